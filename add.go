@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// cmdAdd adds a new dependency with go get, and generates manifests
+// for it and any modules it pulls in, listing the new ones.
+// Given a package, it's generated as if the repository imported it already,
+// so a module nothing imports yet gets only what that package needs.
+func cmdAdd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mud add <module|package>[@version]")
+	}
+	path, version, _ := strings.Cut(args[0], "@")
+	if version == "" {
+		version = "latest"
+	}
+
+	if *dryRun {
+		return errors.New("mud add changes go.mod, so it can't be a dry run")
+	}
+
+	prog.Phase("adding")
+	slog.Info("adding", "module", path, "version", version)
+	err := keepHolds(func() error {
+		_, err := goCmd("get", path+"@"+version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// make sure it resolves to a module, or a package in one
+	_, modErr := goCmd("list", "-m", path)
+	out, pkgErr := goCmd("list", "-f", "{{.Name}}", path)
+	if modErr != nil && pkgErr != nil {
+		return fmt.Errorf("%s doesn't resolve to a module or a package: %w", path, modErr)
+	}
+
+	// nothing may import the package yet, so load it explicitly,
+	// without its tests, like the next run will once something does
+	if pkgErr == nil && len(strings.TrimSpace(string(out))) > 0 {
+		extraRoots = append(extraRoots, path)
+	}
+	reuseHashes = true
+	if err := regenerate(); err != nil {
+		return err
+	}
+
+	prog.Done()
+	if *quiet {
+		return nil
+	}
+	for _, c := range changes {
+		dir := filepath.ToSlash(filepath.Dir(c.Path))
+		if c.Created && filepath.Base(c.Path) == "default.nix" && dir != gopkgsDir {
+			fmt.Printf("new: //%s\n", dir)
+		}
+	}
+	return nil
+}
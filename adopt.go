@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// overridesName is the hand-maintained file next to a module's expression
+// with attributes merged over the ones mud generates, as mud adopt leaves them.
+const overridesName = "overrides.nix"
+
+// adoptedOverrides are the overrides mud adopt -write is writing,
+// so the expressions generated in the same run already import them.
+var adoptedOverrides map[Path][]byte
+
+// Overrides returns the name of the module's overrides file, if it has one.
+func (m *Module) Overrides() string {
+	if adoptedOverrides[m.Path] != nil {
+		return overridesName
+	}
+	if _, err := os.Stat(filepath.Join(m.OutDir(), overridesName)); err == nil {
+		return overridesName
+	}
+	return ""
+}
+
+// managedAttrs are the attributes of buildGo.external the generated
+// expressions set, so they're not kept from hand-written ones.
+var managedAttrs = map[string]bool{
+	"path": true, "src": true, "subPackages": true, "deps": true,
+	"goVersion": true, "toolchain": true,
+}
+
+var overridesTmpl = template.Must(template.New("overrides").Parse(`
+# Attributes kept by mud adopt from the hand-written expression for {{.Path}},
+# merged over the ones mud generates in default.nix.
+# mud won't touch this file again, so review it, and edit it as needed.
+{{.Formals}}
+
+{{with .Preamble}}{{.}}
+{{end -}}
+{
+{{- range .Bindings}}
+  {{.}}
+{{- end}}
+}
+`[1:]))
+
+// handWritten is a hand-written expression for a module in the graph.
+type handWritten struct {
+	file string
+	mod  *Module
+	man  *Manifest
+	// expr is what could be made out of it, unless err says why not
+	expr *externalExpr
+	err  error
+	// deps are the modules it refers to
+	deps map[Path]bool
+}
+
+// cmdAdopt finds the hand-written expressions in the gopkgs dir
+// for modules mud would generate, and reports where they diverge
+// from the module graph: their version, hash and deps.
+// With -write, they're replaced with generated expressions,
+// and the attributes mud doesn't generate are kept in an overrides.nix
+// next to each, which the generated expression merges over its own.
+func cmdAdopt(args []string) error {
+	flags := flag.NewFlagSet("adopt", flag.ContinueOnError)
+	write := flags.Bool("write", false, "replace the hand-written expressions with generated ones, keeping their other attributes in "+overridesName)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: mud adopt [-write]")
+	}
+	if config.Generator != "buildgo" {
+		return fmt.Errorf("mud adopt brings expressions under the buildgo generator, so it can't be used with %s", config.Generator)
+	}
+
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if err != nil {
+		return err
+	}
+	byDir := make(map[string]*Module)
+	known := make(map[Path]*Manifest)
+	for path, mod := range modules {
+		known[path] = nil
+		if mod.IsExternal() {
+			byDir[mod.OutDir()] = mod
+			byDir[mod.legacyOutDir()] = mod
+		}
+	}
+
+	var found []*handWritten
+	var stray []string
+	err = filepath.WalkDir(gopkgsDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		dir := filepath.ToSlash(filepath.Dir(name))
+		if d.IsDir() || d.Name() != "default.nix" || dir == gopkgsDir {
+			return nil
+		}
+		data, err := os.ReadFile(name)
+		if err != nil || parseManifest(data) != nil {
+			return err
+		}
+		mod := byDir[dir]
+		switch {
+		case mod == nil:
+			stray = append(stray, name)
+			return nil
+		case mod.IsVendored():
+			// vendored modules are meant to have hand-written expressions
+			return nil
+		case !config.Selected(mod.Path):
+			slog.Warn("not adopting an expression for a module left out by -only or -exclude", "file", name, "module", mod.Path)
+			return nil
+		}
+
+		h := &handWritten{file: name, mod: mod, man: scanManifest(data), deps: make(map[Path]bool)}
+		h.expr, h.err = parseExternal(string(data))
+		err = scanRefs(name, func(line int, ref Path) {
+			if path, _ := findModule(known, ref); path != "" && path != mod.Path {
+				h.deps[path] = true
+			}
+		})
+		found = append(found, h)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var fetched []*Module
+	for _, h := range found {
+		if !h.mod.IsLocal() {
+			fetched = append(fetched, h.mod)
+		}
+	}
+	prog.Phase("downloading")
+	if err := downloadMissing(fetched); err != nil {
+		return err
+	}
+
+	prog.Done()
+	var unparsed []string
+	for _, h := range found {
+		if err := h.report(os.Stdout); err != nil {
+			return err
+		}
+		if h.err != nil {
+			unparsed = append(unparsed, h.file)
+		}
+	}
+	for _, name := range stray {
+		fmt.Printf("//%s: hand-written, and no module in the graph is generated here\n", filepath.ToSlash(name))
+	}
+	if len(found) == 0 {
+		slog.Info("no hand-written expressions to adopt")
+		return nil
+	}
+	if !*write {
+		slog.Info("run mud adopt -write to replace them with generated expressions", "expressions", len(found))
+		return nil
+	}
+	if len(unparsed) > 0 {
+		return errors.New(withHint(fmt.Sprintf("can't tell the attributes of %s apart", strings.Join(unparsed, ", ")),
+			"move whatever should be kept out of them by hand, or remove them to have mud generate them afresh"))
+	}
+
+	adoptedOverrides = make(map[Path][]byte)
+	for _, h := range found {
+		if len(h.expr.Bindings) == 0 {
+			continue
+		}
+		var buffer bytes.Buffer
+		if err := overridesTmpl.Execute(&buffer, struct {
+			Path Path
+			*externalExpr
+		}{h.mod.Path, h.expr}); err != nil {
+			return err
+		}
+		adoptedOverrides[h.mod.Path] = buffer.Bytes()
+	}
+	return regenerateWith(func(modules map[Path]*Module) error {
+		for _, path := range sortedPaths(modules) {
+			if data := adoptedOverrides[path]; data != nil {
+				if err := emitFile(modules[path].OutDir(), overridesName, data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// report prints how a hand-written expression diverges from the graph,
+// and what adopting it would keep.
+func (h *handWritten) report(w io.Writer) error {
+	mod := h.mod
+	fmt.Fprintf(w, "//%s: %s %s\n", filepath.ToSlash(h.file), mod.Path, mod.describe())
+
+	if !mod.IsLocal() {
+		switch version := strings.TrimPrefix(h.man.Version, "v"); {
+		case version == "":
+			fmt.Fprintf(w, "  version: none found, the graph has v%s\n", mod.Version)
+		case version != mod.Version:
+			fmt.Fprintf(w, "  version: v%s here, v%s in the graph\n", version, mod.Version)
+		}
+		if err := h.reportHash(w); err != nil {
+			return err
+		}
+	}
+
+	var missing, extra []string
+	imported := make(map[Path]bool)
+	for _, dep := range mod.DepModules() {
+		imported[dep.Path] = true
+		if !h.deps[dep.Path] {
+			missing = append(missing, string(dep.Path))
+		}
+	}
+	for path := range h.deps {
+		if !imported[path] {
+			extra = append(extra, string(path))
+		}
+	}
+	sort.Strings(extra)
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "  deps: missing %s\n", strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		fmt.Fprintf(w, "  deps: %s, which it doesn't import\n", strings.Join(extra, ", "))
+	}
+
+	switch {
+	case h.err != nil:
+		fmt.Fprintf(w, "  attributes: %v\n", h.err)
+	case len(h.expr.Bindings) > 0:
+		var names []string
+		for _, b := range h.expr.Bindings {
+			names = append(names, bindingName(b))
+		}
+		fmt.Fprintf(w, "  kept in %s: %s\n", overridesName, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// reportHash compares the hand-written expression's hash
+// with the one mud would generate.
+func (h *handWritten) reportHash(w io.Writer) error {
+	mod := h.mod
+	if mod.hashedBySum() {
+		return nil
+	}
+	if h.man.Fetcher != mod.Fetcher() {
+		fmt.Fprintf(w, "  hash: fetched with %s here, mud fetches with %s\n", h.man.Fetcher, mod.Fetcher())
+		return nil
+	}
+	if h.man.SHA256 == "" {
+		fmt.Fprintf(w, "  hash: none found\n")
+		return nil
+	}
+	have, err := parseNixHash(h.man.SHA256)
+	if err != nil {
+		fmt.Fprintf(w, "  hash: %v\n", err)
+		return nil
+	}
+	want, err := mod.NARHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(have, want) {
+		fmt.Fprintf(w, "  hash: doesn't match the module's source\n")
+	}
+	return nil
+}
+
+// externalExpr is what mud adopt keeps of a hand-written buildGo.external expression.
+type externalExpr struct {
+	// Formals are the function's arguments, with the colon
+	Formals string
+	// Preamble is whatever comes between them and the call, like a let block
+	Preamble string
+	// Bindings are the attributes passed that mud doesn't generate, verbatim
+	Bindings []string
+}
+
+// parseExternal picks apart an expression calling buildGo.external
+// with an attrset, well enough to tell its attributes apart.
+func parseExternal(s string) (*externalExpr, error) {
+	e := &externalExpr{Formals: "{ platform, pkgs, ... }:"}
+	i := skipNixSpace(s, 0)
+	// args:, { ... }:, args@{ ... }: or { ... }@args:
+	j := i
+	if name := nixNameRe.FindString(s[j:]); name != "" {
+		j = skipNixSpace(s, j+len(name))
+		if j < len(s) && s[j] == '@' {
+			j = skipNixSpace(s, j+1)
+		}
+	}
+	if j < len(s) && s[j] == '{' {
+		j = skipNixSpace(s, nixEnd(s, j+1, false)+1)
+		if j < len(s) && s[j] == '@' {
+			j = skipNixSpace(s, j+1)
+			j = skipNixSpace(s, j+len(nixNameRe.FindString(s[j:])))
+		}
+	}
+	if j < len(s) && s[j] == ':' {
+		e.Formals = s[i : j+1]
+		i = j + 1
+	}
+
+	call := strings.Index(s[i:], "buildGo.external")
+	if call < 0 {
+		return nil, errors.New("it doesn't call buildGo.external")
+	}
+	callee := strings.LastIndexAny(s[:i+call], " \t\n(") + 1
+	if callee < i {
+		callee = i
+	}
+	e.Preamble = strings.TrimSpace(s[i:callee])
+
+	j = skipNixSpace(s, i+call+len("buildGo.external"))
+	if strings.HasPrefix(s[j:], "rec") {
+		j = skipNixSpace(s, j+len("rec"))
+	}
+	if j >= len(s) || s[j] != '{' {
+		return nil, errors.New("buildGo.external isn't given an attrset")
+	}
+	for j = skipNixSpace(s, j+1); j < len(s) && s[j] != '}'; j = skipNixSpace(s, j) {
+		end := nixEnd(s, j, true)
+		if end >= len(s) || s[end] != ';' {
+			return nil, errors.New("its attributes don't parse")
+		}
+		binding := s[j : end+1]
+		if !managedAttrs[bindingName(binding)] {
+			e.Bindings = append(e.Bindings, binding)
+		}
+		j = end + 1
+	}
+	if j >= len(s) {
+		return nil, errors.New("its attrset isn't closed")
+	}
+	return e, nil
+}
+
+// bindingName is the attribute a binding sets, going by the first
+// element of its attr path, or "inherit" for an inherit.
+func bindingName(binding string) string {
+	if strings.HasPrefix(binding, "inherit") {
+		return "inherit"
+	}
+	name, _, _ := strings.Cut(binding, "=")
+	name, _, _ = strings.Cut(strings.TrimSpace(name), ".")
+	return strings.Trim(name, `"`)
+}
+
+// nixNameRe matches a Nix identifier at the start of a string.
+var nixNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*`)
+
+// skipNixSpace skips whitespace and comments from i.
+func skipNixSpace(s string, i int) int {
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r':
+			i++
+		case s[i] == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return len(s)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// nixEnd returns the index of the first unmatched closing bracket from i,
+// or of the first semicolon ending a binding if semis is set,
+// outside strings, comments, nested brackets and let blocks.
+// The semicolons of with and assert don't count.
+func nixEnd(s string, i int, semis bool) int {
+	depth, pending := 0, 0
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == '#' || strings.HasPrefix(s[i:], "/*"):
+			i = skipNixSpace(s, i)
+			continue
+		case c == '"':
+			i = nixStringEnd(s, i+1, `"`)
+			continue
+		case strings.HasPrefix(s[i:], "''"):
+			i = nixStringEnd(s, i+2, "''")
+			continue
+		case nixNameRe.MatchString(s[i:]):
+			name := nixNameRe.FindString(s[i:])
+			switch {
+			case name == "let":
+				depth++
+			case name == "in" && depth > 0:
+				depth--
+			case (name == "with" || name == "assert") && depth == 0:
+				pending++
+			}
+			i += len(name)
+			continue
+		case c == '{' || c == '[' || c == '(':
+			depth++
+		case c == '}' || c == ']' || c == ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case c == ';' && depth == 0 && pending > 0:
+			pending--
+		case c == ';' && semis && depth == 0:
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// nixStringEnd returns the index just past the end of a string
+// whose contents start at i, and which quote ends.
+func nixStringEnd(s string, i int, quote string) int {
+	for i < len(s) {
+		switch {
+		case quote == `"` && s[i] == '\\':
+			i += 2
+		case quote == "''" && strings.HasPrefix(s[i:], "''\\"):
+			i += 4
+		case quote == "''" && (strings.HasPrefix(s[i:], "'''") || strings.HasPrefix(s[i:], "''$")):
+			i += 3
+		case strings.HasPrefix(s[i:], "${"):
+			i = nixEnd(s, i+2, false) + 1
+		case strings.HasPrefix(s[i:], quote):
+			return i + len(quote)
+		default:
+			i++
+		}
+	}
+	return i
+}
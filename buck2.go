@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"golang.org/x/mod/module"
+)
+
+// buckProxy is where Buck2 downloads module zips from.
+// The zips are the same everywhere, so it's the public proxy
+// rather than whatever GOPROXY says on the machine mud ran on.
+const buckProxy = "https://proxy.golang.org"
+
+// buckTmpl renders every module into a single BUCK file:
+// an http_archive of its zip from the module proxy,
+// and a go_library (or go_binary, for commands) for each package used from it,
+// built from the archive's files, for repositories building with Buck2
+// rather than Nix. Packages are targets named after their import path,
+// //third_party/gopkgs:golang.org_x_mod_modfile, say.
+var buckTmpl = template.Must(template.New("buck2").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{{range .}}
+# {{.Path}} {{.Version}}
+http_archive(
+    name = {{quote .Name}},
+    urls = [{{quote .URL}}],
+    sha256 = {{quote .SHA256}},
+    strip_prefix = {{quote .StripPrefix}},
+    sub_targets = [
+{{- range .Files}}
+        {{quote .}},
+{{- end}}
+    ],
+)
+{{range .Packages}}
+{{if .Main}}go_binary{{else}}go_library{{end}}(
+    name = {{quote .Name}},
+{{- if not .Main}}
+    package_name = {{quote .Path}},
+{{- end}}
+    srcs = [
+{{- range .Srcs}}
+        {{quote .}},
+{{- end}}
+    ],
+{{- with .Deps}}
+    deps = [
+{{- range .}}
+        {{quote .}},
+{{- end}}
+    ],
+{{- end}}
+    visibility = ["PUBLIC"],
+)
+{{end}}
+{{- end -}}
+`[1:]))
+
+// buckArchive is the template data for a module's targets.
+type buckArchive struct {
+	Path, Version string
+	Name          string
+	URL, SHA256   string
+	StripPrefix   string
+	// Files are the archive's files the packages are built from
+	Files    []string
+	Packages []*buckPackage
+}
+
+// buckPackage is the template data for a package's target.
+type buckPackage struct {
+	Path string
+	Name string
+	Main bool
+	// Srcs and Deps are target labels
+	Srcs, Deps []string
+}
+
+// buckNameRe matches what can't be in a Buck2 target name.
+var buckNameRe = regexp.MustCompile(`[^A-Za-z0-9_.+=,@~-]`)
+
+// buckName is the target name for a package or module path.
+func buckName(path Path) string {
+	return buckNameRe.ReplaceAllString(string(path), "_")
+}
+
+// zipSHA256 is the SHA-256 of the module's zip in the download cache,
+// which http_archive checks the download against. It's a hash of the archive
+// rather than of the tree it extracts to, so the modules' NAR hashes won't do.
+func zipSHA256(mv module.Version) (string, error) {
+	name, err := downloadPath(mv, ".zip")
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return "", &notCachedError{Module: mv.String()}
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func buckArchiveOf(mod *Module, targets map[string]Path) (*buckArchive, error) {
+	if mod.IsLocal() || mod.IsVendored() {
+		return nil, fmt.Errorf("%s is replaced by %s, and the buck2 generator can only build modules from the module proxy", mod.Path, mod.ReplacePath)
+	}
+	mv := mod.ModuleVersion()
+	escPath, err := module.EscapePath(mv.Path)
+	if err != nil {
+		return nil, err
+	}
+	escVersion, err := module.EscapeVersion(mv.Version)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := zipSHA256(mv)
+	if err != nil {
+		return nil, err
+	}
+	a := &buckArchive{
+		Path:        string(mod.Path),
+		Version:     "v" + mod.Version,
+		Name:        buckName(mod.Path) + ".src",
+		URL:         buckProxy + "/" + escPath + "/@v/" + escVersion + ".zip",
+		SHA256:      sum,
+		StripPrefix: mv.Path + "@" + mv.Version,
+	}
+	if other, ok := targets[a.Name]; ok {
+		return nil, fmt.Errorf("%s and %s would both be named %s", other, mod.Path, a.Name)
+	}
+	targets[a.Name] = mod.Path
+
+	paths := make([]Path, 0, len(mod.Pkgs))
+	for path := range mod.Pkgs {
+		paths = append(paths, path)
+	}
+	sortPaths(paths)
+	for _, path := range paths {
+		pkg := mod.Pkgs[path]
+		if len(pkg.GoFiles) == 0 || strings.HasSuffix(string(path), ".test") {
+			continue // nothing to build, or a test main
+		}
+		p := &buckPackage{Path: string(path), Name: buckName(path), Main: pkg.Name == "main"}
+		if other, ok := targets[p.Name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be named %s", other, path, p.Name)
+		}
+		targets[p.Name] = path
+		for _, f := range pkg.GoFiles {
+			rel, err := filepath.Rel(mod.Dir, f)
+			if err != nil {
+				return nil, err
+			}
+			rel = filepath.ToSlash(rel)
+			a.Files = append(a.Files, rel)
+			p.Srcs = append(p.Srcs, ":"+a.Name+"["+rel+"]")
+		}
+		for _, imp := range pkg.Imports.Sorted() {
+			p.Deps = append(p.Deps, ":"+buckName(imp))
+		}
+		a.Packages = append(a.Packages, p)
+	}
+	sort.Strings(a.Files)
+	return a, nil
+}
+
+// generateBuck2 writes all modules into a BUCK file in the gopkgs dir.
+// The packages' files come from the package loading,
+// so imports point at the other targets in it.
+func generateBuck2(selected, all []*Module) error {
+	var archives []*buckArchive
+	targets := make(map[string]Path)
+	for i, mod := range all {
+		prog.Step(i+1, len(all), string(mod.Path))
+		a, err := buckArchiveOf(mod, targets)
+		if err != nil {
+			return err
+		}
+		archives = append(archives, a)
+	}
+	// every import needs a target, which only a first-party package
+	// imported back by a module won't have
+	for _, a := range archives {
+		for _, p := range a.Packages {
+			for _, dep := range p.Deps {
+				if _, ok := targets[dep[1:]]; !ok {
+					return fmt.Errorf("%s imports %s, which has no target in the BUCK file", p.Path, dep[1:])
+				}
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	if err := buckTmpl.Execute(&buffer, archives); err != nil {
+		return err
+	}
+	return emitFile(gopkgsDir, "BUCK", buffer.Bytes())
+}
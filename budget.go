@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	slashpath "path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Budget caps how far the dependency graph may grow, as mud check enforces.
+// Zero leaves a cap off.
+type Budget struct {
+	// MaxModules caps the number of external modules.
+	MaxModules int `json:"maxModules"`
+	// MaxSize caps their total unpacked source size, like "200MiB".
+	MaxSize string `json:"maxSize"`
+	// MaxNewModules caps how many external modules a change may add
+	// over the revision given to mud check -base.
+	MaxNewModules int `json:"maxNewModules"`
+}
+
+func (b *Budget) enabled() bool {
+	return b.MaxModules > 0 || b.MaxSize != "" || b.MaxNewModules > 0
+}
+
+func (b *Budget) validate() error {
+	if b.MaxModules < 0 || b.MaxNewModules < 0 {
+		return fmt.Errorf("budgets can't be negative")
+	}
+	if b.MaxSize != "" {
+		if _, err := parseSize(b.MaxSize); err != nil {
+			return fmt.Errorf("bad size budget: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseSize parses a size in bytes, with an optional decimal or binary unit.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(n), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a size", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// budgetError is a budget the graph goes over,
+// with a breakdown of what takes it there.
+type budgetError struct {
+	Budget    string
+	Breakdown []string
+}
+
+func (e *budgetError) Error() string {
+	var b strings.Builder
+	b.WriteString("over budget: " + e.Budget)
+	for _, line := range e.Breakdown {
+		b.WriteString("\n  " + line)
+	}
+	return b.String()
+}
+
+// budgetBreakdown is how many lines of breakdown a budget error gets.
+const budgetBreakdown = 10
+
+// checkBudget checks the external modules in mods against the budget.
+// base is a git revision whose go.sum files tell which modules are new,
+// for MaxNewModules; without one, that budget isn't checked.
+func checkBudget(modules map[Path]*Module, mods []*Module, base string) ([]error, error) {
+	budget := &config.Budget
+	prog.Phase("checking budget")
+	var over []error
+
+	if budget.MaxModules > 0 && len(mods) > budget.MaxModules {
+		// what each direct dependency brings in with it
+		type closure struct {
+			path Path
+			n    int
+		}
+		var closures []closure
+		for _, mod := range directModules(modules) {
+			closures = append(closures, closure{mod.Path, len(moduleClosure(mod))})
+		}
+		sort.SliceStable(closures, func(i, j int) bool { return closures[i].n > closures[j].n })
+		e := &budgetError{Budget: fmt.Sprintf("%d external modules, over the limit of %d", len(mods), budget.MaxModules)}
+		for _, c := range closures[:min(len(closures), budgetBreakdown)] {
+			e.Breakdown = append(e.Breakdown, fmt.Sprintf("%s brings in %d", c.path, c.n))
+		}
+		over = append(over, e)
+	}
+
+	if budget.MaxSize != "" {
+		limit, err := parseSize(budget.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		sizes := make(map[*Module]int64)
+		var total int64
+		for _, mod := range mods {
+			n, err := mod.narSize()
+			if err != nil {
+				return nil, err
+			}
+			sizes[mod] = n
+			total += n
+		}
+		if total > limit {
+			largest := append([]*Module(nil), mods...)
+			sort.SliceStable(largest, func(i, j int) bool { return sizes[largest[i]] > sizes[largest[j]] })
+			e := &budgetError{Budget: fmt.Sprintf("%s of module sources, over the limit of %s", formatSize(total), formatSize(limit))}
+			for _, mod := range largest[:min(len(largest), budgetBreakdown)] {
+				e.Breakdown = append(e.Breakdown, fmt.Sprintf("%s is %s", mod.Path, formatSize(sizes[mod])))
+			}
+			over = append(over, e)
+		}
+	}
+
+	if budget.MaxNewModules > 0 && base != "" {
+		before, err := baseModules(base)
+		if err != nil {
+			return nil, err
+		}
+		var added []*Module
+		for _, mod := range mods {
+			if !mod.IsLocal() && !before[mod.ModuleVersion().Path] {
+				added = append(added, mod)
+			}
+		}
+		if len(added) > budget.MaxNewModules {
+			importers := make(map[*Module][]string)
+			for _, path := range sortedPaths(modules) {
+				for dep := range modules[path].Deps {
+					importers[dep] = append(importers[dep], string(path))
+				}
+			}
+			e := &budgetError{Budget: fmt.Sprintf("%d modules added since %s, over the limit of %d", len(added), base, budget.MaxNewModules)}
+			for _, mod := range added[:min(len(added), budgetBreakdown)] {
+				e.Breakdown = append(e.Breakdown, fmt.Sprintf("%s, imported by %s", mod.Path, strings.Join(importers[mod], ", ")))
+			}
+			over = append(over, e)
+		}
+	}
+	return over, nil
+}
+
+// directModules returns the external modules the repository's own modules import.
+func directModules(modules map[Path]*Module) []*Module {
+	direct := make(map[*Module]bool)
+	for _, mod := range modules {
+		if mod.IsExternal() {
+			continue
+		}
+		for dep := range mod.Deps {
+			if dep.IsExternal() {
+				direct[dep] = true
+			}
+		}
+	}
+	var mods []*Module
+	for mod := range direct {
+		mods = append(mods, mod)
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].Path < mods[j].Path })
+	return mods
+}
+
+// moduleClosure returns the module and every module it depends on, transitively.
+func moduleClosure(mod *Module) map[*Module]bool {
+	seen := map[*Module]bool{mod: true}
+	queue := []*Module{mod}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		for dep := range m.Deps {
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return seen
+}
+
+func sortedPaths(modules map[Path]*Module) []Path {
+	var paths []Path
+	for path := range modules {
+		paths = append(paths, path)
+	}
+	sortPaths(paths)
+	return paths
+}
+
+// baseModules returns the paths of the modules whose sources the go.sum files
+// of the repository's modules had at the git revision base.
+func baseModules(base string) (map[string]bool, error) {
+	dirs, err := repoModules()
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]bool)
+	for _, dir := range dirs {
+		name := slashpath.Join(dir, "go.sum")
+		cmd := exec.Command("git", "show", base+":./"+name)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := stderr.String(); strings.Contains(msg, "does not exist") || strings.Contains(msg, "exists on disk, but not in") {
+				continue // a module added since, or one without dependencies
+			}
+			return nil, fmt.Errorf("git show %s:%s: %w\n%s", base, name, err, stderr.Bytes())
+		}
+		sums, err := parseGoSum(base+":"+name, bytes.NewReader(out))
+		if err != nil {
+			return nil, err
+		}
+		for mv := range sums {
+			paths[mv.Path] = true
+		}
+	}
+	return paths, nil
+}
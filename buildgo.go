@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// srcTmpl renders the src of an external module's expression.
+// Shared with the tool program expressions, which fetch the same sources.
+var srcTmpl = template.Must(template.New("src").Funcs(templateFuncs).Parse(`
+{{- with .GitSource}}
+{{- if eq .Fetcher "github"}}
+  src = pkgs.fetchFromGitHub {
+    owner = "{{.Owner}}";
+    repo = "{{.Repo}}";
+{{- else}}
+  src = pkgs.fetchgit {
+    url = "{{.URL}}";
+{{- end}}
+    rev = "{{.Rev}}";
+    sha256 = "{{$.ModSHA256}}";
+  }{{with .Subdir}} + "/{{.}}"{{end}};
+{{- else}}
+  src = platform.lib.fetchGoModule {
+{{- if .ReplacePath}}
+    path = "{{.ReplacePath}}";
+{{- else}}
+    inherit path;
+{{- end}}
+    version = "{{.Version}}";
+{{- with .ModSHA256}}
+    sha256 = "{{.}}";
+{{- end}}
+{{- with .Sum}}
+    goSum = "{{.}}";
+{{- end}}
+{{- with .SourceExcludes}}
+    exclude = [{{range .}} {{.}}{{end}} ];
+{{- end}}
+{{- with .VCS}}
+    rev = "{{.Rev}}";
+{{- with .URL}}
+    vcsUrl = "{{.}}";
+{{- end}}
+{{- with .Subdir}}
+    subdir = "{{.}}";
+{{- end}}
+{{- end}}
+  };
+{{- end}}`))
+
+var tmpl = template.Must(template.Must(srcTmpl.Clone()).New("external").Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{{- with .BuildNames}}
+# needed by builds:{{range .}} {{.}}{{end}}
+{{- end}}
+{{- with .RequiredBy}}
+# required by:
+{{- range .}}
+#   {{.}}
+{{- end}}
+{{- end}}
+{ platform, pkgs, ... }{{if .Overrides}}@args{{end}}:
+
+platform.buildGo.external {{if .Overrides}}(rec{{else}}rec{{end}} {
+  path = "{{.Path}}";
+{{- with .GoVersion}}
+  goVersion = "{{.}}";
+{{- end}}
+{{- with .Toolchain}}
+  toolchain = "{{.}}";
+{{- end}}
+{{- template "src" .}}
+{{- with .SubPackages}}
+  subPackages = [
+{{- range .}}
+    "{{.}}"
+{{- end}}
+  ];
+{{- end}}
+{{- with .Imports}}
+  deps = with {{gopkgsScope}}; [
+{{- range .}}
+    {{gopkgsName}}.{{.NixAttr}}
+{{- end}}
+  ];
+{{- end}}
+{{- with .Meta}}
+  meta = {
+{{- range .Attrs}}
+    {{.Name}} = {{.Value}};
+{{- end}}
+  };
+{{- end}}
+}{{with .Overrides}} // import ./{{.}} args){{end}}
+`[1:]))
+
+var localTmpl = template.Must(template.New("local").Funcs(templateFuncs).Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{{- with .BuildNames}}
+# needed by builds:{{range .}} {{.}}{{end}}
+{{- end}}
+{{- with .RequiredBy}}
+# required by:
+{{- range .}}
+#   {{.}}
+{{- end}}
+{{- end}}
+{ platform, pkgs, ... }{{if .Overrides}}@args{{end}}:
+
+platform.buildGo.external {{if .Overrides}}(rec{{else}}rec{{end}} {
+  path = "{{.Path}}";
+{{- with .GoVersion}}
+  goVersion = "{{.}}";
+{{- end}}
+{{- with .Toolchain}}
+  toolchain = "{{.}}";
+{{- end}}
+  src = builtins.path {
+    path = {{.LocalSrc}};
+    name = "source";
+{{- with .NixFilter}}
+    filter = {{.}};
+{{- end}}
+    sha256 = "{{.ModSHA256}}";
+  };
+{{- with .SubPackages}}
+  subPackages = [
+{{- range .}}
+    "{{.}}"
+{{- end}}
+  ];
+{{- end}}
+{{- with .Imports}}
+  deps = with {{gopkgsScope}}; [
+{{- range .}}
+    {{gopkgsName}}.{{.NixAttr}}
+{{- end}}
+  ];
+{{- end}}
+}{{with .Overrides}} // import ./{{.}} args){{end}}
+`[1:]))
+
+var scaffoldTmpl = template.Must(template.New("scaffold").Funcs(templateFuncs).Parse(`
+# starter expression generated by //tools/mud.
+# mud won't touch this file again, so edit it as needed.
+{{- with .PackageList}}
+#
+# packages used from this module:
+{{- range .}}
+#   {{.}}
+{{- end}}
+{{- end}}
+{ platform, ... }:
+
+platform.buildGo.package {
+  name = "{{.Name}}";
+  path = "{{.Path}}";
+  srcs = [
+{{- range .RootSrcs}}
+    ./{{.}}
+{{- end}}
+  ];
+{{- with .Imports}}
+  deps = with {{gopkgsScope}}; [
+{{- range .}}
+    {{gopkgsName}}.{{.NixAttr}}
+{{- end}}
+  ];
+{{- end}}
+}
+`[1:]))
+
+// moveLegacy removes what mud generated for a module
+// in its old unescaped dir, once -escape-dirs has put it in its new one.
+func moveLegacy(mod *Module) error {
+	dir := mod.legacyOutDir()
+	if dir == mod.OutDir() {
+		return nil
+	}
+	man, err := readManifest(filepath.Join(dir, "default.nix"))
+	if err != nil || man == nil || man.Path != string(mod.Path) {
+		return err
+	}
+	if err := removeFile(filepath.Join(dir, sidecarName)); err != nil {
+		return err
+	}
+	return removeFile(filepath.Join(dir, "default.nix"))
+}
+
+// generateBuildGo writes a buildGo.external expression for each module,
+// and an index of all of them.
+func generateBuildGo(selected, all []*Module) error {
+	external, err := externalTemplate()
+	if err != nil {
+		return err
+	}
+	var buffer bytes.Buffer
+	for i, mod := range selected {
+		prog.Step(i+1, len(selected), string(mod.Path))
+
+		buffer.Reset()
+		outDir := mod.OutDir()
+		t := external
+		if mod.IsVendored() {
+			// vendored packages don't use buildGo.external,
+			// so we don't generate a manifest for them.
+			// they are expected to have their own buildGo expressions,
+			// like any other in-tree code.
+			// if there isn't one yet, give them something to start from.
+			if _, err := os.Stat(filepath.Join(outDir, "default.nix")); !os.IsNotExist(err) {
+				continue
+			}
+			if err := scaffoldTmpl.Execute(&buffer, mod); err != nil {
+				return err
+			}
+			if err := emitFile(outDir, "default.nix", buffer.Bytes()); err != nil {
+				return err
+			}
+			if !readOnly() {
+				slog.Warn("wrote a starter expression, please review it", "file", "//"+outDir+"/default.nix")
+			}
+			continue
+		}
+		if mod.IsLocal() {
+			t = localTmpl
+		}
+
+		slog.Debug("generating", "module", mod.Path, "version", mod.Version)
+		if err := t.Execute(&buffer, mod); err != nil {
+			return err
+		}
+
+		if err := emitFile(outDir, "default.nix", buffer.Bytes()); err != nil {
+			return err
+		}
+		if config.Sidecars {
+			if err := emitSidecar(mod); err != nil {
+				return err
+			}
+		}
+		if err := moveLegacy(mod); err != nil {
+			return err
+		}
+	}
+
+	// the index covers every module, not just the ones selected this run
+	return emitFile(gopkgsDir, "default.nix", indexFile(all))
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// Config holds mud's settings.
+// It is read from mud.json in the repository root, if present,
+// and any flags given on the command line take precedence.
+type Config struct {
+	// Generator selects the kind of expressions to generate:
+	// one of the built-in generators, or a plugin (see runPlugin).
+	Generator string `json:"generator"`
+	// HashFormat selects how ModSHA256 renders hashes:
+	// "base32" (the legacy Nix encoding) or "sri".
+	HashFormat string `json:"hashFormat"`
+	// HashSource selects what gets hashed: "dir" hashes the extracted
+	// module cache dir, "zip" hashes the contents of the module's .zip
+	// in the download cache, independent of how it was extracted.
+	// "gosum" hashes nothing: expressions fetched from the module proxy
+	// carry only the go.sum h1: hash, for fetchGoModule to check instead,
+	// and the rest are hashed as with "dir".
+	HashSource string `json:"hashSource"`
+	// Offline guarantees no network access: only the module cache is used,
+	// the go command is run with GOPROXY=off,
+	// and missing modules are listed rather than downloaded.
+	Offline bool `json:"offline"`
+	// OutputDir is where the expressions of external modules go,
+	// relative to the repository root. They're referred to by the attr path
+	// the dir gets under platform: platform.third_party.gopkgs by default.
+	OutputDir string `json:"outputDir"`
+	// LocalReplace is the policy for replace directives pointing at
+	// directories other than the module's own dir in the output dir:
+	// "error" rejects them, "source" generates an expression
+	// that builds the module from that directory.
+	LocalReplace string `json:"localReplace"`
+	// Only restricts generation to modules matching any of these patterns,
+	// and Exclude skips modules matching any of them.
+	// Patterns are globs, and a trailing /... matches a path and everything under it.
+	Only    []string `json:"only"`
+	Exclude []string `json:"exclude"`
+	// Ignore leaves the packages matching any of these patterns out of the graph,
+	// along with their tests and whatever only they import:
+	// generated mirrors, examples, code for platforms nobody builds.
+	// The patterns are like Only's, but match package paths.
+	Ignore []string `json:"ignore"`
+	// Modules are directories of other modules in the repository,
+	// without a go.work to tie them to the root one.
+	// Each is loaded on its own, and their dependencies generated together.
+	// ScanModules adds every directory with a go.mod.
+	Modules     []string `json:"modules"`
+	ScanModules bool     `json:"scanModules"`
+	// Tools lists packages whose imports declare tool dependencies,
+	// in the style of the tools.go pattern.
+	Tools []ToolsRoot `json:"tools"`
+	// Tags are build tags to load the repository's packages with,
+	// so dependencies behind them end up in the graph.
+	Tags []string `json:"tags"`
+	// Builds are named build configurations to load the graph under.
+	// The generated expressions cover all of them,
+	// and note which builds need each module.
+	Builds []Build `json:"builds"`
+	// Loader selects how packages are loaded: "packages" uses go/packages,
+	// "golist" streams go list's output, which takes much less memory.
+	Loader string `json:"loader"`
+	// ModuleGraph adds the requirements in the go.mod files of dependencies
+	// to their dependencies, on top of the imports of the packages loaded,
+	// so expressions also build with tags or platforms the load didn't cover.
+	ModuleGraph bool `json:"moduleGraph"`
+	// SkipTests loads packages without their tests, which takes about half
+	// the time and memory, and leaves out the modules only tests use.
+	SkipTests bool `json:"skipTests"`
+	// Template is a text/template file to render the expressions
+	// of external modules with, instead of the built-in one.
+	Template string `json:"template"`
+	// FirstPartyDir, if set, is a directory of first-party code to generate
+	// buildGo.package expressions for, next to each package's sources.
+	FirstPartyDir string `json:"firstPartyDir"`
+	// ProgramsDir, if set, is a directory of first-party commands
+	// to generate buildGo.program expressions for.
+	ProgramsDir string `json:"programsDir"`
+	// ToolProgramsDir, if set, is a directory to generate buildGo.program
+	// expressions in for the external commands the tools roots
+	// and tool directives name, one dir per command,
+	// so dev shells can have the tools built along with everything else.
+	ToolProgramsDir string `json:"toolProgramsDir"`
+	// EscapeDirs escapes capitals in the directories of module expressions,
+	// the way the module cache does, so module paths differing only in case
+	// don't collide on case-insensitive filesystems.
+	// Existing expressions are moved on the next run.
+	EscapeDirs bool `json:"escapeDirs"`
+	// Attrs maps module paths to the attr paths they're exposed as
+	// in the index, and referred to by in the generated expressions,
+	// instead of their long names: "github.com/sirupsen/logrus": "logrus"
+	// makes gopkgs.logrus, and its packages gopkgs.logrus.hooks.syslog.
+	// Modules nested in an aliased one come along under the alias.
+	Attrs map[string]string `json:"attrs"`
+	// SourceFilters leave files like test fixtures out of module sources,
+	// both when hashing and when Nix fetches them.
+	SourceFilters []SourceFilter `json:"sourceFilters"`
+	// LocalExclude are names to leave out of locally replaced modules,
+	// in addition to the simple patterns in their .gitignore files.
+	LocalExclude []string `json:"localExclude"`
+	// Incremental remembers the inputs of the last run,
+	// skipping runs where nothing changed
+	// and only rehashing modules whose go.sum entries changed.
+	Incremental bool `json:"incremental"`
+	// CheckNix parses every changed expression with nix-instantiate
+	// before anything is written.
+	CheckNix bool `json:"checkNix"`
+	// Hooks are commands to run after a run changes files.
+	Hooks []Hook `json:"hooks"`
+	// Sources override how matching modules are fetched,
+	// for private modules the module proxy can't serve.
+	Sources []SourceRule `json:"sources"`
+	// CheckUpstream warns about retracted versions and deprecated modules,
+	// which takes a trip to the module proxy.
+	CheckUpstream bool `json:"checkUpstream"`
+	// Sidecars writes a metadata.json next to each module's expression,
+	// for tools that would rather not parse Nix.
+	Sidecars bool `json:"sidecars"`
+	// RequiredBy lists the first-party packages importing each external module
+	// at the top of its expression, to answer "who pulls this in?" from there.
+	RequiredBy bool `json:"requiredBy"`
+	// Journal keeps a log of the modules each run added, removed,
+	// updated or rehashed, in CHANGES.json in the gopkgs dir,
+	// so audits needn't piece the history together from every expression's.
+	Journal bool `json:"journal"`
+	// Metadata fills in meta attributes for external modules from deps.dev.
+	Metadata bool `json:"metadata"`
+	// CodeOwners fills in meta.maintainers with the owners CODEOWNERS gives
+	// each module's expression, so bumps are routed to them for review.
+	// Maintainers rules take precedence, and work without it.
+	CodeOwners  bool             `json:"codeOwners"`
+	Maintainers []MaintainerRule `json:"maintainers"`
+	// Env sets environment variables for the go command,
+	// like GOFLAGS, GOPROXY, GOPRIVATE or GOWORK,
+	// so every machine loads and downloads the same way.
+	Env map[string]string `json:"env"`
+	// CleanEnv leaves out the Go settings of the shell mud runs in,
+	// and those written with go env -w, so only Env applies.
+	// Where things are kept, like GOPATH and GOMODCACHE, is still inherited.
+	CleanEnv bool `json:"cleanEnv"`
+	// Mod is the go command's -mod flag: "readonly", "mod" or "vendor".
+	Mod string `json:"mod"`
+	// Verify checks module hashes somewhere other than go.sum before they're used:
+	// "sumdb" looks them up in the checksum database, as GOSUMDB and GONOSUMDB say.
+	Verify string `json:"verify"`
+	// Policy restricts which modules may be used.
+	Policy Policy `json:"policy"`
+	// Holds freeze modules at their current versions, as hold files do.
+	Holds []Hold `json:"holds"`
+	// Budget caps how far the dependency graph may grow.
+	Budget Budget `json:"budget"`
+	// VulnDB is an OSV database mirrored to disk, as a directory of records or a zip,
+	// to check the versions in use against without going online.
+	VulnDB string `json:"vulnDB"`
+	// Provenance is where to write an in-toto SLSA provenance statement
+	// for the generated files, listing the inputs they came from.
+	// With ProvenanceKey, a PEM Ed25519 private key, it's a signed DSSE envelope.
+	Provenance    string `json:"provenance"`
+	ProvenanceKey string `json:"provenanceKey"`
+	// Strict turns warnings about the modules in use into errors,
+	// and stops a run from writing anything when some modules fail,
+	// rather than generating the rest.
+	Strict bool `json:"strict"`
+}
+
+// Build is a named combination of build tags and target platform.
+// Its tags are used in addition to the global ones.
+type Build struct {
+	Name   string   `json:"name"`
+	Tags   []string `json:"tags"`
+	GOOS   string   `json:"goos"`
+	GOARCH string   `json:"goarch"`
+}
+
+// builds returns the builds to load,
+// which is a single anonymous one if none are configured.
+func (c *Config) builds() []Build {
+	if len(c.Builds) == 0 {
+		return []Build{{Tags: c.Tags}}
+	}
+	builds := make([]Build, len(c.Builds))
+	for i, b := range c.Builds {
+		b.Tags = append(append([]string(nil), c.Tags...), b.Tags...)
+		builds[i] = b
+	}
+	return builds
+}
+
+// ToolsRoot is a package pattern that imports tools,
+// and the build tags that make those imports visible.
+type ToolsRoot struct {
+	Pattern string   `json:"pattern"`
+	Tags    []string `json:"tags"`
+}
+
+var defaultConfig = Config{
+	Generator:    "buildgo",
+	HashFormat:   "base32",
+	HashSource:   "dir",
+	OutputDir:    "third_party/gopkgs",
+	LocalReplace: "error",
+	Loader:       "packages",
+	LocalExclude: []string{".git", ".direnv", "result", "result-*", "*~", ".#*", "#*#", ".*.swp", ".DS_Store"},
+	Tools: []ToolsRoot{
+		{Pattern: "./tools", Tags: []string{"tools"}},
+	},
+}
+
+var config = defaultConfig
+
+var configPath = flag.String("config", "mud.json", "read settings from `file`")
+
+func init() {
+	flag.StringVar(&config.Generator, "generator", config.Generator, "kind of expressions to generate ("+generatorNames()+", or the name of a "+pluginPrefix+"<name> plugin)")
+	flag.StringVar(&config.HashFormat, "hash-format", config.HashFormat, "hash encoding for generated expressions (base32 or sri)")
+	flag.StringVar(&config.HashSource, "hash-source", config.HashSource, "what to hash for external modules (dir, zip, or gosum to trust go.sum instead)")
+	flag.StringVar(&config.OutputDir, "output-dir", config.OutputDir, "write the expressions of external modules to `dir`")
+	flag.StringVar(&config.LocalReplace, "local-replace", config.LocalReplace, "policy for local replaces outside the output dir (error or source)")
+	flag.Var((*stringList)(&config.LocalExclude), "local-exclude", "leave files named like `pattern` out of local replacements (repeatable)")
+	flag.Var((*stringList)(&config.Only), "only", "only generate modules matching `pattern` (repeatable)")
+	flag.Var((*stringList)(&config.Exclude), "exclude", "don't generate modules matching `pattern` (repeatable)")
+	flag.Var((*stringList)(&config.Ignore), "ignore", "leave packages matching `pattern` out of the graph (repeatable)")
+	flag.Var((*stringList)(&config.Modules), "module", "also load the module in `dir` (repeatable)")
+	flag.BoolVar(&config.ScanModules, "scan-modules", config.ScanModules, "load every module in the repository")
+	flag.Var((*toolsFlag)(&config.Tools), "tools", "also load tool dependencies from `pattern[:tag,...]` (repeatable)")
+	flag.Var((*commaList)(&config.Tags), "tags", "comma-separated build `tags` to load packages with")
+	flag.StringVar(&config.Loader, "loader", config.Loader, "how to load packages (packages, or golist to use less memory)")
+	flag.BoolVar(&config.SkipTests, "skip-tests", config.SkipTests, "don't load test packages, or generate the modules only they use")
+	flag.BoolVar(&config.ModuleGraph, "module-graph", config.ModuleGraph, "also make modules depend on everything their go.mod requires")
+	flag.StringVar(&config.Template, "template", config.Template, "render external module expressions with the template in `file`")
+	flag.StringVar(&config.FirstPartyDir, "first-party-dir", config.FirstPartyDir, "generate expressions for first-party packages under `dir`")
+	flag.StringVar(&config.ProgramsDir, "programs-dir", config.ProgramsDir, "generate program expressions for main packages under `dir`")
+	flag.StringVar(&config.ToolProgramsDir, "tool-programs-dir", config.ToolProgramsDir, "generate program expressions for external tools in `dir`")
+	flag.BoolVar(&config.EscapeDirs, "escape-dirs", config.EscapeDirs, "escape capitals in module expression dirs (github.com/!burnt!sushi)")
+	flag.BoolVar(&config.Incremental, "incremental", config.Incremental, "skip work that hasn't changed since the last run")
+	flag.BoolVar(&config.CheckNix, "check-nix", config.CheckNix, "check generated expressions parse, using nix-instantiate")
+	flag.BoolVar(&config.CheckUpstream, "check-upstream", config.CheckUpstream, "warn about retracted versions and deprecated modules")
+	flag.BoolVar(&config.Metadata, "metadata", config.Metadata, "add descriptions, homepages and repositories from deps.dev to expressions")
+	flag.BoolVar(&config.CodeOwners, "code-owners", config.CodeOwners, "add meta.maintainers to expressions from the owners of their files in CODEOWNERS")
+	flag.BoolVar(&config.RequiredBy, "required-by", config.RequiredBy, "list the first-party packages importing each module in its expression")
+	flag.BoolVar(&config.Journal, "journal", config.Journal, "log the module changes of each run to CHANGES.json in the gopkgs dir")
+	flag.BoolVar(&config.Sidecars, "sidecars", config.Sidecars, "write a metadata.json next to each module's expression")
+	flag.StringVar(&config.VulnDB, "vuln-db", config.VulnDB, "check modules for vulnerabilities in the OSV database at `path`")
+	flag.StringVar(&config.Verify, "verify", config.Verify, "verify module hashes against `source` (sumdb)")
+	flag.StringVar(&config.Provenance, "provenance", config.Provenance, "write a SLSA provenance statement for the generated files to `file`")
+	flag.StringVar(&config.ProvenanceKey, "provenance-key", config.ProvenanceKey, "sign the provenance statement with the Ed25519 PEM key in `file`")
+	flag.BoolVar(&config.Strict, "strict", config.Strict, "fail on warnings about the modules in use, and write nothing if any module fails")
+	flag.Var((*envFlag)(&config.Env), "env", "set `NAME=value` in the go command's environment (repeatable)")
+	flag.BoolVar(&config.CleanEnv, "clean-env", config.CleanEnv, "don't inherit Go settings from the shell or go env -w")
+	flag.StringVar(&config.Mod, "mod", config.Mod, "run the go command with -mod=`mode` (readonly, mod or vendor)")
+	flag.BoolVar(&config.Offline, "offline", config.Offline, "never access the network, and fail on modules missing from the module cache")
+}
+
+// loadConfig reads the config file, if it exists,
+// and then re-applies the command line on top of it.
+func loadConfig() error {
+	if err := readConfig(); err != nil {
+		return err
+	}
+	gopkgsDir = filepath.ToSlash(filepath.Clean(config.OutputDir))
+	return nil
+}
+
+// readConfig is loadConfig, up to validating the settings.
+func readConfig() error {
+	data, err := os.ReadFile(*configPath)
+	if os.IsNotExist(err) && !isFlagSet("config") {
+		return config.validate()
+	}
+	if err != nil {
+		return err
+	}
+
+	// start over so flags that accumulate don't see themselves twice
+	config = defaultConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", *configPath, err)
+	}
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	return config.validate()
+}
+
+func (c *Config) validate() error {
+	if _, ok := lookupGenerator(c.Generator); !ok {
+		return fmt.Errorf("unknown generator %q (known: %s, or a %s%[1]s plugin in $PATH)", c.Generator, generatorNames(), pluginPrefix)
+	}
+	if c.Template != "" && c.Generator != "buildgo" {
+		return fmt.Errorf("-template replaces the buildgo generator's template, so it can't be used with %s", c.Generator)
+	}
+	switch c.HashFormat {
+	case "base32", "sri":
+	default:
+		return fmt.Errorf("unknown hash format %q", c.HashFormat)
+	}
+	switch c.HashSource {
+	case "dir", "zip":
+	case "gosum":
+		if c.Generator != "buildgo" {
+			return fmt.Errorf("the gosum hash source needs fetchGoModule, which only the buildgo generator uses")
+		}
+	default:
+		return fmt.Errorf("unknown hash source %q", c.HashSource)
+	}
+	if dir := filepath.Clean(c.OutputDir); !filepath.IsLocal(dir) || dir == "." {
+		return fmt.Errorf("the output dir %q has to be a directory within the repository", c.OutputDir)
+	}
+	switch c.LocalReplace {
+	case "error", "source":
+	default:
+		return fmt.Errorf("unknown local replace policy %q", c.LocalReplace)
+	}
+	switch c.Loader {
+	case "packages", "golist":
+	default:
+		return fmt.Errorf("unknown loader %q", c.Loader)
+	}
+	switch c.Verify {
+	case "":
+	case "sumdb":
+		if c.Offline {
+			return errors.New("-verify=sumdb needs the checksum database, so it can't be used offline")
+		}
+	default:
+		return fmt.Errorf("unknown verification source %q", c.Verify)
+	}
+	if c.ProvenanceKey != "" && c.Provenance == "" {
+		return errors.New("-provenance-key signs the -provenance statement, so it needs one")
+	}
+	switch c.Mod {
+	case "", "readonly", "mod", "vendor":
+	default:
+		return fmt.Errorf("unknown -mod mode %q", c.Mod)
+	}
+	for name := range c.Env {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("bad environment variable name %q", name)
+		}
+	}
+	aliased := make(map[string]string)
+	for path, attr := range c.Attrs {
+		if err := module.CheckPath(path); err != nil {
+			return fmt.Errorf("bad attrs entry: %w", err)
+		}
+		for _, name := range strings.Split(attr, ".") {
+			if !nixIdentRe.MatchString(name) || nixKeyword[name] {
+				return fmt.Errorf("bad attr %q for %s: it has to be a dotted path of plain Nix identifiers", attr, path)
+			}
+		}
+		if other, ok := aliased[attr]; ok {
+			return fmt.Errorf("%s and %s would both be gopkgs.%s", other, path, attr)
+		}
+		aliased[attr] = path
+	}
+	names := make(map[string]bool)
+	for _, b := range c.Builds {
+		if b.Name == "" {
+			return errors.New("builds need a name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("duplicate build %q", b.Name)
+		}
+		names[b.Name] = true
+	}
+	for i := range c.Hooks {
+		if err := c.Hooks[i].validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Policy.validate(); err != nil {
+		return err
+	}
+	if err := c.Budget.validate(); err != nil {
+		return err
+	}
+	patterns := append(append(append(append([]string(nil), c.Only...), c.Exclude...), c.Ignore...), c.Policy.Deny...)
+	for _, rule := range c.Sources {
+		switch rule.Fetcher {
+		case "proxy", "git", "github":
+		default:
+			return fmt.Errorf("unknown fetcher %q for %q", rule.Fetcher, rule.Pattern)
+		}
+		patterns = append(patterns, rule.Pattern)
+	}
+	for _, h := range c.Holds {
+		patterns = append(patterns, h.Pattern)
+	}
+	for _, rule := range c.Maintainers {
+		if len(rule.Maintainers) == 0 {
+			return fmt.Errorf("maintainer rule for %q has no maintainers", rule.Pattern)
+		}
+		patterns = append(patterns, rule.Pattern)
+	}
+	for _, filter := range c.SourceFilters {
+		if filter.Pattern != "" {
+			patterns = append(patterns, filter.Pattern)
+		}
+		for _, p := range filter.Exclude {
+			if _, err := slashpath.Match(strings.TrimSuffix(p, "/"), ""); err != nil || p == "" || strings.HasPrefix(p, "/") {
+				return fmt.Errorf("bad source filter pattern %q", p)
+			}
+		}
+	}
+	for _, pattern := range c.LocalExclude {
+		if _, err := slashpath.Match(pattern, ""); err != nil || strings.Contains(pattern, "/") {
+			return fmt.Errorf("bad local exclude pattern %q: patterns match names, not paths", pattern)
+		}
+	}
+	for _, pattern := range patterns {
+		if _, err := slashpath.Match(strings.TrimSuffix(pattern, "/..."), ""); err != nil {
+			return fmt.Errorf("bad module pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Selected reports whether the filters let a module through.
+func (c *Config) Selected(path Path) bool {
+	if len(c.Only) > 0 && !matchAny(c.Only, string(path)) {
+		return false
+	}
+	return !matchAny(c.Exclude, string(path))
+}
+
+func matchAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches a module path against a glob,
+// where a trailing /... also matches anything below the path.
+func matchPattern(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/..."); ok {
+		for p := path; ; p = slashpath.Dir(p) {
+			if ok, _ := slashpath.Match(prefix, p); ok {
+				return true
+			}
+			if !strings.Contains(p, "/") {
+				return false
+			}
+		}
+	}
+	ok, _ := slashpath.Match(pattern, path)
+	return ok
+}
+
+// stringList is a flag.Value for flags that can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// commaList is a flag.Value for comma-separated lists, like go build -tags.
+type commaList []string
+
+func (l *commaList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *commaList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envFlag is a flag.Value adding NAME=value environment variables.
+type envFlag map[string]string
+
+func (f *envFlag) String() string {
+	var ss []string
+	for name, value := range *f {
+		ss = append(ss, name+"="+value)
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, " ")
+}
+
+func (f *envFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=value, got %q", s)
+	}
+	if *f == nil {
+		*f = make(map[string]string)
+	}
+	(*f)[name] = value
+	return nil
+}
+
+// toolsFlag is a flag.Value adding tools roots, given as pattern[:tag,...].
+type toolsFlag []ToolsRoot
+
+func (f *toolsFlag) String() string {
+	var ss []string
+	for _, root := range *f {
+		s := root.Pattern
+		if len(root.Tags) > 0 {
+			s += ":" + strings.Join(root.Tags, ",")
+		}
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, " ")
+}
+
+func (f *toolsFlag) Set(s string) error {
+	pattern, tags, _ := strings.Cut(s, ":")
+	if pattern == "" {
+		return fmt.Errorf("missing pattern in %q", s)
+	}
+	root := ToolsRoot{Pattern: pattern}
+	if tags != "" {
+		root.Tags = strings.Split(tags, ",")
+	}
+	*f = append(*f, root)
+	return nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
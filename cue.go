@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"text/template"
+)
+
+// cueSchema is the schema the cue generator's modules are checked against,
+// written next to them as schema.cue, in the same package,
+// so evaluating the package (cue vet ./third_party/gopkgs, say)
+// validates every module.
+const cueSchema = `// generator //tools/mud (DO NOT EDIT)
+package gopkgs
+
+// #Module is an external Go module, as used by the repository.
+#Module: {
+	// path is the module path, and the key the module is under
+	path: =~"^[^/]+(/[^/]+)*$"
+	// version is the version in use, unless replaced by a local dir
+	version?: =~"^v[0-9]"
+	// replace is what the module is replaced by in go.mod, if anything
+	replace?: string
+	// local is the dir a local replacement points at, relative to this one
+	local?: string
+	// hash is the SRI hash of the module's source, as Nix sees it,
+	// unless its go.sum hash is trusted instead
+	hash?: =~"^sha256-"
+	// goSum is the module's go.sum hash
+	goSum?:     =~"^h1:"
+	goVersion?: string
+	toolchain?: string
+	// subPackages are the packages used from it, relative to its root
+	subPackages: [...string]
+	// deps are the paths of the modules it imports directly
+	deps: [...string]
+	// requiredBy are the first-party packages importing it directly,
+	// with the requiredBy setting
+	requiredBy?: [...string]
+	licenses?: [...string]
+
+	// the source is either local or fetched and checked
+	if local == _|_ {
+		version: string
+	}
+	if local == _|_ && hash == _|_ {
+		goSum: string
+	}
+}
+
+modules: [Path=string]: #Module & {path: Path}
+`
+
+// cueTmpl renders every module as a value of modules, in gopkgs.cue.
+var cueTmpl = template.Must(template.New("cue").Funcs(template.FuncMap{
+	"cueString": cueString,
+}).Parse(`
+// generator //tools/mud (DO NOT EDIT)
+package gopkgs
+
+modules: {
+{{- range .}}
+	{{cueString .Path}}: {
+{{- with .Version}}
+		version: {{cueString .}}
+{{- end}}
+{{- with .Replace}}
+		replace: {{cueString .}}
+{{- end}}
+{{- with .Local}}
+		local: {{cueString .}}
+{{- end}}
+{{- with .Hash}}
+		hash: {{cueString .}}
+{{- end}}
+{{- with .Sum}}
+		goSum: {{cueString .}}
+{{- end}}
+{{- with .GoVersion}}
+		goVersion: {{cueString .}}
+{{- end}}
+{{- with .Toolchain}}
+		toolchain: {{cueString .}}
+{{- end}}
+		subPackages: [{{range $i, $p := .SubPackages}}{{if $i}}, {{end}}{{cueString $p}}{{end}}]
+		deps: [{{range $i, $d := .Deps}}{{if $i}}, {{end}}{{cueString $d}}{{end}}]
+{{- with .RequiredBy}}
+		requiredBy: [{{range $i, $p := .}}{{if $i}}, {{end}}{{cueString $p}}{{end}}]
+{{- end}}
+{{- with .Licenses}}
+		licenses: [{{range $i, $l := .}}{{if $i}}, {{end}}{{cueString $l}}{{end}}]
+{{- end}}
+	}
+{{- end}}
+}
+`[1:]))
+
+// cueModule is the template data for a module in gopkgs.cue.
+type cueModule struct {
+	Path, Version, Replace, Local string
+	Hash, Sum                     string
+	GoVersion, Toolchain          string
+	SubPackages, Deps             []string
+	RequiredBy, Licenses          []string
+}
+
+// cueString quotes s as a CUE string.
+// JSON's escapes are a subset of CUE's, so its quoting will do.
+func cueString(s string) (string, error) {
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+func cueModuleOf(mod *Module) (*cueModule, error) {
+	c := &cueModule{
+		Path:        string(mod.Path),
+		Replace:     mod.ReplacePath,
+		SubPackages: mod.SubPackages(),
+	}
+	goDirs, err := mod.goDirectives()
+	if err != nil {
+		return nil, err
+	}
+	c.GoVersion, c.Toolchain = goDirs.Go, goDirs.Toolchain
+	for _, dep := range mod.DepModules() {
+		c.Deps = append(c.Deps, string(dep.Path))
+	}
+	for _, path := range mod.requiredBy {
+		c.RequiredBy = append(c.RequiredBy, string(path))
+	}
+	if mod.meta != nil {
+		c.Licenses = mod.meta.Licenses
+	}
+
+	if mod.IsLocal() {
+		if c.Local, err = mod.IndexSrc(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c.Version = "v" + mod.Version
+	c.Sum = mod.Sum()
+	if c.Hash, err = mod.ModSRI(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// generateCUE writes all modules into gopkgs.cue in the gopkgs dir,
+// with the schema they're checked against in schema.cue,
+// for configuration pipelines consuming CUE rather than Nix.
+func generateCUE(selected, all []*Module) error {
+	var mods []*cueModule
+	for i, mod := range all {
+		prog.Step(i+1, len(all), string(mod.Path))
+		c, err := cueModuleOf(mod)
+		if err != nil {
+			return err
+		}
+		mods = append(mods, c)
+	}
+	var buffer bytes.Buffer
+	if err := cueTmpl.Execute(&buffer, mods); err != nil {
+		return err
+	}
+	if err := emitFile(gopkgsDir, "schema.cue", []byte(cueSchema)); err != nil {
+		return err
+	}
+	return emitFile(gopkgsDir, "gopkgs.cue", buffer.Bytes())
+}
@@ -4,7 +4,81 @@ platform.buildGo.program {
   name = "mud";
 
   srcs = [
+    ./add.go
+    ./adopt.go
+    ./buck2.go
+    ./budget.go
+    ./buildgo.go
+    ./config.go
+    ./cue.go
+    ./depsdev.go
+    ./diagnostic.go
+    ./diff.go
+    ./doctor.go
+    ./drift.go
+    ./errors.go
+    ./excludes.go
+    ./explainhash.go
+    ./firstparty.go
+    ./flake.go
+    ./generate.go
+    ./gitfetch.go
+    ./gocmd.go
+    ./golist.go
+    ./gomod.go
+    ./gosum.go
+    ./guix.go
+    ./hold.go
+    ./hooks.go
+    ./import.go
+    ./index.go
+    ./journal.go
+    ./load.go
+    ./loadcache.go
+    ./loadshard.go
+    ./localfilter.go
+    ./lock.go
+    ./lock_unix.go
+    ./log.go
+    ./manifest.go
+    ./mirror.go
+    ./modgraph.go
+    ./module.go
     ./mud.go
+    ./nar.go
+    ./nixcheck.go
+    ./osv.go
+    ./outdated.go
+    ./owners.go
+    ./plugin.go
+    ./policy.go
+    ./output.go
+    ./profile.go
+    ./provenance.go
+    ./progress.go
+    ./refs.go
+    ./report.go
+    ./sidecar.go
+    ./signal.go
+    ./root.go
+    ./sarif.go
+    ./serve.go
+    ./sourcefilter.go
+    ./stage_linux.go
+    ./state.go
+    ./stats.go
+    ./stream.go
+    ./summary.go
+    ./sumdb.go
+    ./templates.go
+    ./tidy.go
+    ./toolprograms.go
+    ./unused.go
+    ./update.go
+    ./upstream.go
+    ./vcs.go
+    ./vendorhash.go
+    ./watch.go
   ];
 
   deps = [
@@ -12,7 +86,11 @@ platform.buildGo.program {
     platform.lib.nix.base32
     platform.lib.tempfile
   ] ++ (with platform.third_party; [
+    gopkgs."golang.org".x.mod.modfile
     gopkgs."golang.org".x.mod.module
+    gopkgs."golang.org".x.mod.semver
+    gopkgs."golang.org".x.mod.sumdb
+    gopkgs."golang.org".x.mod.sumdb.dirhash
     gopkgs."golang.org".x.tools.go.packages
     gopkgs."go.uber.org".multierr
   ]);
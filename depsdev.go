@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// depsDevAPI is the deps.dev API that module metadata comes from.
+const depsDevAPI = "https://api.deps.dev/v3"
+
+// errNotFound is returned by getJSON for what deps.dev doesn't know of,
+// like private modules.
+var errNotFound = errors.New("not found")
+
+// ModuleMeta is descriptive metadata for a module's expression.
+type ModuleMeta struct {
+	Description string
+	Homepage    string
+	Repository  string
+	// Licenses are SPDX expressions
+	Licenses []string
+	// Maintainers are owners from CODEOWNERS or the maintainer rules
+	Maintainers []string
+	// fetchErr is why deps.dev couldn't be asked, if it couldn't,
+	// in which case the licenses aren't known to be none;
+	// it's not set for modules deps.dev doesn't know of
+	fetchErr error
+}
+
+// metaAttr is a meta attribute, with its value as Nix.
+type metaAttr struct {
+	Name, Value string
+}
+
+// Attrs returns the metadata that's known, as Nix attributes.
+func (m *ModuleMeta) Attrs() []metaAttr {
+	var attrs []metaAttr
+	for _, a := range []metaAttr{
+		{"description", m.Description},
+		{"homepage", m.Homepage},
+		{"repository", m.Repository},
+	} {
+		if a.Value != "" {
+			attrs = append(attrs, metaAttr{a.Name, nixString(a.Value)})
+		}
+	}
+	if len(m.Maintainers) > 0 {
+		var quoted []string
+		for _, owner := range m.Maintainers {
+			quoted = append(quoted, nixString(owner))
+		}
+		attrs = append(attrs, metaAttr{"maintainers", "[ " + strings.Join(quoted, " ") + " ]"})
+	}
+	return attrs
+}
+
+// Meta returns the module's metadata, if it was fetched.
+func (m *Module) Meta() *ModuleMeta {
+	if m.meta == nil || len(m.meta.Attrs()) == 0 {
+		return nil
+	}
+	return m.meta
+}
+
+// fetchMetadata looks up metadata for modules on deps.dev,
+// falling back to what the go command knows about where they came from.
+// Failures only cost the metadata, so they're warnings here,
+// but the license policy fails modules deps.dev couldn't be asked about.
+// Modules it doesn't know of just have no licenses known.
+func fetchMetadata(mods []*Module) {
+	if config.Offline {
+		slog.Warn("not fetching module metadata offline")
+		return
+	}
+
+	prog.Phase("fetching metadata")
+	client := &http.Client{Timeout: 30 * time.Second}
+	work := make(chan *Module)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mod := range work {
+				meta, err := depsDevMeta(client, mod.ModuleVersion().Path, mod.ModuleVersion().Version)
+				if errors.Is(err, errNotFound) {
+					slog.Debug("deps.dev doesn't know of module", "module", mod.Path, "error", err)
+					meta = &ModuleMeta{}
+				} else if err != nil {
+					slog.Warn("couldn't fetch module metadata", "module", mod.Path, "error", err)
+					meta = &ModuleMeta{fetchErr: err}
+				}
+				if meta.Repository == "" {
+					if vcs, err := mod.VCS(); err == nil && vcs != nil {
+						meta.Repository = vcs.URL
+					} else {
+						meta.Repository = guessRepoURL(mod.ModuleVersion().Path)
+					}
+				}
+				mod.meta = meta
+			}
+		}()
+	}
+	for _, mod := range mods {
+		if !mod.IsLocal() {
+			work <- mod
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// depsDevMeta fetches a module version's links from deps.dev,
+// and the description of the project they point at.
+func depsDevMeta(client *http.Client, path, version string) (*ModuleMeta, error) {
+	var v struct {
+		Licenses []string
+		Links    []struct {
+			Label string
+			URL   string
+		}
+		RelatedProjects []struct {
+			ProjectKey struct {
+				ID string
+			}
+			RelationType string
+		}
+	}
+	if err := getJSON(client, depsDevAPI+"/systems/go/packages/"+url.PathEscape(path)+"/versions/"+url.PathEscape(version), &v); err != nil {
+		return nil, err
+	}
+
+	meta := &ModuleMeta{Licenses: v.Licenses}
+	for _, link := range v.Links {
+		switch link.Label {
+		case "HOMEPAGE":
+			meta.Homepage = link.URL
+		case "SOURCE_REPO":
+			meta.Repository = link.URL
+		}
+	}
+	for _, related := range v.RelatedProjects {
+		if related.RelationType != "SOURCE_REPO" {
+			continue
+		}
+		var p struct {
+			Description string
+			Homepage    string
+		}
+		if err := getJSON(client, depsDevAPI+"/projects/"+url.PathEscape(related.ProjectKey.ID), &p); err != nil {
+			return nil, err
+		}
+		meta.Description = p.Description
+		if meta.Homepage == "" {
+			meta.Homepage = p.Homepage
+		}
+		if meta.Repository == "" {
+			meta.Repository = "https://" + related.ProjectKey.ID
+		}
+		break
+	}
+	return meta, nil
+}
+
+func getJSON(client *http.Client, u string, v any) error {
+	req, err := http.NewRequestWithContext(context.Background(), "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("GET %s: %w", u, errNotFound)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// nixString quotes s as a Nix string.
+func nixString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
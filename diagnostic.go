@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"go.uber.org/multierr"
+	"golang.org/x/tools/go/packages"
+)
+
+var diagnostics = flag.String("diagnostics", "text", "how to report errors and warnings (text or json)")
+
+// Diagnostic is an error or warning as reported with -diagnostics=json,
+// one JSON object per line on stderr.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	// Kind classifies the problem, for errors mud knows about
+	Kind string `json:"kind,omitempty"`
+	// Module is the module path, with an @version if known
+	Module  string `json:"module,omitempty"`
+	Package string `json:"package,omitempty"`
+	// Pos is a file:line:col position, for errors in Go source
+	Pos     string `json:"pos,omitempty"`
+	Message string `json:"message"`
+	// Hint says what to do about it, if mud has an idea
+	Hint  string         `json:"hint,omitempty"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// flattenErrors splits joined errors into the individual ones.
+func flattenErrors(err error) []error {
+	if multi, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, err := range multi.Unwrap() {
+			errs = append(errs, flattenErrors(err)...)
+		}
+		return errs
+	}
+	return []error{err}
+}
+
+// errorDiagnostics describes an error as diagnostics, one for each of the
+// errors it joins, with whatever they say about where the problem is.
+func errorDiagnostics(err error) []Diagnostic {
+	var ds []Diagnostic
+	for _, err := range flattenErrors(err) {
+		var pe *packageError
+		if errors.As(err, &pe) {
+			// a package can have several errors, each with its own position
+			for _, err := range multierr.Errors(pe.Err) {
+				d := errorDiagnostic(err)
+				d.Package = pe.Package
+				d.Message = pe.Package + ": " + d.Message
+				if d.Kind == "" {
+					d.Kind = "package"
+				}
+				if d.Hint == "" {
+					d.Hint = pe.hint()
+				}
+				ds = append(ds, d)
+			}
+			continue
+		}
+		ds = append(ds, errorDiagnostic(err))
+	}
+	return ds
+}
+
+func errorDiagnostic(err error) Diagnostic {
+	d := Diagnostic{Severity: "error", Message: err.Error()}
+	var h hinter
+	if errors.As(err, &h) && h.hint() != "" {
+		d.Hint = h.hint()
+		d.Message = strings.TrimSuffix(d.Message, "\n"+d.Hint)
+	}
+	var (
+		me *moduleError
+		ne *notCachedError
+		re *replaceError
+		ve *versionConflictError
+		xe *excludeError
+	)
+	switch {
+	case errors.As(err, &me):
+		d.Kind, d.Module = me.Kind, me.Module
+	case errors.As(err, &ne):
+		d.Kind, d.Module = "missing", ne.Module
+	case errors.As(err, &re):
+		d.Kind, d.Module = "replace", string(re.Module)
+	case errors.As(err, &ve):
+		d.Kind, d.Module = "conflict", string(ve.Module)
+	case errors.As(err, &xe):
+		d.Kind, d.Module = "exclude", xe.Excluded.Path
+	}
+	var perr packages.Error
+	if errors.As(err, &perr) {
+		d.Pos = perr.Pos
+		switch perr.Kind {
+		case packages.ListError:
+			d.Kind = "list"
+		case packages.ParseError:
+			d.Kind = "parse"
+		case packages.TypeError:
+			d.Kind = "type"
+		}
+	}
+	return d
+}
+
+// reportError reports the error mud is exiting with.
+func reportError(err error) {
+	if *diagnostics != "json" {
+		slog.Error(err.Error())
+		return
+	}
+	for _, d := range errorDiagnostics(err) {
+		writeDiagnostic(d)
+	}
+}
+
+func writeDiagnostic(d Diagnostic) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		data, _ = json.Marshal(Diagnostic{Severity: d.Severity, Message: d.Message})
+	}
+	logWriter{}.Write(append(data, '\n'))
+}
+
+// diagnosticHandler turns warnings into diagnostics,
+// and passes everything else on to the usual log handler.
+type diagnosticHandler struct {
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *diagnosticHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *diagnosticHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+
+	d := Diagnostic{Severity: "warning", Message: r.Message}
+	if r.Level >= slog.LevelError {
+		d.Severity = "error"
+	}
+	add := func(a slog.Attr) bool {
+		switch a.Key {
+		case "module":
+			d.Module = a.Value.String()
+		case "package":
+			d.Package = a.Value.String()
+		default:
+			if d.Attrs == nil {
+				d.Attrs = make(map[string]any)
+			}
+			d.Attrs[a.Key] = a.Value.Resolve().Any()
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	for k, v := range d.Attrs {
+		if err, ok := v.(error); ok {
+			d.Attrs[k] = err.Error()
+		}
+	}
+	writeDiagnostic(d)
+	return nil
+}
+
+func (h *diagnosticHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &diagnosticHandler{next: h.next.WithAttrs(attrs), attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h *diagnosticHandler) WithGroup(name string) slog.Handler {
+	return &diagnosticHandler{next: h.next.WithGroup(name), attrs: h.attrs}
+}
+
+func checkDiagnosticsFlag() error {
+	switch *diagnostics {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown diagnostics format %q", *diagnostics)
+}
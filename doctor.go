@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/version"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// doctor prints the outcomes of mud doctor's checks,
+// with what to do about the ones that didn't pass.
+type doctor struct {
+	w        io.Writer
+	failures int
+}
+
+func (d *doctor) report(status, what, detail, fix string) {
+	fmt.Fprintf(d.w, "%-5s %s: %s\n", status, what, detail)
+	if fix != "" {
+		fmt.Fprintf(d.w, "      fix: %s\n", fix)
+	}
+}
+
+func (d *doctor) ok(what, detail string) {
+	d.report("ok", what, detail, "")
+}
+
+func (d *doctor) warn(what, detail, fix string) {
+	d.report("warn", what, detail, fix)
+}
+
+func (d *doctor) fail(what, detail, fix string) {
+	d.failures++
+	d.report("FAIL", what, detail, fix)
+}
+
+// cmdDoctor checks what mud needs from its environment,
+// and says how to fix what's wrong, rather than failing somewhere
+// in the middle of a run with whatever the go command had to say about it.
+// It runs before the repository root is entered,
+// since finding it is one of the checks.
+func cmdDoctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: mud doctor")
+	}
+
+	d := &doctor{w: os.Stdout}
+	d.check()
+	if d.failures > 0 {
+		return fmt.Errorf("mud doctor found %d problem(s)", d.failures)
+	}
+	return nil
+}
+
+func (d *doctor) check() {
+	if err := enterRoot(); err != nil {
+		start, _ := os.Getwd()
+		d.fail("repository root", err.Error(), fmt.Sprintf("run mud inside the repository, or mark its root with an empty .mudroot file or another marker given with -root-marker (looked upwards from %s)", start))
+		return
+	}
+	root, _ := os.Getwd()
+	d.ok("repository root", root)
+
+	if err := loadConfig(); err != nil {
+		d.fail("config", err.Error(), fmt.Sprintf("fix the setting in %s, or the flag it came from", *configPath))
+	} else if _, err := os.Stat(*configPath); err == nil {
+		d.ok("config", *configPath)
+	} else {
+		d.ok("config", "defaults (no "+*configPath+")")
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		d.fail("go", "the go command isn't in $PATH", "install Go, or add its bin directory to $PATH")
+		return
+	}
+	out, err := goCmd("env", "-json")
+	if err != nil {
+		d.fail("go env", err.Error(), "fix the Go settings it complains about, in the shell or with go env -w")
+		return
+	}
+	var env map[string]string
+	if err := json.Unmarshal(out, &env); err != nil {
+		d.fail("go env", err.Error(), "")
+		return
+	}
+
+	d.checkGoVersion(env)
+	d.checkGoFlags(env["GOFLAGS"])
+	d.checkGoProxy(env["GOPROXY"])
+	d.checkModCache(env["GOMODCACHE"])
+	d.checkWorkspace(root, env["GOWORK"])
+	d.checkStaleFiles()
+	d.checkLock()
+}
+
+// checkGoVersion checks the go command is new enough for the root module,
+// since it won't load packages for a newer go directive
+// unless it can switch toolchains.
+func (d *doctor) checkGoVersion(env map[string]string) {
+	have := env["GOVERSION"]
+	f, err := readGoMod(".")
+	if err != nil {
+		d.fail("go.mod", err.Error(), "run mud from a module's repository, with a go.mod at its root")
+		return
+	}
+	if f.Go == nil || !version.IsValid(have) {
+		d.ok("go version", have)
+		return
+	}
+	want := "go" + f.Go.Version
+	if version.Compare(have, want) < 0 {
+		d.fail("go version", fmt.Sprintf("%s, but go.mod needs %s (GOTOOLCHAIN=%s)", have, want, env["GOTOOLCHAIN"]),
+			fmt.Sprintf("install %s or later, or let the go command fetch it with GOTOOLCHAIN=auto", want))
+		return
+	}
+	d.ok("go version", fmt.Sprintf("%s (go.mod needs %s)", have, want))
+}
+
+// checkGoFlags warns about GOFLAGS that change what the go command
+// loads from under mud's feet.
+func (d *doctor) checkGoFlags(goflags string) {
+	for _, f := range strings.Fields(goflags) {
+		switch {
+		case strings.HasPrefix(f, "-modfile"):
+			d.warn("GOFLAGS", goflags, "mud reads go.mod and go.sum themselves, so drop "+f)
+			return
+		case f == "-mod=vendor" && config.Mod != "vendor":
+			d.warn("GOFLAGS", goflags, `mud hashes modules from the module cache, so drop -mod=vendor, or set "mod": "vendor" in mud.json if that's intended`)
+			return
+		}
+	}
+	if goflags == "" {
+		goflags = "(unset)"
+	}
+	d.ok("GOFLAGS", goflags)
+}
+
+// checkGoProxy warns when nothing can be downloaded, outside offline runs.
+func (d *doctor) checkGoProxy(proxy string) {
+	switch {
+	case config.Offline:
+		d.ok("GOPROXY", "not used, since mud runs offline")
+	case proxy == "off":
+		d.warn("GOPROXY", "off, so modules missing from the module cache can't be downloaded",
+			"set GOPROXY (the default is https://proxy.golang.org,direct), or run with -offline to get a list of what's missing")
+	case proxy == "direct":
+		d.warn("GOPROXY", "direct, so every module is fetched from its VCS",
+			"make sure git and friends can reach each host, or use a module proxy")
+	default:
+		d.ok("GOPROXY", proxy)
+	}
+}
+
+// checkModCache checks the module cache is there and can be written to,
+// since modules are downloaded into it before they're hashed.
+func (d *doctor) checkModCache(dir string) {
+	if dir == "" {
+		d.fail("module cache", "GOMODCACHE is empty", "set GOPATH or GOMODCACHE")
+		return
+	}
+	download := filepath.Join(dir, "cache", "download")
+	if _, err := os.Stat(download); os.IsNotExist(err) {
+		d.warn("module cache", dir+" has nothing downloaded yet", "run go mod download, or let mud download the modules on its first run")
+		return
+	} else if err != nil {
+		d.fail("module cache", err.Error(), "")
+		return
+	}
+	f, err := os.CreateTemp(download, "mud-doctor")
+	if err != nil {
+		d.fail("module cache", dir+" isn't writable: "+err.Error(),
+			"fix its permissions, or point GOMODCACHE somewhere writable")
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	d.ok("module cache", dir)
+}
+
+// checkWorkspace says whether a go.work is in use,
+// and warns when one in the repository is being ignored, or one outside it isn't.
+func (d *doctor) checkWorkspace(root, gowork string) {
+	_, err := os.Stat("go.work")
+	hasWork := err == nil
+	switch {
+	case gowork == "off" && hasWork:
+		d.warn("go.work", "GOWORK=off, so the repository's go.work is ignored", "unset GOWORK, unless the modules are meant to be loaded on their own")
+	case gowork == "" || gowork == "off":
+		d.ok("go.work", "not in use")
+	default:
+		if rel, ok := repoDir(root, gowork); !ok {
+			d.warn("go.work", gowork+" is outside the repository, so others won't get the same graph",
+				"unset GOWORK, or run go work init in the repository")
+		} else {
+			d.ok("go.work", rel)
+		}
+	}
+}
+
+// checkStaleFiles looks for the temporary files a crashed run left behind.
+func (d *doctor) checkStaleFiles() {
+	stale := staleTempFiles()
+	if len(stale) == 0 {
+		d.ok("temporary files", "none left over")
+		return
+	}
+	d.warn("temporary files", fmt.Sprintf("%d left over by an interrupted run: %s", len(stale), strings.Join(stale, ", ")),
+		"the next mud run that writes anything removes them")
+}
+
+// checkLock reports whether another run holds the repository's lock.
+func (d *doctor) checkLock() {
+	f, err := openLock(false)
+	if errors.Is(err, errLocked) {
+		d.warn("lock", "another mud run is in progress", "wait for it to finish, or run with -wait")
+		return
+	}
+	if err != nil {
+		d.fail("lock", err.Error(), "make sure "+lockFile+" can be created at the repository root")
+		return
+	}
+	f.Close()
+	d.ok("lock", "free")
+}
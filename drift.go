@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// requirement is the version of a module the repository's go.mod files
+// select, after replacements.
+type requirement struct {
+	module.Version
+	// Source is what it's fetched as, which differs for replaced modules
+	Source module.Version
+	Local  bool
+	Direct bool
+}
+
+// cmdDrift compares the generated expressions with go.mod and go.sum,
+// without loading packages or hashing anything,
+// as a quick check that the tree is up to date.
+// -report picks other formats for the stale modules, like CI annotations.
+func cmdDrift(args []string) error {
+	flags := flag.NewFlagSet("drift", flag.ContinueOnError)
+	reporter := addReportFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: mud drift [-report format]")
+	}
+	if err := reporter.validate(); err != nil {
+		return err
+	}
+	if config.Generator != "buildgo" {
+		return fmt.Errorf("mud drift reads buildgo expressions, and the %s generator doesn't write them", config.Generator)
+	}
+
+	reqs, err := readRequirements()
+	if err != nil {
+		return err
+	}
+	sums, err := readGoSums()
+	if err != nil {
+		return err
+	}
+
+	mans := make(map[Path]*Manifest)
+	err = filepath.WalkDir(gopkgsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() != "default.nix" || filepath.Dir(path) == filepath.FromSlash(gopkgsDir) {
+			return nil
+		}
+		man, err := readManifest(path)
+		if err != nil || man == nil {
+			return err
+		}
+		mans[Path(man.Path)] = man
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var problems []error
+	report := func(path Path, format string, args ...any) {
+		problems = append(problems, &moduleError{Kind: "drift", Module: string(path), Err: fmt.Errorf(format, args...)})
+	}
+
+	var paths []Path
+	for path := range mans {
+		paths = append(paths, path)
+	}
+	for path, req := range reqs {
+		if mans[path] == nil && req.Direct && !req.Local {
+			paths = append(paths, path)
+		}
+	}
+	sortPaths(paths)
+
+	for _, path := range paths {
+		if !config.Selected(path) {
+			continue
+		}
+		man, req := mans[path], reqs[path]
+		switch {
+		case req == nil:
+			report(path, "has an expression, but no go.mod requires it")
+		case man == nil:
+			report(path, "go.mod requires %s, but it has no expression", req.Version.Version)
+		case req.Local:
+			// local sources are hashed from the directory, with no version to compare
+		case man.Version == "":
+			report(path, "the expression has no version, but go.mod requires %s", req.Source.Version)
+		case ("v"+man.Version != req.Source.Version || man.SourcePath != req.Source.Path) && req.Source != req.Version:
+			report(path, "the expression is for %s@v%s, but go.mod replaces %s with %s", man.SourcePath, man.Version, req.Version, req.Source)
+		case "v"+man.Version != req.Source.Version || man.SourcePath != req.Source.Path:
+			report(path, "the expression is for %s@v%s, but go.mod requires %s", man.SourcePath, man.Version, req.Source)
+		case sums[req.Source] == "":
+			report(path, "go.sum has no entry for %s", req.Source)
+		}
+	}
+
+	if err := reporter.report(problems); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d modules differ from go.mod, run mud to regenerate them", len(problems))
+	}
+	return nil
+}
+
+// readRequirements reads the requirements and replacements
+// of the repository's go.mod files.
+func readRequirements() (map[Path]*requirement, error) {
+	dirs, err := repoModules()
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make(map[Path]*requirement)
+	for _, dir := range dirs {
+		f, err := readGoMod(dir)
+		if err != nil {
+			return nil, err
+		}
+		replaces := make(map[module.Version]*modfile.Replace)
+		for _, r := range f.Replace {
+			replaces[r.Old] = r
+		}
+		for _, r := range f.Require {
+			req := &requirement{Version: r.Mod, Source: r.Mod, Direct: !r.Indirect}
+			rep := replaces[r.Mod]
+			if rep == nil {
+				rep = replaces[module.Version{Path: r.Mod.Path}]
+			}
+			if rep != nil {
+				req.Source = rep.New
+				req.Local = modfile.IsDirectoryPath(rep.New.Path)
+			}
+			if old := reqs[Path(r.Mod.Path)]; old != nil {
+				// loading checks the modules agree properly; here, go with the first
+				old.Direct = old.Direct || req.Direct
+				continue
+			}
+			if !(&Module{Path: Path(r.Mod.Path)}).IsExternal() {
+				continue
+			}
+			reqs[Path(r.Mod.Path)] = req
+		}
+	}
+	return reqs, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The errors mud knows how to explain.
+// Each says what went wrong and, where there's an obvious fix, what to run,
+// after a newline so it reads as a separate hint.
+
+// hinter is an error with a suggestion for fixing it.
+type hinter interface {
+	error
+	hint() string
+}
+
+func withHint(msg, hint string) string {
+	if hint == "" {
+		return msg
+	}
+	return msg + "\n" + hint
+}
+
+// moduleError is a problem with a particular module.
+type moduleError struct {
+	Kind   string
+	Module string
+	Err    error
+	Hint   string
+}
+
+func (e *moduleError) Error() string { return withHint(e.Module+": "+e.Err.Error(), e.Hint) }
+func (e *moduleError) Unwrap() error { return e.Err }
+func (e *moduleError) hint() string  { return e.Hint }
+
+// notCachedError is a module mud needs that isn't in the module cache.
+type notCachedError struct {
+	// Module is path@version
+	Module string
+}
+
+func (e *notCachedError) Error() string {
+	return withHint(e.Module+": not in the module cache", e.hint())
+}
+
+func (e *notCachedError) hint() string {
+	if config.Offline {
+		return fmt.Sprintf("run `go mod download %s` with network access, then run mud -offline again", e.Module)
+	}
+	return fmt.Sprintf("run `go mod download %s`", e.Module)
+}
+
+// replaceError is a replace directive pointing at a directory
+// other than the module's own expression dir.
+type replaceError struct {
+	Module Path
+	Target string
+	Want   string
+}
+
+func (e *replaceError) Error() string {
+	return withHint(fmt.Sprintf("%s: replace points at //%s, expected it to point at //%s", e.Module, e.Target, e.Want), e.hint())
+}
+
+func (e *replaceError) hint() string {
+	return fmt.Sprintf("move the module to //%s and point the replace there, "+
+		"or build it from where it is with -local-replace=source (\"localReplace\": \"source\" in mud.json)", e.Want)
+}
+
+// versionConflictError is two of the repository's modules
+// using different versions of the same dependency.
+type versionConflictError struct {
+	Module Path
+	// Dirs are the repository modules, and Uses what each uses
+	Dirs [2]string
+	Uses [2]string
+	// RequiredBy are what requires the version MVS selected in each, if known
+	RequiredBy [2][]string
+}
+
+func (e *versionConflictError) Error() string {
+	side := func(i int) string {
+		s := fmt.Sprintf("//%s uses %s", e.Dirs[i], e.Uses[i])
+		if len(e.RequiredBy[i]) > 0 {
+			s += fmt.Sprintf(" (required by %s)", strings.Join(e.RequiredBy[i], ", "))
+		}
+		return s
+	}
+	return withHint(fmt.Sprintf("%s: %s, but %s", e.Module, side(0), side(1)), e.hint())
+}
+
+func (e *versionConflictError) hint() string {
+	return fmt.Sprintf("there's only one expression for each module, so run `go get %s@<version>` in one of them to make them agree", e.Module)
+}
+
+// packageError is a problem loading a particular package.
+type packageError struct {
+	Package string
+	Err     error
+}
+
+func (e *packageError) Error() string { return withHint(e.Package+": "+e.Err.Error(), e.hint()) }
+func (e *packageError) Unwrap() error { return e.Err }
+
+func (e *packageError) hint() string {
+	msg := e.Err.Error()
+	switch {
+	case strings.Contains(msg, "no required module provides"),
+		strings.Contains(msg, "missing go.sum entry"),
+		strings.Contains(msg, "updates to go.mod needed"):
+		return "run `go mod tidy` to bring go.mod and go.sum up to date"
+	case strings.Contains(msg, "module lookup disabled by GOPROXY=off"):
+		return "run `go mod download` with network access, then run mud -offline again"
+	}
+	return fmt.Sprintf("run `go vet %s` to see the errors in context", e.Package)
+}
+
+// incompleteError collects the problems a run carried on past,
+// leaving out the modules and packages they concern.
+// Everything else the run produced is still written out.
+type incompleteError struct {
+	err error
+}
+
+func (e *incompleteError) Error() string   { return e.err.Error() }
+func (e *incompleteError) Unwrap() []error { return []error{e.err} }
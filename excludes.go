@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// excludeError is a version excluded by a repository module's go.mod
+// that something still requires, with no later version for MVS to use instead.
+// The go command reports it as a package no module provides.
+type excludeError struct {
+	Dir      string
+	Excluded module.Version
+	// RequiredBy are the module versions requiring it, or go.mod
+	RequiredBy []string
+}
+
+func (e *excludeError) Error() string {
+	return withHint(fmt.Sprintf("%s %s is excluded in //%s, but %s requires it, and there's no later version to use instead",
+		e.Excluded.Path, e.Excluded.Version, e.Dir, strings.Join(e.RequiredBy, " and ")), e.hint())
+}
+
+func (e *excludeError) hint() string {
+	return fmt.Sprintf("require a later version of %s in //%s, or drop the exclude", e.Excluded.Path, e.Dir)
+}
+
+// checkExcludes looks for requirements on versions the module in dir excludes.
+// The go command quietly uses the next version up instead, which is logged
+// along with what asked for the excluded one; if there isn't one, that's an error.
+func checkExcludes(dir string) error {
+	f, err := readGoMod(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(f.Exclude) == 0 {
+		return nil
+	}
+	excluded := make(map[module.Version]bool)
+	for _, x := range f.Exclude {
+		excluded[x.Mod] = true
+	}
+
+	out, err := goCmd("-C", dir, "list", "-m", "-e", "-json", "all")
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]string)
+	requiredBy := make(map[module.Version][]string)
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m struct {
+			Path, Version, GoMod string
+			Main                 bool
+		}
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		selected[m.Path] = m.Version
+		if m.GoMod == "" {
+			continue
+		}
+		data, err := os.ReadFile(m.GoMod)
+		if err != nil {
+			slog.Debug("reading go.mod", "module", m.Path, "err", err)
+			continue
+		}
+		mf, err := modfile.ParseLax(m.GoMod, data, nil)
+		if err != nil {
+			slog.Debug("parsing go.mod", "module", m.Path, "err", err)
+			continue
+		}
+		by := m.Path + "@" + m.Version
+		if m.Main {
+			by = "go.mod"
+		}
+		for _, r := range mf.Require {
+			if excluded[r.Mod] {
+				requiredBy[r.Mod] = append(requiredBy[r.Mod], by)
+			}
+		}
+	}
+
+	var errs []error
+	for _, x := range f.Exclude {
+		by := requiredBy[x.Mod]
+		if len(by) == 0 {
+			continue
+		}
+		if v := selected[x.Mod.Path]; v != "" {
+			slog.Warn("excluded version required", "dir", dir, "module", x.Mod.String(), "requiredBy", by, "selected", v)
+			continue
+		}
+		errs = append(errs, &excludeError{Dir: dir, Excluded: x.Mod, RequiredBy: by})
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// narListing is what goes into a NAR, file by file,
+// so two trees with different NAR hashes can be compared.
+type narListing struct {
+	// NARHash is the SRI hash of the whole tree
+	NARHash string     `json:"narHash"`
+	Entries []narEntry `json:"entries"`
+}
+
+type narEntry struct {
+	Path string `json:"path"`
+	// Type is regular, executable, symlink or directory
+	Type string `json:"type"`
+	Size int64  `json:"size,omitempty"`
+	// SHA256 is the hash of a file's contents
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// cmdExplainHash compares two trees the way their NAR hashes see them,
+// to find out why a hash changed when the version didn't.
+// Each side is a directory, a listing saved with -save,
+// or a module@version from the module cache, filtered like mud hashes it.
+// Modules fetched with git are hashed from their repositories, so aren't covered.
+func cmdExplainHash(args []string) error {
+	fs := flag.NewFlagSet("explain-hash", flag.ContinueOnError)
+	save := fs.String("save", "", "save the listing of a single tree to `file`, to compare against later")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *save != "" && fs.NArg() == 1 {
+		l, err := listTree(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(l, "", "\t")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*save, append(data, '\n'), 0644)
+	}
+	if *save != "" || fs.NArg() != 2 {
+		return errors.New("usage: mud explain-hash <tree> <tree>, or mud explain-hash -save file <tree>")
+	}
+
+	a, err := listTree(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := listTree(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("--- %s %s\n+++ %s %s\n", fs.Arg(0), a.NARHash, fs.Arg(1), b.NARHash)
+	diffs := diffListings(a, b)
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if a.NARHash == b.NARHash {
+		fmt.Println("same hash")
+	} else if len(diffs) == 0 {
+		fmt.Println("hashes differ, but every entry is the same")
+	}
+	return nil
+}
+
+// listTree lists a directory, a saved listing, or a module@version.
+func listTree(arg string) (*narListing, error) {
+	fi, err := os.Stat(arg)
+	switch {
+	case err == nil && fi.IsDir():
+		return listDir(arg, excludeNothing)
+	case err == nil:
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		var l narListing
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, fmt.Errorf("%s: not a listing: %w", arg, err)
+		}
+		return &l, nil
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	path, version, ok := strings.Cut(arg, "@")
+	if !ok || module.CheckPath(path) != nil {
+		return nil, fmt.Errorf("%s isn't a directory, a listing or a module@version", arg)
+	}
+	out, err := goCmd("mod", "download", "-json", arg)
+	var d DownloadedModule
+	if jerr := json.Unmarshal(out, &d); jerr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, jerr
+	}
+	if d.Error != "" {
+		return nil, &moduleError{Kind: "download", Module: arg, Err: errors.New(d.Error)}
+	}
+	mod := &Module{Path: Path(path), Version: strings.TrimPrefix(version, "v"), Dir: d.Dir}
+	exclude := excludePaths(mod.sourceExcludes())
+	if config.HashSource == "zip" {
+		return listZip(d.Zip, d.Path+"@"+d.Version+"/", exclude)
+	}
+	return listDir(d.Dir, exclude)
+}
+
+func listDir(dir string, exclude excluder) (*narListing, error) {
+	sum, err := narHashDir(dir, exclude)
+	if err != nil {
+		return nil, err
+	}
+	l := &narListing{NARHash: "sha256-" + base64.StdEncoding.EncodeToString(sum), Entries: []narEntry{}}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if exclude(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := narEntry{Path: rel}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			e.Type = "symlink"
+			if e.Target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case d.IsDir():
+			e.Type = "directory"
+		default:
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			e.Type, e.Size = "regular", fi.Size()
+			if fi.Mode()&0111 != 0 {
+				e.Type = "executable"
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if e.SHA256, err = hashReader(f); err != nil {
+				return err
+			}
+		}
+		l.Entries = append(l.Entries, e)
+		return nil
+	})
+	return l, err
+}
+
+// listZip lists the tree a module zip extracts to, like narHashZip hashes it.
+func listZip(name, prefix string, exclude excluder) (*narListing, error) {
+	sum, err := narHashZip(name, prefix, exclude)
+	if err != nil {
+		return nil, err
+	}
+	l := &narListing{NARHash: "sha256-" + base64.StdEncoding.EncodeToString(sum), Entries: []narEntry{}}
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// excluded files leave their directories behind, like in the NAR
+	dirs := make(map[string]bool)
+	for _, f := range r.File {
+		rel := strings.TrimPrefix(f.Name, prefix)
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		names := strings.Split(rel, "/")
+		excluded := false
+		for i := 1; i < len(names) && !excluded; i++ {
+			dir := strings.Join(names[:i], "/")
+			if excluded = exclude(dir, true); !excluded && !dirs[dir] {
+				dirs[dir] = true
+				l.Entries = append(l.Entries, narEntry{Path: dir, Type: "directory"})
+			}
+		}
+		if excluded || exclude(rel, false) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hashReader(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		l.Entries = append(l.Entries, narEntry{Path: rel, Type: "regular", Size: int64(f.UncompressedSize64), SHA256: hash})
+	}
+	sort.Slice(l.Entries, func(i, j int) bool { return l.Entries[i].Path < l.Entries[j].Path })
+	return l, nil
+}
+
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// diffListings describes how b differs from a, entry by entry, in path order.
+func diffListings(a, b *narListing) []string {
+	before := make(map[string]narEntry)
+	for _, e := range a.Entries {
+		before[e.Path] = e
+	}
+	after := make(map[string]narEntry)
+	for _, e := range b.Entries {
+		after[e.Path] = e
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, e := range append(append([]narEntry(nil), a.Entries...), b.Entries...) {
+		if !seen[e.Path] {
+			seen[e.Path] = true
+			paths = append(paths, e.Path)
+		}
+	}
+	sort.Strings(paths)
+
+	var diffs []string
+	for _, path := range paths {
+		old, inA := before[path]
+		cur, inB := after[path]
+		switch {
+		case !inB:
+			diffs = append(diffs, fmt.Sprintf("- %s (%s)", path, old.Type))
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("+ %s (%s)", path, cur.Type))
+		case old.Type != cur.Type:
+			diffs = append(diffs, fmt.Sprintf("~ %s: %s, was %s", path, cur.Type, old.Type))
+		case old.Target != cur.Target:
+			diffs = append(diffs, fmt.Sprintf("~ %s: points at %s, was %s", path, cur.Target, old.Target))
+		case old.SHA256 != cur.SHA256:
+			diffs = append(diffs, fmt.Sprintf("~ %s: contents changed, %d bytes, was %d", path, cur.Size, old.Size))
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// generatedHeader starts every file mud owns.
+// Files without it are hand-written, and left alone.
+const generatedHeader = "# generator //tools/mud (DO NOT EDIT)\n"
+
+// depsTmpl renders the deps of first-party expressions,
+// which can mix in-repo and third-party packages.
+var depsTmpl = template.Must(template.New("deps").Funcs(templateFuncs).Parse(`
+{{- if .Local}}
+  deps = [
+{{- range .Local}}
+    {{.}}
+{{- end}}
+  ]{{if .External}} ++ (with {{gopkgsScope}}; [
+{{- range .External}}
+    {{gopkgsName}}.{{.NixAttr}}
+{{- end}}
+  ]){{end}};
+{{- else if .External}}
+  deps = with {{gopkgsScope}}; [
+{{- range .External}}
+    {{gopkgsName}}.{{.NixAttr}}
+{{- end}}
+  ];
+{{- end}}`))
+
+var packageTmpl = template.Must(template.Must(depsTmpl.Clone()).New("package").Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{ platform, ... }:
+
+platform.buildGo.package {
+  name = "{{.Name}}";
+  path = "{{.Path}}";
+{{- with .GoVersion}}
+  goVersion = "{{.}}";
+{{- end}}
+{{- with .Toolchain}}
+  toolchain = "{{.}}";
+{{- end}}
+  srcs = [
+{{- range .Srcs}}
+    ./{{.}}
+{{- end}}
+  ];
+{{- template "deps" .}}
+}
+`[1:]))
+
+var programTmpl = template.Must(template.Must(depsTmpl.Clone()).New("program").Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{ platform, ... }:
+
+# {{.Path}}
+platform.buildGo.program {
+  name = "{{.Name}}";
+{{- with .GoVersion}}
+  goVersion = "{{.}}";
+{{- end}}
+{{- with .Toolchain}}
+  toolchain = "{{.}}";
+{{- end}}
+  srcs = [
+{{- range .Srcs}}
+    ./{{.}}
+{{- end}}
+  ];
+{{- template "deps" .}}
+}
+`[1:]))
+
+// firstPartyPackage is the template data for a first-party package expression.
+type firstPartyPackage struct {
+	Name string
+	Path Path
+	Srcs []string
+	// Local are the Nix expressions for first-party dependencies
+	Local []string
+	// External are the third-party packages imported
+	External []Path
+	// GoVersion and Toolchain come from the go.mod of the package's module
+	GoVersion, Toolchain string
+}
+
+// generateFirstParty writes buildGo.package expressions
+// for the first-party library packages under the first-party dir,
+// and buildGo.program expressions for the commands under the programs dir.
+func generateFirstParty(modules map[Path]*Module) error {
+	if config.FirstPartyDir == "" && config.ProgramsDir == "" {
+		return nil
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	pkgs := make(map[Path]*Package)
+	for _, mod := range modules {
+		for path, pkg := range mod.Pkgs {
+			pkgs[path] = pkg
+		}
+	}
+
+	var paths []Path
+	for path, pkg := range pkgs {
+		if !pkg.Module.IsExternal() {
+			paths = append(paths, path)
+		}
+	}
+	sortPaths(paths)
+
+	var buffer bytes.Buffer
+	for _, path := range paths {
+		pkg := pkgs[path]
+		t, scope := packageTmpl, config.FirstPartyDir
+		if pkg.Name == "main" {
+			t, scope = programTmpl, config.ProgramsDir
+		}
+		dir, ok := repoDir(root, pkg.Dir())
+		if !ok || scope == "" || !inDir(dir, scope) {
+			continue
+		}
+
+		goDirs, err := pkg.Module.goDirectives()
+		if err != nil {
+			return err
+		}
+		data := firstPartyPackage{
+			Name:      slashpath.Base(string(pkg.Path)),
+			Path:      pkg.Path,
+			GoVersion: goDirs.Go,
+			Toolchain: goDirs.Toolchain,
+		}
+		for _, f := range pkg.GoFiles {
+			data.Srcs = append(data.Srcs, filepath.Base(f))
+		}
+		for _, imp := range pkg.Imports.Sorted() {
+			dep := pkgs[imp]
+			if dep == nil {
+				continue
+			}
+			if dep.Module.IsExternal() {
+				data.External = append(data.External, imp)
+				continue
+			}
+			depDir, ok := repoDir(root, dep.Dir())
+			if !ok {
+				return fmt.Errorf("%s: imported package %s is outside the repository", pkg.Path, imp)
+			}
+			data.Local = append(data.Local, repoAttr(depDir))
+		}
+
+		buffer.Reset()
+		if err := t.Execute(&buffer, data); err != nil {
+			return err
+		}
+		if err := emitOwnedFile(dir, "default.nix", buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitOwnedFile writes a generated file like emitFile,
+// unless there's already a hand-written file in its place.
+func emitOwnedFile(dir, name string, data []byte) error {
+	old, err := os.ReadFile(filepath.Join(dir, name))
+	if err == nil && !bytes.HasPrefix(old, []byte(generatedHeader)) {
+		slog.Info("not overwriting hand-written file", "file", filepath.Join(dir, name))
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return emitFile(dir, name, data)
+}
+
+// repoDir returns dir relative to the repository root, with forward slashes.
+func repoDir(root, dir string) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// inDir reports whether the slash-separated path is within dir.
+func inDir(path, dir string) bool {
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// repoAttr returns the attr path of a repository dir under platform.
+func repoAttr(dir string) string {
+	if dir == "." {
+		return "platform"
+	}
+	return "platform." + Path(dir).NixAttr()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// flakeTmpl renders every module into a single expression taking pkgs,
+// for projects using plain nixpkgs rather than platform.buildGo.
+// Modules are keyed by their module path.
+var flakeTmpl = template.Must(template.New("flake").Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{ pkgs, fetchGoModule ? null }:
+
+let
+  fetch = if fetchGoModule != null then fetchGoModule else
+    { path, version, hash, exclude ? [ ], ... }:
+    pkgs.runCommand "${builtins.replaceStrings [ "/" ] [ "-" ] path}-${version}" {
+      nativeBuildInputs = [ pkgs.go pkgs.cacert pkgs.jq ];
+      outputHashMode = "recursive";
+      outputHashAlgo = "sha256";
+      outputHash = hash;
+    } ''
+      export HOME=$TMPDIR GOMODCACHE=$TMPDIR/modcache GOFLAGS=-modcacherw
+      dir=$(go mod download -json ${path}@v${version} | jq -r .Dir)
+      cp -r "$dir" $out
+      chmod -R u+w $out
+      for pattern in ${pkgs.lib.escapeShellArgs exclude}; do
+        case "$pattern" in
+          */) find $out -depth -mindepth 1 -type d -name "''${pattern%/}" -exec rm -rf {} + ;;
+          */*) (cd $out && rm -rf $pattern) ;;
+          *) find $out -depth -mindepth 1 -name "$pattern" -exec rm -rf {} + ;;
+        esac
+      done
+    '';
+
+  self = {
+{{- range $mod := .}}
+    "{{.Path}}" = {
+      path = "{{.Path}}";
+      version = "{{.Version}}";
+{{- with .GoVersion}}
+      goVersion = "{{.}}";
+{{- end}}
+{{- with .Toolchain}}
+      toolchain = "{{.}}";
+{{- end}}
+{{- if .IsLocal}}
+      src = {{.IndexSrc}};
+{{- else}}{{with .GitSource}}
+{{- if eq .Fetcher "github"}}
+      src = pkgs.fetchFromGitHub {
+        owner = "{{.Owner}}";
+        repo = "{{.Repo}}";
+{{- else}}
+      src = pkgs.fetchgit {
+        url = "{{.URL}}";
+{{- end}}
+        rev = "{{.Rev}}";
+        hash = "{{$mod.ModSHA256}}";
+      }{{with .Subdir}} + "/{{.}}"{{end}};
+{{- else}}
+      src = fetch {
+        path = "{{.ModuleVersion.Path}}";
+        version = "{{.Version}}";
+        hash = "{{.ModSHA256}}";
+{{- with .Sum}}
+        goSum = "{{.}}";
+{{- end}}
+{{- with .SourceExcludes}}
+        exclude = [{{range .}} {{.}}{{end}} ];
+{{- end}}
+{{- with .VCS}}
+        rev = "{{.Rev}}";
+{{- with .URL}}
+        vcsUrl = "{{.}}";
+{{- end}}
+{{- with .Subdir}}
+        subdir = "{{.}}";
+{{- end}}
+{{- end}}
+      };
+{{- end}}{{end}}
+{{- with .SubPackages}}
+      subPackages = [
+{{- range .}}
+        "{{.}}"
+{{- end}}
+      ];
+{{- end}}
+{{- with .DepModules}}
+      deps = [
+{{- range .}}
+        self."{{.Path}}"
+{{- end}}
+      ];
+{{- end}}
+{{- with .Meta}}
+      meta = {
+{{- range .Attrs}}
+        {{.Name}} = {{.Value}};
+{{- end}}
+      };
+{{- end}}
+    };
+{{- end}}
+  };
+in
+self
+`[1:]))
+
+// generateFlake writes all modules into gopkgs.nix in the gopkgs dir.
+func generateFlake(selected, all []*Module) error {
+	var buffer bytes.Buffer
+	if err := flakeTmpl.Execute(&buffer, all); err != nil {
+		return err
+	}
+	return emitFile(gopkgsDir, "gopkgs.nix", buffer.Bytes())
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// A generator renders expressions for external modules,
+// writing them out with emitFile.
+type generator struct {
+	// generate renders the selected modules.
+	// all is every external module in the graph.
+	generate func(selected, all []*Module) error
+	// partial is whether the generator can render a subset of the modules,
+	// so that -only and -exclude make sense.
+	partial bool
+}
+
+// reuseHashes makes generate take hashes from existing manifests
+// for modules whose version hasn't changed, instead of rehashing them.
+var reuseHashes bool
+
+var (
+	trustExisting = flag.Bool("trust-existing", false, "reuse the hashes in existing expressions of modules whose version hasn't changed")
+	rehash        = flag.Bool("rehash", false, "hash every module again, even when an existing expression's hash could be reused")
+)
+
+// previousSums, if set, restricts hash reuse to modules whose go.sum entry
+// is the same as when their manifest was generated.
+var previousSums GoSum
+
+var generators = map[string]generator{
+	"buck2":   {generate: generateBuck2},
+	"buildgo": {generate: generateBuildGo, partial: true},
+	"cue":     {generate: generateCUE},
+	"flake":   {generate: generateFlake},
+	"guix":    {generate: generateGuix},
+}
+
+func generatorNames() string {
+	var names []string
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// generate checks the external modules and renders them with the configured generator.
+func generate(modules map[Path]*Module) error {
+	gen, _ := lookupGenerator(config.Generator)
+	if !gen.partial && (len(config.Only) > 0 || len(config.Exclude) > 0) {
+		return fmt.Errorf("the %s generator always covers every module, so it can't be used with -only or -exclude", config.Generator)
+	}
+
+	sums, err := readGoSums()
+	if err != nil {
+		return err
+	}
+
+	var paths []Path
+	for path := range modules {
+		paths = append(paths, path)
+	}
+	sortPaths(paths)
+
+	// several major versions of one module get separate expressions,
+	// nested like their import paths; point this out, since it's easy
+	// to bump one and forget about the other.
+	majors := make(map[string][]Path)
+	for _, path := range paths {
+		if !modules[path].IsExternal() {
+			continue
+		}
+		base, _, _ := module.SplitPathVersion(string(path))
+		majors[base] = append(majors[base], path)
+	}
+	for _, path := range paths {
+		base, _, _ := module.SplitPathVersion(string(path))
+		if siblings := majors[base]; len(siblings) > 1 && siblings[0] == path {
+			slog.Info("multiple major versions in use", "module", base, "paths", siblings)
+		}
+	}
+
+	for _, path := range paths {
+		for dep := range modules[path].Deps {
+			dep.importers = append(dep.importers, path)
+		}
+	}
+	if config.RequiredBy {
+		markRequiredBy(modules)
+	}
+
+	// -rehash wins over everything that would reuse hashes,
+	// for when a manifest's hash is suspect
+	reuse := (reuseHashes || *trustExisting) && !*rehash
+	var all, selected, fetched []*Module
+	for _, path := range paths {
+		mod := modules[path]
+		if !mod.IsExternal() {
+			continue
+		}
+		all = append(all, mod)
+		if !config.Selected(path) {
+			continue
+		}
+		selected = append(selected, mod)
+		if mod.IsLocal() {
+			continue
+		}
+		mod.sum = sums[mod.ModuleVersion()]
+		if mv := mod.ModuleVersion(); reuse && (previousSums == nil || previousSums[mv] == sums[mv]) {
+			if err := mod.reuseHash(); err != nil {
+				return err
+			}
+		}
+		if !mod.hashReused && importedHashes != nil {
+			mod.reuseImported()
+		}
+		if !mod.hashReused {
+			fetched = append(fetched, mod)
+		}
+	}
+
+	// problems with individual modules don't stop the run:
+	// they're all reported at the end, and the other modules still generated
+	var problems []error
+	failed := make(map[*Module]bool)
+	fail := func(mod *Module, err error) {
+		problems = append(problems, err)
+		failed[mod] = true
+	}
+
+	if err := downloadMissing(fetched); err != nil {
+		byVersion := make(map[string]*Module)
+		for _, mod := range fetched {
+			byVersion[mod.ModuleVersion().String()] = mod
+		}
+		for _, err := range flattenErrors(err) {
+			var me *moduleError
+			if !errors.As(err, &me) || byVersion[me.Module] == nil {
+				return err
+			}
+			fail(byVersion[me.Module], err)
+		}
+		fetched = withoutFailed(fetched, failed)
+	}
+	if err := resolveOrigins(fetched); err != nil {
+		return err
+	}
+
+	for _, mod := range selected {
+		if mod.IsVendored() || failed[mod] {
+			continue
+		}
+
+		if mod.IsLocal() {
+			if config.LocalReplace != "source" {
+				fail(mod, &replaceError{Module: mod.Path, Target: mod.ReplacePath, Want: mod.OutDir()})
+			}
+			// local replacements have no go.sum entry to check against
+			continue
+		}
+
+		if err := mod.CheckMajor(); err != nil {
+			fail(mod, err)
+			continue
+		}
+		if mod.hashReused || mod.hashedBySum() {
+			continue
+		}
+		// the module cache is only as trustworthy as go.sum,
+		// so don't bake a hash into the tree that go itself would reject
+		if err := mod.VerifySum(sums); err != nil {
+			fail(mod, err)
+		}
+	}
+	if config.Verify == "sumdb" {
+		var verify []*Module
+		for _, mod := range selected {
+			if !mod.IsVendored() && !mod.IsLocal() && !failed[mod] {
+				verify = append(verify, mod)
+			}
+		}
+		failures, err := verifySumDB(verify, sums)
+		if err != nil {
+			return err
+		}
+		for _, mod := range verify {
+			if err := failures[mod]; err != nil {
+				fail(mod, err)
+			}
+		}
+	}
+
+	// hash up front, so a module that can't be hashed is left out
+	// rather than failing the whole generator
+	prog.Phase("hashing")
+	for i, mod := range selected {
+		prog.Step(i+1, len(selected), string(mod.Path))
+		if mod.IsVendored() || failed[mod] || mod.hashedBySum() {
+			continue
+		}
+		if _, err := mod.NARHash(); err != nil {
+			if !errors.As(err, new(hinter)) {
+				err = &moduleError{Kind: "hash", Module: string(mod.Path), Err: err}
+			}
+			fail(mod, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		// generators that cover every module can't leave any out
+		if config.Strict || !gen.partial {
+			return errors.Join(problems...)
+		}
+		selected = withoutFailed(selected, failed)
+		// a failed module keeps its old expression, if it has one,
+		// and the index can go on pointing at it
+		for mod := range failed {
+			if _, err := os.Stat(filepath.Join(mod.OutDir(), "default.nix")); err == nil {
+				delete(failed, mod)
+			}
+		}
+		all = withoutFailed(all, failed)
+	}
+
+	if config.Metadata {
+		fetchMetadata(selected)
+	}
+	if config.CheckUpstream {
+		if err := checkUpstream(selected); err != nil {
+			return err
+		}
+	}
+
+	if config.VulnDB != "" {
+		if err := reportVulns(selected); err != nil {
+			return err
+		}
+	}
+	if config.Policy.enabled() {
+		violations, err := checkPolicy(all)
+		if err != nil {
+			return err
+		}
+		if len(violations) > 0 {
+			return errors.Join(violations...)
+		}
+	}
+
+	if config.CodeOwners || len(config.Maintainers) > 0 {
+		if err := assignMaintainers(selected); err != nil {
+			return err
+		}
+	}
+
+	if err := checkAttrs(all); err != nil {
+		return err
+	}
+	if err := checkDirs(all); err != nil {
+		return err
+	}
+
+	prog.Phase("generating")
+	if err := gen.generate(selected, all); err != nil {
+		return err
+	}
+	if err := generateFirstParty(modules); err != nil {
+		return err
+	}
+	if err := generateToolPrograms(modules); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &incompleteError{errors.Join(problems...)}
+	}
+	return nil
+}
+
+// markRequiredBy sets requiredBy for the external modules
+// the first-party packages import directly.
+func markRequiredBy(modules map[Path]*Module) {
+	pkgs := make(map[Path]*Package)
+	for _, mod := range modules {
+		for path, pkg := range mod.Pkgs {
+			pkgs[path] = pkg
+		}
+	}
+	requiredBy := make(map[*Module]PackageSet)
+	for path, pkg := range pkgs {
+		if pkg.Module.IsExternal() {
+			continue
+		}
+		for imp := range pkg.Imports {
+			if dep := pkgs[imp]; dep != nil && dep.Module.IsExternal() {
+				if requiredBy[dep.Module] == nil {
+					requiredBy[dep.Module] = make(PackageSet)
+				}
+				requiredBy[dep.Module].Add(path)
+			}
+		}
+	}
+	for mod, importers := range requiredBy {
+		mod.requiredBy = importers.Sorted()
+	}
+}
+
+// checkDirs fails if the expressions of two modules
+// would end up in the same dir on a case-insensitive filesystem.
+func checkDirs(mods []*Module) error {
+	byDir := make(map[string]Path)
+	var errs []error
+	for _, mod := range mods {
+		dir := strings.ToLower(mod.OutDir())
+		if other, ok := byDir[dir]; ok {
+			errs = append(errs, errors.New(withHint(
+				fmt.Sprintf("%s and %s only differ in case, so their expressions would collide on some filesystems", other, mod.Path),
+				"use -escape-dirs (\"escapeDirs\": true in mud.json) to escape capitals in their dirs")))
+			continue
+		}
+		byDir[dir] = mod.Path
+	}
+	return errors.Join(errs...)
+}
+
+func withoutFailed(mods []*Module, failed map[*Module]bool) []*Module {
+	var ok []*Module
+	for _, mod := range mods {
+		if !failed[mod] {
+			ok = append(ok, mod)
+		}
+	}
+	return ok
+}
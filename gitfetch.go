@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// SourceRule picks how modules matching Pattern are fetched in Nix:
+// "proxy" through fetchGoModule as usual, "git" with fetchgit,
+// or "github" with fetchFromGitHub.
+// The first matching rule applies.
+type SourceRule struct {
+	Pattern string `json:"pattern"`
+	Fetcher string `json:"fetcher"`
+}
+
+// Fetcher returns how the module's source is fetched,
+// which is "proxy" unless a source rule says otherwise.
+// Guix has no fetcher for the module proxy, so the guix generator
+// fetches everything with git, whatever the rules say,
+// and the buck2 generator fetches everything from the proxy.
+func (m *Module) Fetcher() string {
+	if m.IsLocal() || config.Generator == "buck2" {
+		return "proxy"
+	}
+	if config.Generator == "guix" {
+		return "git"
+	}
+	for _, rule := range config.Sources {
+		if matchPattern(rule.Pattern, m.ModuleVersion().Path) {
+			return rule.Fetcher
+		}
+	}
+	return "proxy"
+}
+
+// GitSource is where in a git repository a module is fetched from.
+type GitSource struct {
+	Fetcher string
+	URL     string
+	// Owner and Repo are set for GitHub repositories
+	Owner, Repo string
+	Rev         string
+	// Subdir is the module's directory in the repository, if it isn't the root
+	Subdir string
+}
+
+// GitSource returns where to fetch the module from,
+// or nil if it's fetched through the module proxy.
+func (m *Module) GitSource() (*GitSource, error) {
+	fetcher := m.Fetcher()
+	if fetcher == "proxy" {
+		return nil, nil
+	}
+	if m.gitSrc != nil {
+		return m.gitSrc, nil
+	}
+
+	mv := m.ModuleVersion()
+	src := &GitSource{Fetcher: fetcher, URL: guessRepoURL(mv.Path)}
+	if src.URL != "" {
+		src.Subdir = guessSubdir(mv.Path)
+	}
+	o, err := m.gitOrigin()
+	if err != nil {
+		return nil, err
+	}
+	if o != nil {
+		src.URL = o.URL
+		src.Subdir = o.Subdir
+		src.Rev = o.Hash
+	}
+	if src.URL == "" {
+		return nil, &moduleError{Kind: "fetch", Module: string(m.Path), Err: errors.New("don't know which repository to fetch it from")}
+	}
+
+	if src.Rev == "" {
+		if config.Offline {
+			return nil, &moduleError{Kind: "fetch", Module: string(m.Path), Err: fmt.Errorf("can't look up the commit for %s offline", mv.Version)}
+		}
+		if src.Rev, err = resolveRev(src.URL, src.Subdir, mv.Version); err != nil {
+			return nil, &moduleError{Kind: "fetch", Module: string(m.Path), Err: err}
+		}
+	}
+
+	if fetcher == "github" {
+		match := githubURLRe.FindStringSubmatch(src.URL)
+		if match == nil {
+			return nil, &moduleError{Kind: "fetch", Module: string(m.Path), Err: fmt.Errorf("%s isn't a GitHub repository", src.URL)}
+		}
+		src.Owner, src.Repo = match[1], match[2]
+	}
+
+	// hashing may also expand an abbreviated rev, so do it before anyone uses it
+	m.gitSrc = src
+	if _, err := m.NARHash(); err != nil {
+		m.gitSrc = nil
+		return nil, err
+	}
+	return src, nil
+}
+
+var githubURLRe = regexp.MustCompile(`^https://github\.com/([^/]+)/([^/]+?)(?:\.git)?/?$`)
+
+// guessSubdir is the counterpart of guessRepoURL:
+// whatever of the path is below the repository,
+// less a major version suffix, which is usually a branch rather than a directory.
+func guessSubdir(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) <= 3 {
+		return ""
+	}
+	rest := parts[3:]
+	if last := rest[len(rest)-1]; len(last) > 1 && last[0] == 'v' && strings.Trim(last[1:], "0123456789") == "" {
+		rest = rest[:len(rest)-1]
+	}
+	return strings.Join(rest, "/")
+}
+
+// resolveRev finds the commit for a module version.
+// Pseudo-versions name it themselves, if abbreviated,
+// and release versions are looked up as tags.
+func resolveRev(url, subdir, version string) (string, error) {
+	if module.IsPseudoVersion(version) {
+		return module.PseudoVersionRev(version)
+	}
+
+	tag := version
+	if subdir != "" {
+		tag = subdir + "/" + version
+	}
+	ref := "refs/tags/" + tag
+	// fail rather than prompt for credentials, like the go command does
+	cmd := exec.Command("git", "ls-remote", url, ref, ref+"^{}")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", explainAuth(fmt.Errorf("git ls-remote %s: %w\n%s", url, err, stderr.Bytes()))
+	}
+
+	// annotated tags show up twice, and the peeled one is the commit
+	rev := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		hash, name, _ := strings.Cut(scanner.Text(), "\t")
+		if name == ref+"^{}" || (name == ref && rev == "") {
+			rev = hash
+		}
+	}
+	if rev == "" {
+		return "", fmt.Errorf("no tag %s in %s", tag, url)
+	}
+	return rev, nil
+}
+
+// prefetch fetches the source the way Nix will, returning its NAR hash.
+func (src *GitSource) prefetch() ([]byte, error) {
+	if config.Offline {
+		return nil, fmt.Errorf("can't prefetch %s offline, and the existing manifest's hash can't be reused", src.URL)
+	}
+
+	var cmd *exec.Cmd
+	switch src.Fetcher {
+	case "github":
+		cmd = exec.Command("nix-prefetch-url", "--unpack", fmt.Sprintf("https://github.com/%s/%s/archive/%s.tar.gz", src.Owner, src.Repo, src.Rev))
+	default:
+		cmd = exec.Command("nix-prefetch-git", "--quiet", "--url", src.URL, "--rev", src.Rev)
+	}
+	slog.Info("prefetching", "url", src.URL, "rev", src.Rev)
+
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, explainAuth(fmt.Errorf("%s: %w\n%s", strings.Join(cmd.Args, " "), err, stderr.Bytes()))
+	}
+
+	if src.Fetcher == "github" {
+		return parseNixHash(strings.TrimSpace(string(out)))
+	}
+	var prefetched struct {
+		Rev    string `json:"rev"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.Unmarshal(out, &prefetched); err != nil {
+		return nil, fmt.Errorf("nix-prefetch-git: %w", err)
+	}
+	// abbreviated revs get expanded, which saves the builder a full fetch
+	if strings.HasPrefix(prefetched.Rev, src.Rev) {
+		src.Rev = prefetched.Rev
+	}
+	return parseNixHash(prefetched.SHA256)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// goCmd runs the go command with args, returning its stdout.
+// stderr is included in the error if it fails.
+func goCmd(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Env = goEnv()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, explainAuth(fmt.Errorf("go %s: %w\n%s", strings.Join(args, " "), err, stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// authFailureRe matches the ways the go command reports
+// a proxy or VCS host turning it away for lack of credentials.
+var authFailureRe = regexp.MustCompile(`\b(?:401 Unauthorized|403 Forbidden)\b|terminal prompts disabled|could not read Username`)
+
+// explainAuth adds a hint to errors that look like authentication failures.
+// Everything mud downloads goes through the go command,
+// so credentials are configured the same way as for it.
+func explainAuth(err error) error {
+	if err == nil || !authFailureRe.MatchString(err.Error()) {
+		return err
+	}
+	return fmt.Errorf("%w\nthis looks like an authentication failure: "+
+		"the go command reads credentials for the hosts in GOPROXY from $GONETRC (~/.netrc by default), "+
+		"and fetches modules matching GOPRIVATE directly, with git's credentials and without the checksum database", err)
+}
+
+// goEnv is the environment to run the go command in:
+// the shell's, or only its non-Go parts with -clean-env,
+// with the configured variables and -mod on top.
+// Offline, it's kept from touching the network at all,
+// so that missing modules fail fast instead of hanging in a sandbox.
+func goEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !config.CleanEnv || !isGoSetting(kv) {
+			env = append(env, kv)
+		}
+	}
+	if config.CleanEnv {
+		// go env -w settings are as much the developer's as their shell's
+		env = append(env, "GOENV=off")
+	}
+
+	names := make([]string, 0, len(config.Env))
+	for name := range config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+config.Env[name])
+	}
+
+	if config.Mod != "" {
+		goflags, ok := config.Env["GOFLAGS"]
+		if !ok && !config.CleanEnv {
+			goflags = os.Getenv("GOFLAGS")
+		}
+		env = append(env, "GOFLAGS="+strings.TrimSpace(goflags+" -mod="+config.Mod))
+	}
+
+	if config.Offline {
+		env = append(env, "GOPROXY=off", "GOSUMDB=off", "GOTOOLCHAIN=local")
+	}
+	return env
+}
+
+// isGoSetting reports whether an environment variable changes
+// what the go command does, rather than just where it keeps things.
+func isGoSetting(kv string) bool {
+	name, _, _ := strings.Cut(kv, "=")
+	switch name {
+	case "GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOTMPDIR":
+		return false
+	}
+	return strings.HasPrefix(name, "GO") || strings.HasPrefix(name, "CGO_")
+}
+
+var goModCache string
+
+// modCacheDir returns $GOMODCACHE, as the go command sees it.
+func modCacheDir() (string, error) {
+	if goModCache != "" {
+		return goModCache, nil
+	}
+	out, err := goCmd("env", "GOMODCACHE")
+	if err != nil {
+		return "", err
+	}
+	goModCache = strings.TrimSpace(string(out))
+	if goModCache == "" {
+		return "", fmt.Errorf("go env GOMODCACHE is empty")
+	}
+	return goModCache, nil
+}
+
+// downloadPath returns the path of a file in the module download cache,
+// such as the .zip or .info for a module version.
+func downloadPath(mv module.Version, ext string) (string, error) {
+	dir, err := modCacheDir()
+	if err != nil {
+		return "", err
+	}
+	path, err := module.EscapePath(mv.Path)
+	if err != nil {
+		return "", err
+	}
+	version, err := module.EscapeVersion(mv.Version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cache", "download", path, "@v", version+ext), nil
+}
+
+// DownloadedModule is the subset of `go mod download -json` output we use.
+type DownloadedModule struct {
+	Path    string
+	Version string
+	Error   string
+	Info    string
+	GoMod   string
+	Zip     string
+	Dir     string
+	Sum     string
+	Origin  *moduleOrigin
+}
+
+// goModDownload fetches module versions into the module cache,
+// returning what the go command reports for each of them.
+func goModDownload(mvs ...module.Version) ([]DownloadedModule, error) {
+	args := []string{"mod", "download", "-json"}
+	for _, mv := range mvs {
+		args = append(args, mv.Path+"@"+mv.Version)
+	}
+
+	// go mod download exits non-zero if any module failed,
+	// but still reports every module, so look at the output regardless
+	out, cmdErr := goCmd(args...)
+	var mods []DownloadedModule
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m DownloadedModule
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Join(cmdErr, err)
+		}
+		mods = append(mods, m)
+	}
+	if len(mods) == 0 && cmdErr != nil {
+		return nil, cmdErr
+	}
+	return mods, nil
+}
+
+// downloadMissing makes sure every module has its source in the module cache,
+// fetching any that don't unless we're offline.
+func downloadMissing(mods []*Module) error {
+	var missing []module.Version
+	byVersion := make(map[module.Version]*Module)
+	for _, mod := range mods {
+		if !mod.isMissing() {
+			continue
+		}
+		mv := mod.ModuleVersion()
+		missing = append(missing, mv)
+		byVersion[mv] = mod
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if config.Offline {
+		var errs []error
+		for _, mv := range missing {
+			errs = append(errs, &notCachedError{Module: mv.String()})
+		}
+		return errors.Join(errs...)
+	}
+
+	prog.Phase("downloading")
+	slog.Info("downloading missing modules", "count", len(missing))
+	downloaded, err := goModDownload(missing...)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range downloaded {
+		if d.Error != "" {
+			mv := module.Version{Path: d.Path, Version: d.Version}
+			errs = append(errs, &moduleError{Kind: "download", Module: mv.String(), Err: explainAuth(errors.New(d.Error))})
+			continue
+		}
+		if mod := byVersion[module.Version{Path: d.Path, Version: d.Version}]; mod != nil {
+			mod.Dir = d.Dir
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// listedPackage is the part of go list's output mud needs.
+type listedPackage struct {
+	ImportPath string
+	Name       string
+	Dir        string
+	GoFiles    []string
+	CgoFiles   []string
+	Imports    []string
+	ImportMap  map[string]string
+	Module     *packages.Module
+	DepOnly    bool
+	Error      *struct {
+		Pos string
+		Err string
+	}
+}
+
+// listFields are the fields go list is asked for,
+// which saves it working out the rest.
+const listFields = "ImportPath,Name,Dir,GoFiles,CgoFiles,Imports,ImportMap,Module,DepOnly,Error"
+
+// listPackages loads the same graph packages.Load would for the modes mud uses,
+// by streaming go list -deps -json directly.
+// Only the fields mud looks at are requested or kept,
+// so the graph of a large repository takes a fraction of the memory.
+func listPackages(cfg *packages.Config, roots []string) ([]*packages.Package, error) {
+	args := []string{"list", "-e", "-deps", "-json=" + listFields}
+	if cfg.Tests {
+		args = append(args, "-test")
+	}
+	args = append(append(args, cfg.BuildFlags...), "--")
+	args = append(args, roots...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Dir = cfg.Dir
+	cmd.Env = cfg.Env
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*packages.Package)
+	imports := make(map[*packages.Package]map[string]string)
+	var pkgs []*packages.Package
+	dec := json.NewDecoder(stdout)
+	for {
+		var lp listedPackage
+		if err := dec.Decode(&lp); err == io.EOF {
+			break
+		} else if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("reading go list output: %w", err)
+		}
+
+		pkg := &packages.Package{
+			ID:      lp.ImportPath,
+			PkgPath: lp.ImportPath,
+			Name:    lp.Name,
+			Module:  lp.Module,
+		}
+		// test variants are listed as "path [path.test]"
+		if i := strings.IndexByte(pkg.PkgPath, ' '); i >= 0 {
+			pkg.PkgPath = pkg.PkgPath[:i]
+		}
+		if cfg.Mode&packages.NeedFiles != 0 {
+			// packages.Load counts cgo files as Go files too
+			for _, name := range append(lp.GoFiles, lp.CgoFiles...) {
+				if !filepath.IsAbs(name) {
+					name = filepath.Join(lp.Dir, name)
+				}
+				pkg.GoFiles = append(pkg.GoFiles, name)
+			}
+		}
+		if lp.Error != nil {
+			pkg.Errors = append(pkg.Errors, packages.Error{Pos: lp.Error.Pos, Msg: lp.Error.Err, Kind: packages.ListError})
+		}
+
+		// imports are listed resolved; key them by what the source says, like packages.Load
+		source := make(map[string]string, len(lp.ImportMap))
+		for from, to := range lp.ImportMap {
+			source[to] = from
+		}
+		ids := make(map[string]string, len(lp.Imports))
+		for _, id := range lp.Imports {
+			if from, ok := source[id]; ok {
+				ids[from] = id
+			} else {
+				ids[id] = id
+			}
+		}
+		imports[pkg] = ids
+
+		byID[pkg.ID] = pkg
+		if !lp.DepOnly {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, explainAuth(fmt.Errorf("go list: %w\n%s", err, stderr.Bytes()))
+	}
+
+	for pkg, ids := range imports {
+		pkg.Imports = make(map[string]*packages.Package, len(ids))
+		for path, id := range ids {
+			if dep := byID[id]; dep != nil {
+				pkg.Imports[path] = dep
+			}
+		}
+	}
+	return pkgs, nil
+}
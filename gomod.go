@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// workspaceDirs returns the directories of the modules in the workspace:
+// those used by go.work if there is one, or just the repository root.
+func workspaceDirs() ([]string, error) {
+	out, err := goCmd("env", "GOWORK")
+	if err != nil {
+		return nil, err
+	}
+	gowork := strings.TrimSpace(string(out))
+	if gowork == "" || gowork == "off" {
+		return []string{"."}, nil
+	}
+
+	data, err := os.ReadFile(gowork)
+	if err != nil {
+		return nil, err
+	}
+	work, err := modfile.ParseWork(gowork, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, use := range work.Use {
+		dirs = append(dirs, filepath.Join(filepath.Dir(gowork), filepath.FromSlash(use.Path)))
+	}
+	return dirs, nil
+}
+
+var repoModuleDirs []string
+
+// repoModules returns the directories of the repository's own modules,
+// which are loaded one by one: the root, those configured,
+// and with -scan-modules, every directory with a go.mod.
+func repoModules() ([]string, error) {
+	if repoModuleDirs != nil {
+		return repoModuleDirs, nil
+	}
+	dirs := []string{"."}
+	seen := map[string]bool{".": true}
+	add := func(dir string) {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range config.Modules {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+			return nil, err
+		}
+		add(dir)
+	}
+	if config.ScanModules {
+		found, err := findGoMods()
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range found {
+			add(dir)
+		}
+	}
+	repoModuleDirs = dirs
+	return dirs, nil
+}
+
+// findGoMods returns the directories below the root with a go.mod,
+// other than the copies of external modules in gopkgsDir.
+func findGoMods() ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == "." {
+			return nil
+		}
+		if name := d.Name(); strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+			name == "testdata" || name == "vendor" || path == filepath.FromSlash(gopkgsDir) {
+			return fs.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// moduleFiles are the files of a module that say what it needs.
+func moduleFiles(dir string) []string {
+	if dir == "." {
+		return []string{"go.mod", "go.sum", "go.work", "go.work.sum"}
+	}
+	return []string{filepath.Join(dir, "go.mod"), filepath.Join(dir, "go.sum")}
+}
+
+// readGoMod parses the go.mod of the repository's module in dir.
+// It's parsed strictly, as the go command does for the main module:
+// a lenient parse keeps only the module, go, require and retract directives,
+// and callers need its tool, replace and exclude directives too.
+func readGoMod(dir string) (*modfile.File, error) {
+	name := filepath.Join(dir, "go.mod")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return modfile.Parse(name, data, nil)
+}
+
+// goModTools returns the packages named by tool directives
+// in the go.mod files of the module in dir,
+// or for the root, of the workspace.
+func goModTools(dir string) ([]string, error) {
+	dirs := []string{dir}
+	if dir == "." {
+		var err error
+		if dirs, err = workspaceDirs(); err != nil {
+			return nil, err
+		}
+	}
+
+	var tools []string
+	for _, dir := range dirs {
+		f, err := readGoMod(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, tool := range f.Tool {
+			tools = append(tools, tool.Path)
+		}
+	}
+	return tools, nil
+}
+
+// goDirectives is what a go.mod says about the Go it needs.
+type goDirectives struct {
+	Go, Toolchain string
+}
+
+// readGoDirectives reads the go and toolchain directives of a go.mod file.
+// ParseLax skips toolchain lines, but they're still in the syntax tree.
+func readGoDirectives(name string) (*goDirectives, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := modfile.ParseLax(name, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &goDirectives{}
+	if f.Go != nil {
+		d.Go = f.Go.Version
+	}
+	for _, stmt := range f.Syntax.Stmt {
+		if line, ok := stmt.(*modfile.Line); ok && len(line.Token) == 2 && line.Token[0] == "toolchain" {
+			d.Toolchain = line.Token[1]
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// GoSum maps module versions to the h1: hashes recorded for them in go.sum.
+// Only hashes of full module trees are kept, not the /go.mod ones.
+type GoSum map[module.Version]string
+
+// readGoSums merges the go.sum files of the repository's modules.
+// Only the root module has to have one.
+func readGoSums() (GoSum, error) {
+	dirs, err := repoModules()
+	if err != nil {
+		return nil, err
+	}
+	sums := make(GoSum)
+	for _, dir := range dirs {
+		s, err := readGoSum(filepath.Join(dir, "go.sum"))
+		if os.IsNotExist(err) && dir != "." {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for mv, sum := range s {
+			sums[mv] = sum
+		}
+	}
+	return sums, nil
+}
+
+func readGoSum(name string) (GoSum, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGoSum(name, f)
+}
+
+// parseGoSum parses a go.sum file read from r, naming it name in errors.
+func parseGoSum(name string, r io.Reader) (GoSum, error) {
+	sums := make(GoSum)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line", name, lineno)
+		}
+		if strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[module.Version{Path: fields[0], Version: fields[1]}] = fields[2]
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/mutable/base32"
+)
+
+// guixTmpl renders every module as a go-build-system package
+// in a single Guile module, (gopkgs), for Guix users:
+// guix build -L third_party/gopkgs go-golang-org-x-mod, say.
+// The packages only install their sources, for the packages
+// depending on them to build against, like buildGo.external does.
+var guixTmpl = template.Must(template.New("guix").Parse(`
+;;; generator //tools/mud (DO NOT EDIT)
+(define-module (gopkgs)
+  #:use-module (guix packages)
+  #:use-module (guix gexp)
+  #:use-module (guix git-download)
+  #:use-module (guix build-system go)
+  #:use-module ((guix licenses) #:prefix license:))
+{{range .}}
+(define-public {{.Var}}
+  (package
+    (name "{{.Var}}")
+    (version "{{.Version}}")
+    (source
+{{- if .Local}}
+     (local-file "{{.Local}}" "{{.Var}}-source" #:recursive? #t))
+{{- else}}
+     (origin
+       (method git-fetch)
+       (uri (git-reference
+             (url {{.URL}})
+             (commit "{{.Commit}}")))
+       (file-name (git-file-name name version))
+       (sha256
+        (base32 "{{.Hash}}"))))
+{{- end}}
+    (build-system go-build-system)
+    (arguments
+     (list
+      #:import-path "{{.ImportPath}}"
+{{- with .UnpackPath}}
+      #:unpack-path "{{.}}"
+{{- end}}
+      #:skip-build? #t
+      #:tests? #f))
+{{- with .Inputs}}
+    (propagated-inputs
+     (list{{range .}} {{.}}{{end}}))
+{{- end}}
+    (home-page {{.HomePage}})
+    (synopsis {{.Synopsis}})
+    (description {{.Description}})
+    (license {{.License}})))
+{{end -}}
+`[1:]))
+
+// guixPackage is the template data for a module's package definition.
+type guixPackage struct {
+	Var, Version string
+	// Local is the directory of a local replacement, relative to the gopkgs dir
+	Local             string
+	URL, Commit, Hash string
+	// UnpackPath is where the repository goes in GOPATH,
+	// if the module is in a subdirectory of it
+	ImportPath, UnpackPath string
+	Inputs                 []string
+	// these are Scheme expressions
+	HomePage, Synopsis, Description, License string
+}
+
+// guixString quotes a value as a Scheme string.
+func guixString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+var guixVarRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// guixVar names a module's package the way guix import go does:
+// go-, then the module path lowercased, with punctuation as dashes.
+func guixVar(path Path) string {
+	return "go-" + strings.Trim(guixVarRe.ReplaceAllString(strings.ToLower(string(path)), "-"), "-")
+}
+
+// spdxGuix maps SPDX license identifiers to the (guix licenses) variables for them.
+var spdxGuix = map[string]string{
+	"0BSD":         "license:zero-clause-bsd",
+	"Apache-2.0":   "license:asl2.0",
+	"BSD-2-Clause": "license:bsd-2",
+	"BSD-3-Clause": "license:bsd-3",
+	"CC0-1.0":      "license:cc0",
+	"GPL-2.0":      "license:gpl2",
+	"GPL-3.0":      "license:gpl3",
+	"ISC":          "license:isc",
+	"LGPL-2.1":     "license:lgpl2.1",
+	"LGPL-3.0":     "license:lgpl3",
+	"MIT":          "license:expat",
+	"MPL-2.0":      "license:mpl2.0",
+	"Unlicense":    "license:unlicense",
+	"Zlib":         "license:zlib",
+}
+
+// guixLicense turns the module's licenses into a Scheme expression,
+// #f if there are none it knows.
+func guixLicense(meta *ModuleMeta) string {
+	var licenses []string
+	if meta != nil {
+		for _, expr := range meta.Licenses {
+			// AND and OR both mean every license is in play
+			for _, id := range strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(expr)) {
+				id = strings.TrimSuffix(strings.TrimSuffix(id, "-only"), "-or-later")
+				if l, ok := spdxGuix[id]; ok {
+					licenses = append(licenses, l)
+				}
+			}
+		}
+	}
+	switch len(licenses) {
+	case 0:
+		return "#f"
+	case 1:
+		return licenses[0]
+	}
+	return "(list " + strings.Join(licenses, " ") + ")"
+}
+
+// guixPackageOf fills in the package definition of a module.
+func guixPackageOf(mod *Module) (*guixPackage, error) {
+	p := &guixPackage{
+		Var:        guixVar(mod.Path),
+		Version:    mod.Version,
+		ImportPath: string(mod.Path),
+		HomePage:   guixString("https://pkg.go.dev/" + string(mod.Path)),
+		Synopsis:   guixString("Go module " + string(mod.Path)),
+		License:    guixLicense(mod.meta),
+	}
+	p.Description = p.Synopsis
+	if meta := mod.meta; meta != nil {
+		if meta.Homepage != "" {
+			p.HomePage = guixString(meta.Homepage)
+		}
+		if meta.Description != "" {
+			p.Description = guixString(meta.Description)
+		}
+	}
+	for _, dep := range mod.DepModules() {
+		if dep.IsExternal() {
+			p.Inputs = append(p.Inputs, guixVar(dep.Path))
+		}
+	}
+
+	if mod.IsLocal() {
+		src, err := mod.LocalSrcFrom(gopkgsDir)
+		if err != nil {
+			return nil, err
+		}
+		p.Local = src
+		return p, nil
+	}
+
+	src, err := mod.GitSource()
+	if err != nil {
+		return nil, err
+	}
+	sum, err := mod.NARHash()
+	if err != nil {
+		return nil, err
+	}
+	p.URL, p.Commit, p.Hash = guixString(src.URL), src.Rev, base32.Encode(sum)
+	if src.Subdir != "" {
+		// GOPATH wants the repository where its root's import path would be
+		if root, ok := strings.CutSuffix(string(mod.Path), "/"+src.Subdir); ok {
+			p.UnpackPath = root
+		}
+	}
+	return p, nil
+}
+
+// generateGuix writes all modules into gopkgs.scm in the gopkgs dir.
+func generateGuix(selected, all []*Module) error {
+	var pkgs []*guixPackage
+	for i, mod := range all {
+		prog.Step(i+1, len(all), string(mod.Path))
+		p, err := guixPackageOf(mod)
+		if err != nil {
+			return err
+		}
+		pkgs = append(pkgs, p)
+	}
+	var buffer bytes.Buffer
+	if err := guixTmpl.Execute(&buffer, pkgs); err != nil {
+		return err
+	}
+	return emitFile(gopkgsDir, "gopkgs.scm", buffer.Bytes())
+}
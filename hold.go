@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Hold freezes the modules matching Pattern at their current versions:
+// mud update and mud add won't change them, and mud outdated says so.
+// Reason is shown along with it, so the next person knows why.
+type Hold struct {
+	Pattern string `json:"pattern"`
+	Reason  string `json:"reason"`
+}
+
+// holdFile marks a module held when it's in the module's expression dir,
+// with the reason in it, so the hold shows up in review next to the expression.
+const holdFile = "HOLD"
+
+// holdReason returns why a module is held, and whether it is:
+// the first matching hold in the config, or the module's hold file.
+func holdReason(path Path) (string, bool) {
+	for _, h := range config.Holds {
+		if matchPattern(h.Pattern, string(path)) {
+			return h.Reason, true
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(gopkgsDir, filepath.FromSlash(path.dirName()), holdFile))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// heldError is a held module that an update would have changed.
+type heldError struct {
+	Module   string
+	From, To string
+	Reason   string
+}
+
+func (e *heldError) Error() string {
+	msg := fmt.Sprintf("%s is held at %s", e.Module, e.From)
+	if e.To != "" {
+		msg += ", but this would take it to " + e.To
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return withHint(msg, e.hint())
+}
+
+func (e *heldError) hint() string {
+	return fmt.Sprintf("release it with `mud hold -release %s` first, if the hold's no longer needed", e.Module)
+}
+
+// keepHolds runs a go get, and puts go.mod and go.sum back as they were
+// if it changed the version of a held module, directly or not.
+func keepHolds(get func() error) error {
+	saved := make(map[string][]byte)
+	for _, name := range moduleFiles(".") {
+		if data, err := os.ReadFile(name); err == nil {
+			saved[name] = data
+		}
+	}
+	before, err := requiredVersions()
+	if err != nil {
+		return err
+	}
+	if err := get(); err != nil {
+		return err
+	}
+	after, err := requiredVersions()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for path := range before {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var errs []error
+	for _, path := range paths {
+		reason, held := holdReason(Path(path))
+		if held && after[path] != before[path] {
+			errs = append(errs, &heldError{Module: path, From: before[path], To: after[path], Reason: reason})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	for name, data := range saved {
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requiredVersions returns the versions go.mod requires, by module path.
+func requiredVersions() (map[string]string, error) {
+	f, err := readGoMod(".")
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]string)
+	for _, r := range f.Require {
+		versions[r.Mod.Path] = r.Mod.Version
+	}
+	return versions, nil
+}
+
+// cmdHold holds a module, with the reason given, by writing its hold file;
+// with -release, it removes the hold file instead.
+// Without arguments, it lists the held modules.
+func cmdHold(args []string) error {
+	flags := flag.NewFlagSet("hold", flag.ContinueOnError)
+	release := flags.Bool("release", false, "release the hold on the module")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 && !*release {
+		return listHolds()
+	}
+	if flags.NArg() == 0 || (*release && flags.NArg() > 1) {
+		return errors.New("usage: mud hold [<module> <reason>...], or mud hold -release <module>")
+	}
+	path := Path(flags.Arg(0))
+	name := filepath.Join(gopkgsDir, filepath.FromSlash(path.dirName()), holdFile)
+	if _, err := os.Stat(filepath.Dir(name)); err != nil {
+		return fmt.Errorf("%s has no expression to hold: %w", path, err)
+	}
+	if *release {
+		for _, h := range config.Holds {
+			if matchPattern(h.Pattern, string(path)) {
+				return fmt.Errorf("%s is held by the hold for %q in %s, so it can only be released there", path, h.Pattern, *configPath)
+			}
+		}
+		if *dryRun {
+			return nil
+		}
+		slog.Info("releasing", "module", path)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	reason := strings.Join(flags.Args()[1:], " ")
+	if reason == "" {
+		return errors.New("say why the module is held: mud hold <module> <reason>")
+	}
+	if *dryRun {
+		return nil
+	}
+	slog.Info("holding", "module", path, "reason", reason)
+	return os.WriteFile(name, []byte(reason+"\n"), 0644)
+}
+
+// listHolds prints the held modules, with the versions they're held at.
+func listHolds() error {
+	versions, err := requiredVersions()
+	if err != nil {
+		return err
+	}
+	held := make(map[string]string)
+	for path := range versions {
+		if reason, ok := holdReason(Path(path)); ok {
+			held[path] = reason
+		}
+	}
+	// hold files for modules go.mod doesn't name still count
+	err = filepath.WalkDir(gopkgsDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != holdFile {
+			return nil
+		}
+		rel, err := filepath.Rel(gopkgsDir, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		path := dirPath(filepath.ToSlash(rel))
+		if _, ok := held[string(path)]; !ok {
+			held[string(path)], _ = holdReason(path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var paths []string
+	for path := range held {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tVERSION\tREASON")
+	for _, path := range paths {
+		version := versions[path]
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", path, version, held[path])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var noHooks = flag.Bool("no-hooks", false, "don't run the configured hooks")
+
+// Hook is a command to run after a run has changed files,
+// like a formatter, git add, or a check of the generated tree.
+// It's run in the repository root with MUD_WRITTEN and MUD_REMOVED
+// set to the paths written and removed, one per line.
+// Files chooses which of them are also passed as arguments:
+// "written", "changed" for both, or none.
+// Its output goes to stderr, like the rest of mud's.
+type Hook struct {
+	Run   []string `json:"run"`
+	Files string   `json:"files"`
+}
+
+func (h *Hook) validate() error {
+	if len(h.Run) == 0 {
+		return errors.New("hooks need a command to run")
+	}
+	switch h.Files {
+	case "", "written", "changed":
+	default:
+		return fmt.Errorf("unknown hook files %q for %s (want written or changed)", h.Files, h.Run[0])
+	}
+	return nil
+}
+
+// runHooks runs the configured hooks, in order, over the changes a run made.
+// A failing hook fails the run, though its files have been written by then.
+func runHooks(cs []fileChange) error {
+	if len(config.Hooks) == 0 || len(cs) == 0 || readOnly() || *noHooks {
+		return nil
+	}
+	var written, removed []string
+	for _, c := range cs {
+		path := filepath.ToSlash(c.Path)
+		if c.Removed {
+			removed = append(removed, path)
+		} else {
+			written = append(written, path)
+		}
+	}
+
+	prog.Phase("running hooks")
+	for _, h := range config.Hooks {
+		args := h.Run[1:]
+		switch h.Files {
+		case "written":
+			args = append(args[:len(args):len(args)], written...)
+		case "changed":
+			args = append(append(args[:len(args):len(args)], written...), removed...)
+		}
+		if h.Files != "" && len(args) == len(h.Run)-1 {
+			continue // nothing to pass it
+		}
+		slog.Debug("running hook", "command", h.Run, "files", len(args)-len(h.Run)+1)
+		cmd := exec.Command(h.Run[0], args...)
+		cmd.Env = append(os.Environ(),
+			"MUD_WRITTEN="+strings.Join(written, "\n"),
+			"MUD_REMOVED="+strings.Join(removed, "\n"))
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("hook %s: %w", strings.Join(h.Run, " "), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// importedHash is a module's hash as recorded by another tool.
+type importedHash struct {
+	// Version is the module version, for gomod2nix
+	Version string
+	// Replaced is the module it's replaced by, for gomod2nix
+	Replaced string
+	// Rev is the commit or tag that was fetched, for vgo2nix
+	Rev  string
+	Hash []byte
+	// used is set once a module's hash is taken from it
+	used bool
+}
+
+// importedHashes are the hashes mud import took from another tool's manifest.
+var importedHashes map[Path]*importedHash
+
+// cmdImport generates the tree, taking hashes from a gomod2nix.toml
+// or a vgo2nix deps.nix where they were recorded for the source mud fetches:
+// the same version of the same module, or the same commit.
+func cmdImport(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mud import <gomod2nix.toml|deps.nix>")
+	}
+	name := args[0]
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasSuffix(name, ".toml"):
+		importedHashes, err = parseGomod2nix(data)
+	case strings.HasSuffix(name, ".nix"):
+		importedHashes, err = parseVgo2nix(data)
+	default:
+		return fmt.Errorf("%s: expected a gomod2nix .toml or a vgo2nix .nix file", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	slog.Info("importing hashes", "file", name, "modules", len(importedHashes))
+
+	if err := regenerate(); err != nil {
+		return err
+	}
+
+	var reused int
+	for _, imp := range importedHashes {
+		if imp.used {
+			reused++
+		}
+	}
+	slog.Info("imported", "reused", reused, "rehashed", len(importedHashes)-reused)
+	return nil
+}
+
+// reuseImported takes the module's hash from the imported manifest,
+// if it was recorded for the same source mud fetches.
+// gomod2nix hashes module cache dirs, like fetchGoModule;
+// vgo2nix hashes git checkouts, so they're only of use to the git fetcher.
+func (m *Module) reuseImported() {
+	imp := importedHashes[m.Path]
+	if imp == nil || imp.Hash == nil {
+		return
+	}
+
+	mv := m.ModuleVersion()
+	switch {
+	case imp.Version != "":
+		replaced := imp.Replaced
+		if replaced == "" {
+			replaced = string(m.Path)
+		}
+		if m.Fetcher() != "proxy" || len(m.sourceExcludes()) > 0 || imp.Version != mv.Version || replaced != mv.Path {
+			slog.Info("not reusing imported hash", "module", m.Path, "imported", imp.Version, "version", mv.Version)
+			return
+		}
+	case imp.Rev != "":
+		same := imp.Rev == mv.Version
+		if rev, err := module.PseudoVersionRev(mv.Version); err == nil {
+			// pseudo-versions only have a prefix of the commit hash
+			same = strings.HasPrefix(imp.Rev, rev)
+		}
+		if m.Fetcher() != "git" || !same {
+			slog.Info("not reusing imported hash", "module", m.Path, "rev", imp.Rev, "version", mv.Version)
+			return
+		}
+	default:
+		return
+	}
+
+	m.narHash = imp.Hash
+	m.hashReused = true
+	imp.used = true
+}
+
+var (
+	gomod2nixSectionRe = regexp.MustCompile(`^\[mod\.("(?:[^"\\]|\\.)*")\]$`)
+	gomod2nixKeyRe     = regexp.MustCompile(`^(\w+) = ("(?:[^"\\]|\\.)*")$`)
+)
+
+// parseGomod2nix reads the [mod] tables of a gomod2nix.toml.
+// It's regular enough not to need a TOML parser.
+func parseGomod2nix(data []byte) (map[Path]*importedHash, error) {
+	hashes := make(map[Path]*importedHash)
+	var cur *importedHash
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := gomod2nixSectionRe.FindStringSubmatch(line); m != nil {
+			path, err := strconv.Unquote(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			cur = &importedHash{}
+			hashes[Path(path)] = cur
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			cur = nil
+			continue
+		}
+		m := gomod2nixKeyRe.FindStringSubmatch(line)
+		if m == nil || cur == nil {
+			continue
+		}
+		value, err := strconv.Unquote(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		switch m[1] {
+		case "version":
+			cur.Version = value
+		case "replaced":
+			cur.Replaced = value
+		case "hash":
+			if cur.Hash, err = parseNixHash(value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+		}
+	}
+	return hashes, scanner.Err()
+}
+
+var (
+	vgo2nixEntryRe = regexp.MustCompile(`(?s)\{\s*goPackagePath\s*=\s*"([^"]*)";\s*fetch\s*=\s*\{(.*?)\};\s*\}`)
+	vgo2nixAttrRe  = regexp.MustCompile(`(\w+)\s*=\s*"([^"]*)";`)
+)
+
+// parseVgo2nix reads the entries of a vgo2nix deps.nix.
+func parseVgo2nix(data []byte) (map[Path]*importedHash, error) {
+	hashes := make(map[Path]*importedHash)
+	for _, entry := range vgo2nixEntryRe.FindAllSubmatch(data, -1) {
+		imp := &importedHash{}
+		attrs := make(map[string]string)
+		for _, attr := range vgo2nixAttrRe.FindAllSubmatch(entry[2], -1) {
+			attrs[string(attr[1])] = string(attr[2])
+		}
+		if attrs["type"] != "git" {
+			continue
+		}
+		imp.Rev = attrs["rev"]
+		sum, err := parseNixHash(attrs["sha256"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry[1], err)
+		}
+		imp.Hash = sum
+		hashes[Path(entry[1])] = imp
+	}
+	if len(hashes) == 0 {
+		return nil, errors.New("no git dependencies found")
+	}
+	return hashes, nil
+}
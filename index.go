@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	slashpath "path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// indexHeader starts the generated index of all module expressions.
+const indexHeader = `# generator //tools/mud (DO NOT EDIT)
+args:
+
+`
+
+// indexFile returns the contents of the gopkgs index,
+// an attrset of every module expression keyed by its attr path.
+func indexFile(mods []*Module) []byte {
+	root := &attrTree{}
+	for _, mod := range mods {
+		node := root
+		for _, name := range mod.Path.nixAttrNames() {
+			node = node.child(name)
+		}
+		node.expr = fmt.Sprintf("import %s args", nixRelPath(mod.Path.dirName()))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(indexHeader)
+	root.write(&buf, 0)
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// nixPathRe matches relative paths that can be written as Nix path literals.
+var nixPathRe = regexp.MustCompile(`^[a-zA-Z0-9._+-]+(?:/[a-zA-Z0-9._+-]+)*$`)
+
+// nixRelPath writes a path relative to the current Nix file,
+// as a literal if it can be one.
+func nixRelPath(rel string) string {
+	if nixPathRe.MatchString(rel) {
+		return "./" + rel
+	}
+	return "(./. + " + nixString("/"+rel) + ")"
+}
+
+// reservedAttrs are attributes of a module's expression,
+// which a nested module can't also be exposed as:
+// those of any derivation, and those buildGo adds.
+var reservedAttrs = map[string]bool{
+	"name": true, "type": true, "drvPath": true, "outPath": true,
+	"out": true, "outputs": true, "outputName": true, "all": true,
+	"meta": true, "passthru": true, "override": true,
+	"overrideAttrs": true, "overrideDerivation": true,
+	"gopkg": true, "goDeps": true, "goImportPath": true,
+}
+
+// attrRenames maps module paths to the name their last element is
+// exposed as in the index, where the plain one would collide.
+// A module nested in another (foo/bar in foo) shares its attrset,
+// so if its name is one of the outer expression's own attributes,
+// it's primed instead: gopkgs.foo."meta'".
+// Module paths can't contain ', so primed names can't collide in turn.
+var attrRenames map[Path]string
+
+// renameAttrs computes attrRenames for a set of module paths.
+func renameAttrs(paths []Path) map[Path]string {
+	set := make(map[Path]bool)
+	for _, path := range paths {
+		set[path] = true
+	}
+	renames := make(map[Path]string)
+	for _, path := range paths {
+		i := strings.LastIndexByte(string(path), '/')
+		if i < 0 {
+			continue
+		}
+		if parent, name := path[:i], string(path[i+1:]); set[parent] && reservedAttrs[name] {
+			renames[path] = name + "'"
+		}
+	}
+	return renames
+}
+
+// checkAttrs sets attrRenames for the modules,
+// and fails if any of them can't be told apart in the index:
+// a module using packages from a directory that's also a nested module,
+// so that both would be the same attr.
+func checkAttrs(mods []*Module) error {
+	var paths []Path
+	for _, mod := range mods {
+		paths = append(paths, mod.Path)
+	}
+	attrRenames = renameAttrs(paths)
+
+	byPath := make(map[Path]*Module)
+	for _, mod := range mods {
+		byPath[mod.Path] = mod
+	}
+	byAttr := make(map[string]Path)
+	var errs []error
+	for _, mod := range mods {
+		attr := mod.Path.NixAttr()
+		if other, ok := byAttr[attr]; ok {
+			errs = append(errs, fmt.Errorf("%s and %s would both be gopkgs.%s", other, mod.Path, attr))
+			continue
+		}
+		byAttr[attr] = mod.Path
+		for _, pkg := range mod.PackageList() {
+			// the nested module with the longest path would claim the attr
+			for p := pkg; len(p) > len(mod.Path); p = Path(slashpath.Dir(string(p))) {
+				if nested := byPath[p]; nested != nil {
+					errs = append(errs, fmt.Errorf("package %s of module %s would be gopkgs.%s, which is module %s", pkg, mod.Path, pkg.NixAttr(), nested.Path))
+					break
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// attrTree is a nested attrset being built up.
+// A node with both an expression and children
+// is written as the expression merged with the children.
+type attrTree struct {
+	expr     string
+	children map[string]*attrTree
+}
+
+func (t *attrTree) child(name string) *attrTree {
+	if t.children == nil {
+		t.children = make(map[string]*attrTree)
+	}
+	c := t.children[name]
+	if c == nil {
+		c = &attrTree{}
+		t.children[name] = c
+	}
+	return c
+}
+
+func (t *attrTree) write(buf *bytes.Buffer, depth int) {
+	if len(t.children) == 0 {
+		buf.WriteString(t.expr)
+		return
+	}
+	if t.expr != "" {
+		buf.WriteString(t.expr)
+		buf.WriteString(" // ")
+	}
+
+	names := make([]string, 0, len(t.children))
+	for name := range t.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	indent := strings.Repeat("  ", depth+1)
+	buf.WriteString("{\n")
+	for _, name := range names {
+		// collapse chains of plain attrsets into a single attr path
+		key, c := name, t.children[name]
+		for c.expr == "" && len(c.children) == 1 {
+			for next, cc := range c.children {
+				key, c = key+"."+next, cc
+			}
+		}
+		buf.WriteString(indent)
+		buf.WriteString(key)
+		buf.WriteString(" = ")
+		c.write(buf, depth+1)
+		buf.WriteString(";\n")
+	}
+	buf.WriteString(strings.Repeat("  ", depth))
+	buf.WriteString("}")
+}
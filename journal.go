@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalFile is the change journal in the gopkgs dir, with the Journal setting.
+const journalFile = "CHANGES.json"
+
+// journalEntry records what a run did to the set of modules.
+type journalEntry struct {
+	Time     string          `json:"time"`
+	Added    []journalModule `json:"added,omitempty"`
+	Removed  []journalModule `json:"removed,omitempty"`
+	Updated  []journalModule `json:"updated,omitempty"`
+	Rehashed []journalModule `json:"rehashed,omitempty"`
+}
+
+type journalModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	// From is the version it was updated from
+	From string `json:"from,omitempty"`
+	// GoSum is the h1: hash from go.sum the expression was generated from
+	GoSum string `json:"goSum,omitempty"`
+}
+
+// emitJournal adds an entry for the module changes since the start'th one
+// to the change journal, so the history of the dependency set can be read
+// from one file rather than dug out of the history of hundreds.
+// Runs that change no module add nothing.
+func emitJournal(modules map[Path]*Module, start int) error {
+	s := summarize(changes[start:])
+	if len(s.Added)+len(s.Removed)+len(s.Updated)+len(s.Rehashed) == 0 {
+		return nil
+	}
+
+	var journal []journalEntry
+	name := filepath.Join(gopkgsDir, journalFile)
+	data, err := os.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &journal); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	version := func(v string) string {
+		if v == "" {
+			return "" // local modules have none
+		}
+		return withV(v)
+	}
+	sum := func(path string) string {
+		if mod := modules[Path(path)]; mod != nil {
+			return mod.Sum()
+		}
+		return ""
+	}
+	entry := journalEntry{Time: time.Now().UTC().Format(time.RFC3339)}
+	for _, c := range s.Added {
+		entry.Added = append(entry.Added, journalModule{Path: c.Path, Version: version(c.NewVersion), GoSum: sum(c.Path)})
+	}
+	for _, c := range s.Removed {
+		entry.Removed = append(entry.Removed, journalModule{Path: c.Path, Version: version(c.OldVersion)})
+	}
+	for _, c := range s.Updated {
+		entry.Updated = append(entry.Updated, journalModule{Path: c.Path, Version: version(c.NewVersion), From: version(c.OldVersion), GoSum: sum(c.Path)})
+	}
+	for _, c := range s.Rehashed {
+		entry.Rehashed = append(entry.Rehashed, journalModule{Path: c.Path, Version: version(c.NewVersion), GoSum: sum(c.Path)})
+	}
+
+	data, err = json.MarshalIndent(append(journal, entry), "", "  ")
+	if err != nil {
+		return err
+	}
+	return emitFile(gopkgsDir, journalFile, append(data, '\n'))
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/multierr"
+	"golang.org/x/tools/go/packages"
+)
+
+// loadModules loads the packages of the repository and its tools,
+// and groups them into the modules they come from.
+// With several builds or repository modules configured,
+// the result covers all of them.
+func loadModules() (map[Path]*Module, error) {
+	dirs, err := repoModules()
+	if err != nil {
+		return nil, err
+	}
+
+	// packages that fail to load are reported, and left out of the graph;
+	// the rest of it is still returned
+	var problems error
+	modules := make(map[Path]*Module)
+	requiredBy := make(map[Path]string)
+	for _, dir := range dirs {
+		// the go command's errors about these don't say what they're about
+		if err := checkExcludes(dir); err != nil {
+			return nil, err
+		}
+		roots, err := loadRoots(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, build := range config.builds() {
+			slog.Debug("loading packages", "dir", dir, "build", build.Name, "roots", len(roots), "tags", build.Tags, "goos", build.GOOS, "goarch", build.GOARCH)
+			cfg := build.packagesConfig()
+			cfg.Dir = dir
+			prog.Phase("loading packages")
+			pkgs, err := loadPackages(build.Name, cfg, roots)
+			if err != nil {
+				if config.Offline {
+					if missing := missingModules(err.Error()); missing != nil {
+						return nil, missing
+					}
+				}
+				return nil, err
+			}
+			pkgs = dropIgnored(dropExtraTests(pkgs))
+			// one expression serves every module in the repository,
+			// so they have to agree on the version of each dependency
+			if err := checkVersions(modules, requiredBy, pkgs, dir); err != nil {
+				return nil, err
+			}
+			prog.Phase("building graph")
+			err = addPackages(modules, pkgs, build.Name)
+			markUsed(modules, pkgs, dir)
+			if config.Offline {
+				// the packages that failed did so because of these
+				if missing := missingOffline(pkgs); missing != nil {
+					err = missing
+				}
+			}
+			multierr.AppendInto(&problems, err)
+		}
+	}
+
+	if config.ModuleGraph {
+		prog.Phase("reading module graph")
+		if err := addModuleGraph(modules, dirs); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ignoredPackages) > 0 {
+		slog.Info("left out ignored packages", "packages", sortedKeys(ignoredPackages))
+	}
+	slog.Info("loaded packages", "modules", len(modules))
+	if problems != nil {
+		return modules, &incompleteError{problems}
+	}
+	return modules, nil
+}
+
+// checkVersions checks the external modules pkgs use from the module in dir
+// are the versions already in the graph, if they're there.
+// requiredBy records which repository module brought each one in.
+func checkVersions(modules map[Path]*Module, requiredBy map[Path]string, pkgs []*packages.Package, dir string) error {
+	var errs []error
+	reported := make(map[Path]bool)
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		m := pkg.Module
+		if m == nil || m.Main || isBuiltin(pkg) {
+			return
+		}
+		path := Path(m.Path)
+		version, replace := strings.TrimPrefix(m.Version, "v"), ""
+		if m.Replace != nil {
+			version, replace = strings.TrimPrefix(m.Replace.Version, "v"), m.Replace.Path
+		}
+		mod := modules[path]
+		if mod == nil {
+			requiredBy[path] = dir
+			return
+		}
+		if !mod.IsExternal() || (mod.Version == version && mod.ReplacePath == replace) || reported[path] {
+			return
+		}
+		reported[path] = true
+		e := &versionConflictError{
+			Module: path,
+			Dirs:   [2]string{requiredBy[path], dir},
+			Uses:   [2]string{mod.describe(), describeVersion(version, replace)},
+		}
+		// what MVS selected from is a matter of the module graphs;
+		// the conflict is worth reporting even if they can't be read
+		for i, d := range e.Dirs {
+			if _, by, err := selectedVersion(d, path); err != nil {
+				slog.Debug("reading module graph", "dir", d, "err", err)
+			} else {
+				e.RequiredBy[i] = by
+			}
+		}
+		errs = append(errs, e)
+	})
+	return errors.Join(errs...)
+}
+
+// markUsed notes which modules the packages loaded for the module in dir use.
+func markUsed(modules map[Path]*Module, pkgs []*packages.Package, dir string) {
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if pkg.Module == nil {
+			return
+		}
+		mod := modules[Path(pkg.Module.Path)]
+		if mod == nil {
+			return // failed to load
+		}
+		if mod.usedBy == nil {
+			mod.usedBy = make(map[string]bool)
+		}
+		mod.usedBy[dir] = true
+	})
+}
+
+// ignoredPackages are the packages dropIgnored left out, to be reported.
+var ignoredPackages = make(map[string]bool)
+
+// dropIgnored leaves the packages the Ignore setting matches out of the graph,
+// along with their tests, so whatever only they import goes too,
+// and a broken package there doesn't fail the load.
+func dropIgnored(pkgs []*packages.Package) []*packages.Package {
+	if len(config.Ignore) == 0 {
+		return pkgs
+	}
+	ignored := func(pkg *packages.Package) bool {
+		// tests are ignored with the package they test
+		path := strings.TrimSuffix(strings.TrimSuffix(pkg.PkgPath, ".test"), "_test")
+		if !matchAny(config.Ignore, path) {
+			return false
+		}
+		ignoredPackages[path] = true
+		return true
+	}
+
+	var roots []*packages.Package
+	for _, pkg := range pkgs {
+		if !ignored(pkg) {
+			roots = append(roots, pkg)
+		}
+	}
+	packages.Visit(roots, func(pkg *packages.Package) bool {
+		for path, imp := range pkg.Imports {
+			if ignored(imp) {
+				delete(pkg.Imports, path)
+			}
+		}
+		return true
+	}, nil)
+	return roots
+}
+
+// extraRoots are packages to load in addition to the usual roots.
+var extraRoots []string
+
+// dropExtraTests leaves the tests of the extra roots out of the graph:
+// only the repository's own packages are loaded with their tests.
+func dropExtraTests(pkgs []*packages.Package) []*packages.Package {
+	if len(extraRoots) == 0 {
+		return pkgs
+	}
+	var roots []*packages.Package
+	for _, pkg := range pkgs {
+		path := strings.TrimSuffix(strings.TrimSuffix(pkg.PkgPath, ".test"), "_test")
+		if slices.Contains(extraRoots, path) && (pkg.ID != pkg.PkgPath || path != pkg.PkgPath) {
+			continue
+		}
+		roots = append(roots, pkg)
+	}
+	return roots
+}
+
+// toolPackages are the packages loadRoots found the tools roots
+// and tool directives naming, whose commands are the repository's tools.
+var toolPackages = make(map[Path]bool)
+
+// resetLoad forgets what the last load found,
+// so a round of -watch starts afresh.
+func resetLoad() {
+	toolPackages = make(map[Path]bool)
+	ignoredPackages = make(map[string]bool)
+}
+
+// loadRoots returns the package patterns to load:
+// everything in the repository, plus the tools it depends on.
+func loadRoots(dir string) ([]string, error) {
+	roots := []string{"./..."}
+	if dir == "." {
+		// extra roots are given relative to the root
+		roots = append(roots, extraRoots...)
+	}
+	// the tools roots are small loads of their own, so do them all at once
+	imports := make([][]string, len(config.Tools))
+	errs := make([]error, len(config.Tools))
+	var wg sync.WaitGroup
+	for i, tools := range config.Tools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Debug("loading tools", "pattern", tools.Pattern, "tags", tools.Tags)
+			var buildFlags []string
+			if len(tools.Tags) > 0 {
+				buildFlags = []string{"-tags", strings.Join(tools.Tags, ",")}
+			}
+			pkgs, err := packages.Load(&packages.Config{
+				Mode: 0 |
+					packages.NeedName |
+					packages.NeedImports,
+				BuildFlags: buildFlags,
+				Env:        goEnv(),
+				Dir:        dir,
+			}, tools.Pattern)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, pkg := range pkgs {
+				for dep := range pkg.Imports {
+					imports[i] = append(imports[i], dep)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for _, deps := range imports {
+		roots = append(roots, deps...)
+		for _, dep := range deps {
+			toolPackages[Path(dep)] = true
+		}
+	}
+
+	// since Go 1.24, tools can also be declared in go.mod
+	tools, err := goModTools(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, tool := range tools {
+		toolPackages[Path(tool)] = true
+	}
+	return append(roots, tools...), nil
+}
+
+func (b *Build) packagesConfig() *packages.Config {
+	cfg := &packages.Config{
+		Mode: 0 |
+			packages.NeedName |
+			packages.NeedDeps |
+			packages.NeedImports |
+			packages.NeedModule,
+		Tests: !config.SkipTests,
+	}
+	if config.FirstPartyDir != "" || config.ProgramsDir != "" || config.ToolProgramsDir != "" || config.Generator == "buck2" {
+		cfg.Mode |= packages.NeedFiles
+	}
+	if len(b.Tags) > 0 {
+		cfg.BuildFlags = []string{"-tags", strings.Join(b.Tags, ",")}
+	}
+	cfg.Env = goEnv()
+	if b.GOOS != "" {
+		cfg.Env = append(cfg.Env, "GOOS="+b.GOOS)
+	}
+	if b.GOARCH != "" {
+		cfg.Env = append(cfg.Env, "GOARCH="+b.GOARCH)
+	}
+	return cfg
+}
+
+// addPackages adds the modules pkgs transitively use to modules,
+// noting that they're needed by the named build.
+func addPackages(modules map[Path]*Module, pkgs []*packages.Package, build string) error {
+	// for each module, figure out what dependencies it has
+	// NOTE: these aren't necessarily *complete* dependencies,
+	// since we are just walking the packages we're transitively using,
+	// rather than $MODULE/...; -module-graph fills them in from go.mod
+
+	var errs error
+	packages.Visit(pkgs,
+		func(pkg *packages.Package) bool {
+			return !isBuiltin(pkg)
+		},
+		func(pkg *packages.Package) {
+			if isBuiltin(pkg) {
+				return
+			}
+
+			if err := pkgErrors(pkg); err != nil {
+				multierr.AppendInto(&errs, &packageError{Package: pkg.PkgPath, Err: err})
+				return
+			}
+
+			if pkg.Module == nil {
+				if pkg.Name == "main" && strings.HasSuffix(pkg.PkgPath, ".test") {
+					return // test packages show up twice, once without pkg.Module set
+				}
+				if strings.HasSuffix(pkg.PkgPath, "_test") {
+					// _test packages don't have pkg.Module set
+					// their main package ends in .test instead
+					return
+				}
+				multierr.AppendInto(&errs, fmt.Errorf("package without a module: %s", pkg.PkgPath))
+				return
+			}
+
+			mod := modules[Path(pkg.Module.Path)]
+			if mod == nil {
+				mod = &Module{
+					Path:     Path(pkg.Module.Path),
+					Version:  pkg.Module.Version,
+					Dir:      pkg.Module.Dir,
+					Deps:     make(map[*Module]PackageSet),
+					Packages: make(PackageSet),
+					Pkgs:     make(map[Path]*Package),
+					Builds:   make(map[string]bool),
+				}
+
+				if pkg.Module.Replace != nil {
+					mod.ReplacePath = pkg.Module.Replace.Path
+					mod.Version = pkg.Module.Replace.Version
+				}
+
+				mod.Version = strings.TrimPrefix(mod.Version, "v")
+				modules[mod.Path] = mod
+			}
+			mod.Packages.Add(Path(pkg.PkgPath))
+			if build != "" {
+				mod.Builds[build] = true
+			}
+
+			// test variants of packages have the same path, but extra files and imports
+			p := mod.Pkgs[Path(pkg.PkgPath)]
+			if p == nil && pkg.ID == pkg.PkgPath {
+				p = &Package{
+					Path:    Path(pkg.PkgPath),
+					Name:    pkg.Name,
+					Module:  mod,
+					GoFiles: pkg.GoFiles,
+					Imports: make(PackageSet),
+				}
+				mod.Pkgs[p.Path] = p
+			}
+
+			for _, dep := range pkg.Imports {
+				if isBuiltin(dep) {
+					continue
+				}
+				if p != nil && pkg.ID == pkg.PkgPath {
+					p.Imports.Add(Path(dep.PkgPath))
+				}
+
+				if dep.Module == nil {
+					continue // already reported
+				}
+				depMod := modules[Path(dep.Module.Path)]
+				if depMod == nil {
+					continue // failed to load, and already reported
+				}
+				if depMod.Path == mod.Path {
+					continue // ignore intra-module dependencies
+				}
+
+				depSet := mod.Dep(depMod)
+				depSet.Add(Path(dep.PkgPath))
+			}
+		},
+	)
+	return errs
+}
+
+var offlineLookupRe = regexp.MustCompile(`(\S+@\S+): module lookup disabled by GOPROXY=off`)
+
+// missingOffline lists the modules a load offline couldn't find,
+// rather than the errors of every package that needed them.
+func missingOffline(pkgs []*packages.Package) error {
+	var texts []string
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if err := pkgErrors(pkg); err != nil {
+			texts = append(texts, err.Error())
+		}
+	})
+	return missingModules(texts...)
+}
+
+// missingModules finds the modules the go command couldn't look up offline
+// in its error messages.
+func missingModules(texts ...string) error {
+	missing := make(map[string]bool)
+	for _, text := range texts {
+		for _, match := range offlineLookupRe.FindAllStringSubmatch(text, -1) {
+			missing[match[1]] = true
+		}
+	}
+
+	var errs []error
+	for _, mv := range sortedKeys(missing) {
+		errs = append(errs, &notCachedError{Module: mv})
+	}
+	return errors.Join(errs...)
+}
+
+func pkgErrors(pkg *packages.Package) error {
+	var errs error
+	for _, err := range pkg.Errors {
+		multierr.AppendInto(&errs, err)
+	}
+	if pkg.Module != nil && pkg.Module.Error != nil {
+		multierr.AppendInto(&errs, errors.New(pkg.Module.Error.Err))
+	}
+	return errs
+}
+
+func isBuiltin(pkg *packages.Package) bool {
+	importPath := pkg.PkgPath
+	i := strings.IndexByte(importPath, '/')
+	if i != -1 {
+		importPath = importPath[:i]
+	}
+	return strings.IndexByte(importPath, '.') == -1
+}
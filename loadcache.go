@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/packages"
+)
+
+var noLoadCache bool
+
+func init() {
+	flag.BoolVar(&noLoadCache, "no-load-cache", false, "always load packages, instead of reusing the last load when nothing changed")
+}
+
+// loadCache is a flattened packages.Load result, along with the key
+// of the inputs it was loaded from.
+type loadCache struct {
+	Key      string          `json:"key"`
+	Roots    []string        `json:"roots"`
+	Packages []cachedPackage `json:"packages"`
+}
+
+type cachedPackage struct {
+	ID      string   `json:"id"`
+	PkgPath string   `json:"pkgPath"`
+	Name    string   `json:"name"`
+	GoFiles []string `json:"goFiles,omitempty"`
+	// Imports maps import paths to package IDs
+	Imports map[string]string `json:"imports,omitempty"`
+	Module  *packages.Module  `json:"module,omitempty"`
+}
+
+func loadCachePath(build string) string {
+	if build == "" {
+		build = "default"
+	}
+	return filepath.Join(stateDir(), "load", build+".json")
+}
+
+// loadCacheName names the cache of a build's load of the module in dir.
+func loadCacheName(build, dir string) string {
+	if dir == "" || dir == "." {
+		return build
+	}
+	if build == "" {
+		build = "default"
+	}
+	return build + "@" + strings.ReplaceAll(filepath.ToSlash(dir), "/", "_")
+}
+
+// loadKey identifies the inputs of a load: what's being loaded and how,
+// the module files, and the names, sizes and mtimes of the Go files,
+// in the repository and in the local replacements outside it.
+// Anything else outside the repository comes from the module cache,
+// which is immutable, and is pinned by go.sum.
+func loadKey(cfg *packages.Config, roots []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "mode %d tests %t\n", cfg.Mode, cfg.Tests)
+	fmt.Fprintf(h, "flags %q\nroots %q\n", cfg.BuildFlags, roots)
+	for _, env := range cfg.Env {
+		if strings.HasPrefix(env, "GO") || strings.HasPrefix(env, "CGO_") {
+			fmt.Fprintf(h, "env %q\n", env)
+		}
+	}
+	for _, name := range []string{"GOFLAGS", "GOOS", "GOARCH", "GOWORK", "GOEXPERIMENT", "CGO_ENABLED"} {
+		fmt.Fprintf(h, "%s=%q\n", name, os.Getenv(name))
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "."
+	}
+	fmt.Fprintf(h, "dir %q\n", dir)
+	for _, name := range moduleFiles(dir) {
+		data, err := os.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		io.WriteString(h, name+"\n"+hashBytes(data)+"\n")
+	}
+
+	files, err := repoGoFiles()
+	if err != nil {
+		return "", err
+	}
+	// go.mod files in subdirectories change which module packages are in
+	files = append(files, nestedGoMods(files)...)
+	replaced, err := localReplaceDirs(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range replaced {
+		fmt.Fprintf(h, "replacement %q\n", root)
+		more, err := goFilesIn(root)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		files = append(files, more...)
+		files = append(files, filepath.Join(root, "go.mod"))
+	}
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(h, "%s missing\n", path)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localReplaceDirs returns the directories outside the repository
+// that the module in dir replaces modules with, since nothing pins what's in them.
+// Those inside the repository are covered by its Go files.
+func localReplaceDirs(dir string) ([]string, error) {
+	dirs, err := replaceDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return nil, err
+	}
+	var outside []string
+	for _, target := range dirs {
+		if rel, err := filepath.Rel(root, target); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		outside = append(outside, target)
+	}
+	return outside, nil
+}
+
+// replaceDirs returns the absolute paths of the directories
+// the go.mod in dir replaces modules with;
+// for the root, those of every module in the workspace and of go.work,
+// which all apply in workspace mode.
+func replaceDirs(dir string) ([]string, error) {
+	mods := []string{dir}
+	if dir == "." {
+		var err error
+		if mods, err = workspaceDirs(); err != nil {
+			return nil, err
+		}
+	}
+	var replaces []*modfile.Replace
+	var base []string
+	for _, mod := range mods {
+		f, err := readGoMod(mod)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, r := range f.Replace {
+			replaces, base = append(replaces, r), append(base, mod)
+		}
+	}
+	if dir == "." {
+		if data, err := os.ReadFile("go.work"); err == nil {
+			work, err := modfile.ParseWork("go.work", data, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range work.Replace {
+				replaces, base = append(replaces, r), append(base, ".")
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	var dirs []string
+	for i, r := range replaces {
+		if !modfile.IsDirectoryPath(r.New.Path) {
+			continue
+		}
+		target := filepath.FromSlash(r.New.Path)
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(base[i], target)
+		}
+		// the workspace's modules are absolute, the rest relative to the root
+		target, err := filepath.Abs(target)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, target)
+	}
+	sort.Strings(dirs)
+	return slices.Compact(dirs), nil
+}
+
+// nestedGoMods returns the go.mod files in the directories of files,
+// other than the root one.
+func nestedGoMods(files []string) []string {
+	seen := make(map[string]bool)
+	var mods []string
+	for _, path := range files {
+		dir := filepath.Dir(path)
+		if dir == "." || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		name := filepath.Join(dir, "go.mod")
+		if _, err := os.Stat(name); err == nil {
+			mods = append(mods, name)
+		}
+	}
+	return mods
+}
+
+// loadPackages is packages.Load, reusing the last result for the build
+// if its inputs haven't changed.
+func loadPackages(build string, cfg *packages.Config, roots []string) ([]*packages.Package, error) {
+	if noLoadCache {
+		return load(cfg, roots)
+	}
+
+	key, err := loadKey(cfg, roots)
+	if err != nil {
+		return nil, err
+	}
+	build = loadCacheName(build, cfg.Dir)
+	if cache := readLoadCache(build); cache != nil && cache.Key == key {
+		if dir := cache.missingDir(); dir != "" {
+			slog.Debug("not reusing cached package load, a module dir is gone", "build", build, "dir", dir)
+		} else {
+			slog.Debug("reusing cached package load", "build", build)
+			return cache.packages(), nil
+		}
+	}
+
+	pkgs, err := load(cfg, roots)
+	if err != nil {
+		return nil, err
+	}
+	// errors might be transient, like a failed download, so don't keep them
+	if !readOnly() && !hasErrors(pkgs) {
+		if err := writeLoadCache(build, newLoadCache(key, pkgs)); err != nil {
+			// the cache is only an optimisation
+			slog.Warn("couldn't write package load cache", "error", err)
+		}
+	}
+	return pkgs, nil
+}
+
+// load loads packages with the configured loader, in shards.
+func load(cfg *packages.Config, roots []string) ([]*packages.Package, error) {
+	if config.Loader == "golist" {
+		return loadSharded(cfg, roots, listPackages)
+	}
+	return loadSharded(cfg, roots, func(cfg *packages.Config, roots []string) ([]*packages.Package, error) {
+		return packages.Load(cfg, roots...)
+	})
+}
+
+func hasErrors(pkgs []*packages.Package) bool {
+	failed := false
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if pkgErrors(pkg) != nil {
+			failed = true
+		}
+	})
+	return failed
+}
+
+func readLoadCache(build string) *loadCache {
+	data, err := os.ReadFile(loadCachePath(build))
+	if err != nil {
+		return nil
+	}
+	var cache loadCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		slog.Debug("ignoring unreadable package load cache", "error", err)
+		return nil
+	}
+	return &cache
+}
+
+func writeLoadCache(build string, cache *loadCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	path := loadCachePath(build)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func newLoadCache(key string, pkgs []*packages.Package) *loadCache {
+	cache := &loadCache{Key: key}
+	for _, pkg := range pkgs {
+		cache.Roots = append(cache.Roots, pkg.ID)
+	}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		cp := cachedPackage{
+			ID:      pkg.ID,
+			PkgPath: pkg.PkgPath,
+			Name:    pkg.Name,
+			GoFiles: pkg.GoFiles,
+			Module:  pkg.Module,
+		}
+		if len(pkg.Imports) > 0 {
+			cp.Imports = make(map[string]string)
+			for path, dep := range pkg.Imports {
+				cp.Imports[path] = dep.ID
+			}
+		}
+		cache.Packages = append(cache.Packages, cp)
+	})
+	return cache
+}
+
+// missingDir returns a module dir the cached load refers to that's not
+// there anymore, as after a go clean -modcache, or "" if they all are.
+// Modules without one would be taken as present, and not downloaded.
+func (c *loadCache) missingDir() string {
+	seen := make(map[string]bool)
+	for _, cp := range c.Packages {
+		for m := cp.Module; m != nil; m = m.Replace {
+			if m.Dir == "" || seen[m.Dir] {
+				continue
+			}
+			seen[m.Dir] = true
+			if _, err := os.Stat(m.Dir); err != nil {
+				return m.Dir
+			}
+		}
+	}
+	return ""
+}
+
+// packages rebuilds the package graph, returning its roots.
+func (c *loadCache) packages() []*packages.Package {
+	byID := make(map[string]*packages.Package)
+	for _, cp := range c.Packages {
+		byID[cp.ID] = &packages.Package{
+			ID:      cp.ID,
+			PkgPath: cp.PkgPath,
+			Name:    cp.Name,
+			GoFiles: cp.GoFiles,
+			Module:  cp.Module,
+		}
+	}
+	for _, cp := range c.Packages {
+		pkg := byID[cp.ID]
+		pkg.Imports = make(map[string]*packages.Package)
+		for path, id := range cp.Imports {
+			pkg.Imports[path] = byID[id]
+		}
+	}
+
+	roots := make([]*packages.Package, len(c.Roots))
+	for i, id := range c.Roots {
+		roots[i] = byID[id]
+	}
+	return roots
+}
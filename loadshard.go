@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+var loadShards int
+
+func init() {
+	flag.IntVar(&loadShards, "load-shards", runtime.GOMAXPROCS(0), "split package loads into up to `n` concurrent go list runs (1 to load everything at once)")
+}
+
+// loadSharded loads the roots in up to loadShards concurrent loads,
+// and merges the results into one graph, as one load of them all would be.
+// ./... is split up by top-level directory first,
+// since it's usually most of the work.
+func loadSharded(cfg *packages.Config, roots []string, load func(*packages.Config, []string) ([]*packages.Package, error)) ([]*packages.Package, error) {
+	n := loadShards
+	if n > 1 {
+		roots = splitRoots(cfg.Dir, roots)
+	}
+	if n > len(roots) {
+		n = len(roots)
+	}
+	if n <= 1 {
+		return load(cfg, roots)
+	}
+
+	// hand the roots out round-robin, so the big directories spread out
+	shards := make([][]string, n)
+	for i, root := range roots {
+		shards[i%n] = append(shards[i%n], root)
+	}
+	slog.Debug("loading packages in shards", "dir", cfg.Dir, "shards", n, "roots", len(roots))
+	results := make([][]*packages.Package, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := *cfg
+			results[i], errs[i] = load(&c, shard)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return mergeLoads(results), nil
+}
+
+// mergeLoads merges the graphs of several loads, so each package is
+// a single *packages.Package that all its importers point to.
+// Roots loaded by more than one shard are only returned once.
+func mergeLoads(results [][]*packages.Package) []*packages.Package {
+	byID := make(map[string]*packages.Package)
+	for _, pkgs := range results {
+		packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+			if _, ok := byID[pkg.ID]; !ok {
+				byID[pkg.ID] = pkg
+			}
+		})
+	}
+	for _, pkg := range byID {
+		for path, imp := range pkg.Imports {
+			pkg.Imports[path] = byID[imp.ID]
+		}
+	}
+
+	var roots []*packages.Package
+	seen := make(map[string]bool)
+	for _, pkgs := range results {
+		for _, pkg := range pkgs {
+			if !seen[pkg.ID] {
+				seen[pkg.ID] = true
+				roots = append(roots, byID[pkg.ID])
+			}
+		}
+	}
+	return roots
+}
+
+// splitRoots replaces ./... in roots with the same packages
+// split up by top-level directory: the root package, if there is one,
+// and dir/... for each directory the wildcard would descend into.
+// Workspaces are left alone, since there ./... covers other modules
+// in the directory too.
+func splitRoots(dir string, roots []string) []string {
+	i := -1
+	for j, root := range roots {
+		if root == "./..." {
+			i = j
+		}
+	}
+	if i < 0 {
+		return roots
+	}
+	if dir == "" {
+		dir = "."
+	}
+	if out, err := goCmd("-C", dir, "env", "GOWORK"); err != nil {
+		return roots
+	} else if gowork := strings.TrimSpace(string(out)); gowork != "" && gowork != "off" {
+		return roots
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return roots
+	}
+
+	var split []string
+	hasGo := false
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			hasGo = hasGo || strings.HasSuffix(name, ".go")
+			continue
+		}
+		// the wildcard skips these, and nested modules are their own
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, name, "go.mod")); err == nil {
+			continue
+		}
+		split = append(split, "./"+name+"/...")
+	}
+	if hasGo {
+		split = append(split, ".")
+	}
+	if len(split) == 0 {
+		return roots
+	}
+	return append(append(append([]string(nil), roots[:i]...), split...), roots[i+1:]...)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// localExcludes returns the name patterns left out of a local replacement's
+// source: the configured ones, plus the .gitignore patterns that apply to
+// names anywhere below it, from the repository root down to the module.
+// Patterns that only match particular paths can't be expressed as a filter
+// on names, so they're not included.
+func (m *Module) localExcludes() ([]string, error) {
+	patterns := make(map[string]bool)
+	for _, p := range config.LocalExclude {
+		patterns[p] = true
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(root, m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	dir := "."
+	for _, elem := range append([]string{""}, strings.Split(filepath.ToSlash(rel), "/")...) {
+		dir = filepath.Join(dir, elem)
+		if err := readGitignore(filepath.Join(dir, ".gitignore"), patterns); err != nil {
+			return nil, err
+		}
+	}
+	return sortedKeys(patterns), nil
+}
+
+func readGitignore(name string, patterns map[string]bool) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.ContainsAny(line[:1], `#!\`) {
+			continue
+		}
+		line = strings.TrimSuffix(line, "/")
+		if strings.Contains(line, "/") || strings.Contains(line, "**") {
+			continue
+		}
+		if _, err := slashpath.Match(line, ""); err != nil {
+			continue
+		}
+		patterns[line] = true
+	}
+	return scanner.Err()
+}
+
+// excludeNames returns an excluder matching names against patterns.
+func excludeNames(patterns []string) excluder {
+	return func(rel string, isDir bool) bool {
+		name := slashpath.Base(rel)
+		for _, p := range patterns {
+			if ok, _ := slashpath.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NixFilter returns a builtins.path filter leaving out the same names
+// the module's hash leaves out, or nothing if there aren't any.
+func (m *Module) NixFilter() (string, error) {
+	patterns, err := m.localExcludes()
+	if err != nil || len(patterns) == 0 {
+		return "", err
+	}
+	alts := make([]string, len(patterns))
+	for i, p := range patterns {
+		alts[i] = globRegexp(p)
+	}
+	sort.Strings(alts)
+	return "path: type: builtins.match " + nixString("("+strings.Join(alts, "|")+")") + " (baseNameOf path) == null", nil
+}
+
+// globRegexp translates a path.Match pattern into a POSIX extended regexp,
+// which is what builtins.match speaks.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString("[" + glob[i+1:i+1+end] + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
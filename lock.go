@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+)
+
+var waitLock = flag.Bool("wait", false, "wait for a concurrent mud run to finish instead of failing")
+
+const lockFile = ".mud.lock"
+
+// errLocked is returned by openLock when another process holds the lock.
+var errLocked = errors.New("another mud run is in progress in this repository (use -wait to wait for it)")
+
+// lockRepo takes an advisory lock on the repository,
+// so concurrent runs can't interleave their writes.
+// The lock is held until unlock is called or the process exits.
+func lockRepo() (unlock func(), err error) {
+	f, err := openLock(false)
+	if errors.Is(err, errLocked) && *waitLock {
+		slog.Warn("waiting for another mud run to finish")
+		f, err = openLock(true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ERROR_SHARING_VIOLATION, which syscall doesn't name
+const errSharingViolation syscall.Errno = 32
+
+// openLock opens the lock file without sharing it,
+// which Windows enforces until the handle is closed or the process exits.
+func openLock(wait bool) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(lockFile)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			return os.NewFile(uintptr(h), lockFile), nil
+		}
+		if !errors.Is(err, errSharingViolation) {
+			return nil, &os.PathError{Op: "open", Path: lockFile, Err: err}
+		}
+		if !wait {
+			return nil, errLocked
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var (
+	verbose     = flag.Bool("v", false, "log progress")
+	veryVerbose = flag.Bool("vv", false, "log debugging detail")
+	logFormat   = flag.String("log-format", "text", "log output format (text or json)")
+	quiet       = flag.Bool("quiet", false, "only report errors")
+)
+
+// setupLogging installs the default slog logger on stderr
+// according to the verbosity and format flags.
+func setupLogging() error {
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	if *veryVerbose {
+		level = slog.LevelDebug
+	}
+	if *quiet {
+		level = slog.LevelError
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		// timestamps are noise for an interactive tool
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+		handler = slog.NewTextHandler(logWriter{}, opts)
+	case "json":
+		handler = slog.NewJSONHandler(logWriter{}, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+
+	if err := checkDiagnosticsFlag(); err != nil {
+		return err
+	}
+	if *diagnostics == "json" {
+		handler = &diagnosticHandler{next: handler}
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// logWriter writes log records to stderr,
+// clearing the progress line first so the two don't run together.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	if prog.enabled {
+		os.Stderr.WriteString("\r\033[K")
+	}
+	return os.Stderr.Write(p)
+}
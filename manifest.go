@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Manifest is what can be read back from an expression mud generated.
+type Manifest struct {
+	// Path is the module's import path
+	Path string
+	// SourcePath is the path the module is fetched as,
+	// which differs from Path for replaced modules
+	SourcePath string
+	Version    string
+	SHA256     string
+	// Fetcher is how the source is fetched, like Module.Fetcher
+	Fetcher string
+	// Exclude is the source filter, as space-separated Nix strings
+	Exclude string
+	// SubPackages are the packages built from the module, if listed
+	SubPackages []string
+}
+
+var (
+	manifestPathRe    = regexp.MustCompile(`(?m)^\s*path = "([^"]*)";`)
+	manifestVersionRe = regexp.MustCompile(`(?m)^\s*version = "([^"]*)";`)
+	manifestSHA256Re  = regexp.MustCompile(`(?m)^\s*(?:sha256|hash) = "([^"]*)";`)
+	manifestExcludeRe = regexp.MustCompile(`(?m)^\s*exclude = \[ (.*) \];`)
+	manifestSubPkgsRe = regexp.MustCompile(`(?s)\bsubPackages = \[(.*?)\];`)
+	manifestStringRe  = regexp.MustCompile(`"([^"]*)"`)
+	manifestFetcherRe = regexp.MustCompile(`\bpkgs\.(fetchgit|fetchFromGitHub) \{`)
+)
+
+// readManifest parses an expression previously generated by mud.
+// It returns nil if the file doesn't exist or wasn't generated.
+func readManifest(name string) (*Manifest, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data), nil
+}
+
+// parseManifest is readManifest on the contents of a file.
+func parseManifest(data []byte) *Manifest {
+	if !bytes.HasPrefix(data, []byte(generatedHeader)) {
+		return nil
+	}
+	return scanManifest(data)
+}
+
+// scanManifest reads what it can of a manifest from any expression,
+// generated or not, going by how mud lays them out.
+func scanManifest(data []byte) *Manifest {
+	m := &Manifest{}
+	paths := manifestPathRe.FindAllSubmatch(data, 2)
+	if len(paths) > 0 {
+		m.Path = string(paths[0][1])
+		m.SourcePath = m.Path
+	}
+	if len(paths) > 1 {
+		m.SourcePath = string(paths[1][1])
+	}
+	if match := manifestVersionRe.FindSubmatch(data); match != nil {
+		m.Version = string(match[1])
+	}
+	if match := manifestSHA256Re.FindSubmatch(data); match != nil {
+		m.SHA256 = string(match[1])
+	}
+	if match := manifestExcludeRe.FindSubmatch(data); match != nil {
+		m.Exclude = string(match[1])
+	}
+	if match := manifestSubPkgsRe.FindSubmatch(data); match != nil {
+		m.SubPackages = []string{}
+		for _, s := range manifestStringRe.FindAllSubmatch(match[1], -1) {
+			m.SubPackages = append(m.SubPackages, string(s[1]))
+		}
+	}
+	m.Fetcher = "proxy"
+	if match := manifestFetcherRe.FindSubmatch(data); match != nil {
+		m.Fetcher = map[string]string{"fetchgit": "git", "fetchFromGitHub": "github"}[string(match[1])]
+	}
+	return m
+}
+
+const nixBase32Chars = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// parseNixHash decodes a sha256 hash in any of the encodings Nix accepts:
+// SRI, Nix base32, or hex.
+func parseNixHash(s string) ([]byte, error) {
+	if b64, ok := strings.CutPrefix(s, "sha256-"); ok {
+		sum, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SRI hash %q", s)
+		}
+		return sum, nil
+	}
+
+	switch len(s) {
+	case hex.EncodedLen(sha256.Size):
+		return hex.DecodeString(s)
+	case (sha256.Size*8-1)/5 + 1:
+		// Nix base32 is little-endian, and starts with the last digit
+		sum := make([]byte, sha256.Size)
+		for k := 0; k < len(s); k++ {
+			digit := strings.IndexByte(nixBase32Chars, s[k])
+			if digit < 0 {
+				return nil, fmt.Errorf("invalid base32 hash %q", s)
+			}
+			b := uint(len(s)-1-k) * 5
+			i, j := b/8, b%8
+			sum[i] |= byte(digit << j)
+			if carry := byte(digit >> (8 - j)); i+1 < sha256.Size {
+				sum[i+1] |= carry
+			} else if carry != 0 {
+				return nil, fmt.Errorf("invalid base32 hash %q", s)
+			}
+		}
+		return sum, nil
+	}
+	return nil, fmt.Errorf("unrecognised hash %q", s)
+}
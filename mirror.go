@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// cmdMirror copies the module zips the expressions fetch, with their .info and .mod files,
+// into dir, laid out like a GOPROXY, so builders without network access
+// can fetch from it with GOPROXY=file://dir.
+// Modules missing from the module cache are downloaded first.
+// Mirroring into the same dir again adds to it.
+func cmdMirror(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mud mirror <dir>")
+	}
+	if readOnly() {
+		return errors.New("mud mirror writes the mirror, so it can't be a dry run")
+	}
+	dir := args[0]
+
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if err != nil {
+		return err
+	}
+
+	var paths []Path
+	for path := range modules {
+		paths = append(paths, path)
+	}
+	sortPaths(paths)
+	var mvs []module.Version
+	for _, path := range paths {
+		mod := modules[path]
+		if mod.IsExternal() && !mod.IsLocal() && !mod.IsVendored() && config.Selected(path) {
+			mvs = append(mvs, mod.ModuleVersion())
+		}
+	}
+	if len(mvs) == 0 {
+		slog.Info("no modules to mirror")
+		return nil
+	}
+
+	prog.Phase("downloading")
+	downloaded, err := goModDownload(mvs...)
+	if err != nil {
+		return err
+	}
+
+	prog.Phase("mirroring")
+	var errs []error
+	for i, d := range downloaded {
+		mv := module.Version{Path: d.Path, Version: d.Version}
+		prog.Step(i+1, len(downloaded), mv.String())
+		if d.Error != "" {
+			errs = append(errs, &moduleError{Kind: "download", Module: mv.String(), Err: explainAuth(errors.New(d.Error))})
+			continue
+		}
+		if err := mirrorModule(dir, mv, d); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", mv, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	slog.Info("mirrored modules", "dir", dir, "modules", len(downloaded))
+	return nil
+}
+
+// mirrorModule copies a module version's files from the module cache
+// into its @v dir in the mirror, and adds the version to its list.
+func mirrorModule(dir string, mv module.Version, d DownloadedModule) error {
+	path, err := module.EscapePath(mv.Path)
+	if err != nil {
+		return err
+	}
+	version, err := module.EscapeVersion(mv.Version)
+	if err != nil {
+		return err
+	}
+	vdir := filepath.Join(dir, filepath.FromSlash(path), "@v")
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		return err
+	}
+	for ext, src := range map[string]string{".info": d.Info, ".mod": d.GoMod, ".zip": d.Zip} {
+		if src == "" {
+			return fmt.Errorf("the module cache has no %s file", ext)
+		}
+		if err := copyFile(src, filepath.Join(vdir, version+ext)); err != nil {
+			return err
+		}
+	}
+
+	list := filepath.Join(vdir, "list")
+	data, err := os.ReadFile(list)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	versions := strings.Fields(string(data))
+	if slices.Contains(versions, mv.Version) {
+		return nil
+	}
+	versions = append(versions, mv.Version)
+	return os.WriteFile(list, []byte(strings.Join(versions, "\n")+"\n"), 0644)
+}
+
+// copyFile copies src to dst, unless dst is already the same size:
+// everything in the module cache is immutable.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if out, err := os.Stat(dst); err == nil && out.Size() == fi.Size() {
+		return nil
+	}
+
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
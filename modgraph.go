@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// moduleEdge is a requirement in the module graph.
+type moduleEdge struct {
+	From, To Path
+}
+
+// graphEdge is a line of go mod graph: a module version requiring another.
+// FromVersion is empty for the main module.
+type graphEdge struct {
+	From, FromVersion, To, ToVersion string
+}
+
+// moduleGraph runs go mod graph for the module in dir,
+// and returns its requirements, leaving out go and toolchain lines,
+// along with the version MVS selects of each module.
+func moduleGraph(dir string) ([]graphEdge, map[string]string, error) {
+	out, err := goCmd("-C", dir, "mod", "graph")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var edges []graphEdge
+	selected := make(map[string]string)
+	sel := func(path, version string) {
+		if semver.Compare(version, selected[path]) > 0 {
+			selected[path] = version
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		from, to, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		fromPath, fromVersion, _ := strings.Cut(from, "@")
+		if fromPath == "go" || fromPath == "toolchain" {
+			continue
+		}
+		toPath, toVersion, ok := strings.Cut(to, "@")
+		if !ok || toPath == "go" || toPath == "toolchain" {
+			continue
+		}
+		if fromVersion != "" {
+			sel(fromPath, fromVersion)
+		}
+		sel(toPath, toVersion)
+		edges = append(edges, graphEdge{fromPath, fromVersion, toPath, toVersion})
+	}
+	return edges, selected, scanner.Err()
+}
+
+// readModuleGraph returns the requirements of the versions MVS selects
+// in the module in dir.
+// Requirements of versions that lost out don't count,
+// and neither do those of the main module, whose imports are all walked.
+func readModuleGraph(dir string) ([]moduleEdge, error) {
+	edges, selected, err := moduleGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+	var reqs []moduleEdge
+	for _, e := range edges {
+		if e.FromVersion != "" && selected[e.From] == e.FromVersion {
+			reqs = append(reqs, moduleEdge{Path(e.From), Path(e.To)})
+		}
+	}
+	return reqs, nil
+}
+
+// selectedVersion returns the version of path MVS selects in the module in dir,
+// and what requires that version: "go.mod" for the module itself,
+// or the module versions that do.
+func selectedVersion(dir string, path Path) (string, []string, error) {
+	edges, selected, err := moduleGraph(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	version := selected[string(path)]
+	var by []string
+	for _, e := range edges {
+		if e.To != string(path) || e.ToVersion != version {
+			continue
+		}
+		if e.FromVersion == "" {
+			by = append(by, "go.mod")
+		} else {
+			by = append(by, e.From+"@"+e.FromVersion)
+		}
+	}
+	return version, by, nil
+}
+
+// addModuleGraph adds the requirements of the module graph to modules:
+// a module requiring another gets everything used from it as dependencies,
+// whether or not the packages walked import any of it.
+// That covers imports behind build tags or platforms the walk didn't load.
+// Required modules that nothing uses at all have no packages to build,
+// so they stay out of the graph.
+// Requirements that would make expressions depend on each other are left out.
+func addModuleGraph(modules map[Path]*Module, dirs []string) error {
+	var added int
+	unused := make(map[Path]bool)
+	for _, dir := range dirs {
+		edges, err := readModuleGraph(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range edges {
+			from, to := modules[e.From], modules[e.To]
+			if to == nil {
+				unused[e.To] = true
+				continue
+			}
+			if from == nil || from == to || !from.IsExternal() {
+				continue
+			}
+			if _, ok := from.Deps[to]; !ok && dependsOn(to, from) {
+				// modules can require each other, but expressions can't
+				slog.Debug("not adding requirement, it would be a cycle", "module", from.Path, "requires", to.Path)
+				continue
+			}
+			deps := from.Dep(to)
+			for pkg := range to.Packages {
+				if _, ok := deps[pkg]; !ok {
+					deps.Add(pkg)
+					added++
+				}
+			}
+		}
+	}
+	slog.Debug("added module graph requirements", "imports", added, "unused", len(unused))
+	return nil
+}
+
+// dependsOn reports whether m depends on dep, directly or not.
+func dependsOn(m, dep *Module) bool {
+	seen := make(map[*Module]bool)
+	var visit func(*Module) bool
+	visit = func(m *Module) bool {
+		if m == dep {
+			return true
+		}
+		if seen[m] {
+			return false
+		}
+		seen[m] = true
+		for d := range m.Deps {
+			if visit(d) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(m)
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mutable/archive"
+	"github.com/mutable/base32"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+var nixIdentRe = regexp.MustCompile(`^[a-zA-Z\_][a-zA-Z0-9\_\'\-]*$`)
+var nixKeyword = map[string]bool{
+	"if":      true,
+	"then":    true,
+	"else":    true,
+	"assert":  true,
+	"with":    true,
+	"let":     true,
+	"in":      true,
+	"rec":     true,
+	"inherit": true,
+	"or":      true,
+}
+
+// gopkgsDir is where expressions for external modules go:
+// the output dir setting, with forward slashes, set by loadConfig.
+var gopkgsDir = defaultConfig.OutputDir
+
+// gopkgsAttr splits the attr path of the gopkgs dir under platform
+// the way expressions refer to it: with platform.third_party; [ gopkgs.foo ].
+func gopkgsAttr() (scope, name string) {
+	name = slashpath.Base(gopkgsDir)
+	if !nixIdentRe.MatchString(name) || nixKeyword[name] {
+		name = nixString(name)
+	}
+	return repoAttr(slashpath.Dir(gopkgsDir)), name
+}
+
+type Path string
+
+func (p Path) NixAttr() string {
+	return strings.Join(p.nixAttrNames(), ".")
+}
+
+// nixAttrNames returns the elements of the path as Nix attr names,
+// starting with the attr path of its module if it's aliased (see Config.Attrs),
+// renamed where they'd collide (see attrRenames) and quoted where necessary.
+func (p Path) nixAttrNames() []string {
+	elems := strings.Split(string(p), "/")
+	var names []string
+	start := 0
+	if alias, n := p.alias(); alias != "" {
+		names = strings.Split(alias, ".")
+		start = n
+	}
+	for i := start; i < len(elems); i++ {
+		name := elems[i]
+		if renamed, ok := attrRenames[Path(strings.Join(elems[:i+1], "/"))]; ok {
+			name = renamed
+		}
+		if !nixIdentRe.MatchString(name) || nixKeyword[name] {
+			name = nixString(name)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// alias returns the configured attr path of the longest aliased module path
+// the path is in, and how many of the path's elements it stands for.
+func (p Path) alias() (string, int) {
+	elems := strings.Split(string(p), "/")
+	for n := len(elems); n > 0; n-- {
+		if attr, ok := config.Attrs[strings.Join(elems[:n], "/")]; ok {
+			return attr, n
+		}
+	}
+	return "", 0
+}
+
+// unalias turns attr names back into the path they're for,
+// undoing the longest alias they start with.
+func unalias(names []string) Path {
+	for n := len(names); n > 0; n-- {
+		attr := strings.Join(names[:n], ".")
+		for path, alias := range config.Attrs {
+			if alias == attr {
+				return Path(strings.Join(append([]string{path}, names[n:]...), "/"))
+			}
+		}
+	}
+	return Path(strings.Join(names, "/"))
+}
+
+type Module struct {
+	Path    Path
+	Version string
+	Dir     string
+	// If not empty, the path that this module's source is located at,
+	// either in the repo or as another module
+	ReplacePath string
+	// Deps maps modules we depend on to the exact packages
+	// from that module we depend on
+	Deps map[*Module]PackageSet
+	// Packages is the set of packages from this module that are used
+	Packages PackageSet
+	// Builds is the set of named builds that use this module
+	Builds map[string]bool
+	// Pkgs holds details of the packages in Packages
+	Pkgs map[Path]*Package
+
+	narHash []byte
+	// hashReused is set if narHash was taken from the existing manifest
+	hashReused bool
+	// gitSrc caches GitSource
+	gitSrc *GitSource
+	// goDirs caches goDirectives
+	goDirs *goDirectives
+	// meta is set by fetchMetadata
+	meta *ModuleMeta
+	// sum is the module's h1: hash from go.sum, set by generate
+	sum string
+	// origin is set by resolveOrigins
+	origin *moduleOrigin
+	// importers are the modules importing this one directly, set by generate
+	importers []Path
+	// requiredBy are the first-party packages importing this module directly,
+	// set by generate with RequiredBy
+	requiredBy []Path
+	// usedBy are the repository module dirs whose loads use this module, set by loadModules
+	usedBy map[string]bool
+}
+
+// Sum returns the module's h1: hash from go.sum, if it has one.
+func (m *Module) Sum() string {
+	return m.sum
+}
+
+// goDirectives returns the go and toolchain directives of the module's go.mod.
+// For modules from the module cache, that's the .mod file next to the zip,
+// which the go command synthesises for modules without a go.mod.
+func (m *Module) goDirectives() (*goDirectives, error) {
+	if m.goDirs != nil {
+		return m.goDirs, nil
+	}
+
+	var names []string
+	if !m.IsLocal() {
+		name, err := downloadPath(m.ModuleVersion(), ".mod")
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if m.Dir != "" {
+		names = append(names, filepath.Join(m.Dir, "go.mod"))
+	}
+
+	m.goDirs = &goDirectives{}
+	for _, name := range names {
+		d, err := readGoDirectives(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.goDirs = d
+		break
+	}
+	return m.goDirs, nil
+}
+
+// GoVersion returns the go directive of the module's go.mod, if any.
+func (m *Module) GoVersion() (string, error) {
+	d, err := m.goDirectives()
+	if err != nil {
+		return "", err
+	}
+	return d.Go, nil
+}
+
+// Toolchain returns the toolchain directive of the module's go.mod, if any.
+func (m *Module) Toolchain() (string, error) {
+	d, err := m.goDirectives()
+	if err != nil {
+		return "", err
+	}
+	return d.Toolchain, nil
+}
+
+func (m *Module) Imports() []Path {
+	var imports []Path
+	for _, dep := range m.Deps {
+		for pkg := range dep {
+			imports = append(imports, pkg)
+		}
+	}
+	sortPaths(imports)
+	return imports
+}
+
+// Name returns a short name for the module: the last element of its path,
+// plus the major version if the path has one.
+func (m *Module) Name() string {
+	base, _, _ := module.SplitPathVersion(string(m.Path))
+	name := slashpath.Base(base)
+	if major := m.MajorVersion(); major != "" {
+		name += "-" + major
+	}
+	return name
+}
+
+// MajorVersion returns the major version suffix of the module path,
+// such as "v2" for example.com/foo/v2 or gopkg.in/foo.v2,
+// or "" if the path has none.
+func (m *Module) MajorVersion() string {
+	_, major, _ := module.SplitPathVersion(string(m.Path))
+	return strings.TrimLeft(major, "./")
+}
+
+// CheckMajor verifies that the version we're fetching
+// agrees with the major version its module path declares.
+func (m *Module) CheckMajor() error {
+	mv := m.ModuleVersion()
+	_, major, ok := module.SplitPathVersion(mv.Path)
+	if !ok {
+		return fmt.Errorf("%s: invalid module path", mv.Path)
+	}
+	if err := module.CheckPathMajor(mv.Version, major); err != nil {
+		return &moduleError{Kind: "major", Module: string(m.Path), Err: err}
+	}
+	return nil
+}
+
+// BuildNames lists the named builds that use this module.
+func (m *Module) BuildNames() []string {
+	return sortedKeys(m.Builds)
+}
+
+func (m *Module) PackageList() []Path {
+	return m.Packages.Sorted()
+}
+
+// SubPackages lists the packages used from this module,
+// relative to the module root.
+func (m *Module) SubPackages() []string {
+	var subs []string
+	for _, pkg := range m.Packages.Sorted() {
+		sub, ok := strings.CutPrefix(string(pkg), string(m.Path))
+		if !ok || sub != "" && sub[0] != '/' {
+			continue
+		}
+		if sub == "" {
+			sub = "."
+		} else {
+			sub = sub[1:]
+		}
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// RootSrcs lists the non-test Go files in the module's root directory.
+func (m *Module) RootSrcs() ([]string, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
+			srcs = append(srcs, name)
+		}
+	}
+	return srcs, nil
+}
+
+// DepModules lists the modules this module depends on.
+func (m *Module) DepModules() []*Module {
+	deps := make([]*Module, 0, len(m.Deps))
+	for dep := range m.Deps {
+		deps = append(deps, dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Path < deps[j].Path })
+	return deps
+}
+
+// ModuleDep is a module depended on, and the packages used from it.
+type ModuleDep struct {
+	Module   *Module
+	Packages []Path
+}
+
+// DepList lists the modules this module depends on with the packages it uses,
+// in a stable order, unlike ranging over Deps.
+func (m *Module) DepList() []ModuleDep {
+	var deps []ModuleDep
+	for _, dep := range m.DepModules() {
+		deps = append(deps, ModuleDep{Module: dep, Packages: m.Deps[dep].Sorted()})
+	}
+	return deps
+}
+
+// Importers lists the modules importing this one directly.
+func (m *Module) Importers() []Path {
+	return m.importers
+}
+
+// RequiredBy lists the first-party packages importing this module directly,
+// if the RequiredBy setting is on.
+func (m *Module) RequiredBy() []Path {
+	return m.requiredBy
+}
+
+func (m *Module) Dep(d *Module) PackageSet {
+	pkgs := m.Deps[d]
+	if pkgs == nil {
+		pkgs = make(PackageSet)
+		m.Deps[d] = pkgs
+	}
+	return pkgs
+}
+
+// ModSHA256 returns the NAR hash of the module's source,
+// in the encoding selected by the hash format setting,
+// or nothing if the module's go.sum hash stands in for it.
+func (m *Module) ModSHA256() (string, error) {
+	if m.hashedBySum() {
+		return "", nil
+	}
+	if config.HashFormat == "sri" {
+		return m.ModSRI()
+	}
+	sum, err := m.NARHash()
+	if err != nil {
+		return "", err
+	}
+	return base32.Encode(sum), nil
+}
+
+// ModSRI returns the NAR hash of the module's source as an SRI string,
+// or nothing if the module's go.sum hash stands in for it.
+func (m *Module) ModSRI() (string, error) {
+	if m.hashedBySum() {
+		return "", nil
+	}
+	sum, err := m.NARHash()
+	if err != nil {
+		return "", err
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// hashedBySum reports whether the module's expression is checked
+// by its go.sum hash alone, with the gosum hash source.
+// Modules fetched from git can't be, and nor can those without a go.sum entry.
+func (m *Module) hashedBySum() bool {
+	return config.HashSource == "gosum" && !m.IsLocal() && m.Fetcher() == "proxy" && m.sum != ""
+}
+
+func (m *Module) NARHash() ([]byte, error) {
+	if m.narHash != nil {
+		return m.narHash, nil
+	}
+
+	if src := m.gitSrc; src != nil || m.Fetcher() != "proxy" {
+		if src == nil {
+			// GitSource hashes it once it knows where it comes from
+			_, err := m.GitSource()
+			return m.narHash, err
+		}
+		sum, err := src.prefetch()
+		if err != nil {
+			return nil, &moduleError{Kind: "fetch", Module: string(m.Path), Err: err}
+		}
+		m.narHash = sum
+		return m.narHash, nil
+	}
+
+	if config.HashSource == "zip" && !m.IsLocal() {
+		mv := m.ModuleVersion()
+		zipPath, err := downloadPath(mv, ".zip")
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("hashing module zip", "module", m.Path, "zip", zipPath)
+		sum, err := narHashZip(zipPath, mv.Path+"@"+mv.Version+"/", excludePaths(m.sourceExcludes()))
+		if err != nil {
+			return nil, err
+		}
+		m.narHash = sum
+		return m.narHash, nil
+	}
+
+	if m.Dir == "" {
+		return nil, &notCachedError{Module: m.ModuleVersion().String()}
+	}
+
+	if m.IsLocal() {
+		// local directories pick up build outputs and editor droppings,
+		// which the expression filters out, so the hash has to as well
+		patterns, err := m.localExcludes()
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("hashing local module dir", "module", m.Path, "dir", m.Dir, "exclude", patterns)
+		if m.narHash, err = narHashDir(m.Dir, excludeNames(patterns)); err != nil {
+			return nil, err
+		}
+		return m.narHash, nil
+	}
+
+	if excludes := m.sourceExcludes(); len(excludes) > 0 {
+		slog.Debug("hashing filtered module dir", "module", m.Path, "dir", m.Dir, "exclude", excludes)
+		var err error
+		if m.narHash, err = narHashDir(m.Dir, excludePaths(excludes)); err != nil {
+			return nil, err
+		}
+		return m.narHash, nil
+	}
+
+	slog.Debug("hashing module dir", "module", m.Path, "dir", m.Dir)
+	h := sha256.New()
+	if err := archive.CopyPath(archive.WriteDump(h), m.Dir); err != nil {
+		return nil, err
+	}
+
+	m.narHash = h.Sum(nil)
+	return m.narHash, nil
+}
+
+// reuseHash takes the module's hash from its existing manifest,
+// if that was generated for the same source and version.
+func (m *Module) reuseHash() error {
+	man, err := readManifest(filepath.Join(m.OutDir(), "default.nix"))
+	if err == nil && man == nil && m.legacyOutDir() != m.OutDir() {
+		// it's moving with -escape-dirs, but the hash is still good
+		man, err = readManifest(filepath.Join(m.legacyOutDir(), "default.nix"))
+	}
+	if err != nil || man == nil {
+		return err
+	}
+	if man.Version != m.Version || man.SourcePath != m.ModuleVersion().Path || man.Fetcher != m.Fetcher() || man.Exclude != strings.Join(m.SourceExcludes(), " ") || man.SHA256 == "" {
+		return nil
+	}
+
+	sum, err := parseNixHash(man.SHA256)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.OutDir(), err)
+	}
+	m.narHash = sum
+	m.hashReused = true
+	return nil
+}
+
+// describe says which version of the module is used,
+// for messages.
+func (m *Module) describe() string {
+	return describeVersion(m.Version, m.ReplacePath)
+}
+
+func describeVersion(version, replace string) string {
+	if replace == "" {
+		return "v" + version
+	}
+	if version == "" {
+		return replace
+	}
+	return replace + " v" + version
+}
+
+// ModuleVersion returns the module version the source is fetched as,
+// which is the replacement if there is one.
+func (m *Module) ModuleVersion() module.Version {
+	path := string(m.Path)
+	if m.ReplacePath != "" {
+		path = m.ReplacePath
+	}
+	return module.Version{Path: path, Version: "v" + m.Version}
+}
+
+// VerifySum checks the module cache against the h1: hash recorded in go.sum,
+// like go mod verify: the download cache's .ziphash, the zip itself
+// if that's what gets hashed, and otherwise the extracted dir,
+// so a corrupt or locally modified cache doesn't end up in a hash
+// nobody else can reproduce.
+func (m *Module) VerifySum(sums GoSum) error {
+	if m.Dir == "" && config.HashSource != "zip" {
+		return &notCachedError{Module: m.ModuleVersion().String()}
+	}
+
+	mv := m.ModuleVersion()
+	want, ok := sums[mv]
+	if !ok {
+		return &moduleError{Kind: "sum", Module: mv.String(), Err: errors.New("missing go.sum entry"), Hint: "run `go mod tidy` to add it"}
+	}
+	corrupt := func(what, got string) error {
+		return &moduleError{Kind: "sum", Module: mv.String(), Err: fmt.Errorf("module cache %s has %s, go.sum has %s", what, got, want),
+			Hint: "if go.sum is right, the module cache is corrupt: run `go clean -modcache` and try again"}
+	}
+
+	// the go command records the zip's hash when it downloads it;
+	// old caches might not have it
+	if name, err := downloadPath(mv, ".ziphash"); err == nil {
+		if data, err := os.ReadFile(name); err == nil {
+			if got := strings.TrimSpace(string(data)); got != want {
+				return corrupt("zip hash", got)
+			}
+		}
+	}
+
+	if config.HashSource == "zip" {
+		name, err := downloadPath(mv, ".zip")
+		if err != nil {
+			return err
+		}
+		got, err := dirhash.HashZip(name, dirhash.Hash1)
+		if os.IsNotExist(err) {
+			return &notCachedError{Module: mv.String()}
+		}
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return corrupt("zip", got)
+		}
+		return nil
+	}
+
+	got, err := dirhash.HashDir(m.Dir, mv.Path+"@"+mv.Version, dirhash.Hash1)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return corrupt("dir", got)
+	}
+	return nil
+}
+
+// isMissing reports whether the source we're going to hash
+// is absent from the module cache.
+func (m *Module) isMissing() bool {
+	if config.HashSource == "zip" {
+		zipPath, err := downloadPath(m.ModuleVersion(), ".zip")
+		if err != nil {
+			return true
+		}
+		_, err = os.Stat(zipPath)
+		return err != nil
+	}
+	return m.Dir == ""
+}
+
+// OutDir returns the directory the module's expression is written to.
+func (m *Module) OutDir() string {
+	return slashpath.Join(gopkgsDir, m.Path.dirName())
+}
+
+// legacyOutDir is OutDir without -escape-dirs,
+// where expressions are until they're moved.
+func (m *Module) legacyOutDir() string {
+	return slashpath.Join(gopkgsDir, string(m.Path))
+}
+
+// dirName is the path of the module's directory under gopkgsDir.
+// With -escape-dirs, capitals are escaped like in the module cache,
+// so paths differing only in case don't collide on case-insensitive filesystems.
+func (p Path) dirName() string {
+	if config.EscapeDirs {
+		if escaped, err := module.EscapePath(string(p)); err == nil {
+			return escaped
+		}
+	}
+	return string(p)
+}
+
+// dirPath turns the path of a directory under gopkgsDir back into a module path.
+func dirPath(dir string) Path {
+	if path, err := module.UnescapePath(dir); err == nil {
+		return Path(path)
+	}
+	return Path(dir)
+}
+
+// LocalSrc returns the directory a local replacement points at
+// as a Nix path relative to the module's output dir.
+func (m *Module) LocalSrc() (string, error) {
+	return m.LocalSrcFrom(m.OutDir())
+}
+
+// IndexSrc returns the directory a local replacement points at
+// as a Nix path relative to the gopkgs dir.
+func (m *Module) IndexSrc() (string, error) {
+	return m.LocalSrcFrom(gopkgsDir)
+}
+
+// LocalSrcFrom returns the directory a local replacement points at
+// as a Nix path relative to dir.
+func (m *Module) LocalSrcFrom(dir string) (string, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, m.Dir)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: replacement %s is outside the repository", m.Path, m.ReplacePath)
+	}
+
+	src, err := filepath.Rel(dir, rel)
+	if err != nil {
+		return "", err
+	}
+	src = filepath.ToSlash(src)
+	if !strings.HasPrefix(src, "../") {
+		src = "./" + src
+	}
+	return src, nil
+}
+
+// IsVendored reports whether the module is replaced by its own output dir,
+// which means it's vendored into the repository.
+func (m *Module) IsVendored() bool {
+	return m.ReplacePath == "./"+m.OutDir() || m.ReplacePath == "./"+m.legacyOutDir()
+}
+
+// IsLocal reports whether the module is replaced by a directory on disk.
+func (m *Module) IsLocal() bool {
+	return m.ReplacePath != "" && modfile.IsDirectoryPath(m.ReplacePath)
+}
+
+func (m *Module) IsExternal() bool {
+	return !strings.HasPrefix(string(m.Path), "example.com/")
+}
+
+// Package is a package used from a module.
+type Package struct {
+	Path   Path
+	Name   string
+	Module *Module
+	// GoFiles are the absolute paths of the package's non-test Go files,
+	// if they were loaded
+	GoFiles []string
+	// Imports are the non-builtin packages this package imports
+	Imports PackageSet
+}
+
+// Dir returns the directory containing the package's files.
+func (p *Package) Dir() string {
+	if len(p.GoFiles) == 0 {
+		return ""
+	}
+	return filepath.Dir(p.GoFiles[0])
+}
+
+type PackageSet map[Path]struct{}
+
+func (s PackageSet) Add(p Path) {
+	s[p] = struct{}{}
+}
+
+func (s PackageSet) Sorted() []Path {
+	paths := make([]Path, 0, len(s))
+	for p := range s {
+		paths = append(paths, p)
+	}
+	sortPaths(paths)
+	return paths
+}
+
+func sortPaths(xs []Path) {
+	sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] })
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,320 +1,249 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
 	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
-	slashpath "path"
-	"path/filepath"
-	"regexp"
 	"sort"
 	"strings"
-	"text/template"
+	"time"
 
-	"github.com/mutable/archive"
-	"github.com/mutable/base32"
-	"github.com/mutable/tempfile"
-	"go.uber.org/multierr"
-	"golang.org/x/tools/go/packages"
+	"golang.org/x/mod/module"
 )
 
-var tmpl = template.Must(template.New("external").Parse(`
-# generator //tools/mud (DO NOT EDIT)
-{ platform, pkgs, ... }:
-
-platform.buildGo.external rec {
-  path = "{{.Path}}";
-  src = platform.lib.fetchGoModule {
-    inherit path;
-    version = "{{.Version}}";
-    sha256 = "{{.ModSHA256}}";
-  };
-{{- with .Imports}}
-  deps = with platform.third_party; [
-{{- range .}}
-    gopkgs.{{.NixAttr}}
-{{- end}}
-  ];
-{{- end}}
-}
-`[1:]))
-
 func main() {
-	if len(os.Args) > 1 {
-		fmt.Fprintln(os.Stderr, "mud takes no arguments")
-		os.Exit(1)
+	flag.Usage = usage
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
 	}
 
-	if _, err := os.Stat(".git"); os.IsNotExist(err) {
-		fmt.Fprintln(os.Stderr, "mud must be run from the repository root")
-		os.Exit(1)
+	stopProfiling, err := startProfiling()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
 	}
-
-	roots := []string{"./..."}
-	{
-		pkgs, err := packages.Load(&packages.Config{
-			Mode: 0 |
-				packages.NeedName |
-				packages.NeedImports,
-			BuildFlags: []string{"-tags", "tools"},
-		}, "./tools")
-		if err != nil {
-			panic(err)
-		}
-		for _, pkg := range pkgs {
-			for dep := range pkg.Imports {
-				roots = append(roots, dep)
-			}
-		}
+	start := time.Now()
+	err = run()
+	if *timings {
+		prog.printTimings(time.Since(start))
+	}
+	if perr := stopProfiling(); err == nil {
+		err = perr
 	}
-
-	pkgs, err := packages.Load(&packages.Config{
-		Mode: 0 |
-			packages.NeedName |
-			packages.NeedDeps |
-			packages.NeedImports |
-			packages.NeedModule,
-		Tests: true,
-	}, roots...)
-
 	if err != nil {
-		panic(err)
+		reportError(err)
+		os.Exit(exitError)
 	}
-
-	// for each module, figure out what dependencies it has
-	// NOTE: these aren't necessarily *complete* dependencies,
-	// since we are just walking the packages we're transitively using,
-	// rather than $MODULE/...
-
-	modules := make(map[Path]*Module)
-	packages.Visit(pkgs,
-		func(pkg *packages.Package) bool {
-			return !isBuiltin(pkg)
-		},
-		func(pkg *packages.Package) {
-			if isBuiltin(pkg) {
-				return
-			}
-
-			if err := pkgErrors(pkg); err != nil {
-				panic(err)
-			}
-
-			if pkg.Module == nil {
-				if pkg.Name == "main" && strings.HasSuffix(pkg.PkgPath, ".test") {
-					return // test packages show up twice, once without pkg.Module set
-				}
-				if strings.HasSuffix(pkg.PkgPath, "_test") {
-					// _test packages don't have pkg.Module set
-					// their main package ends in .test instead
-					return
-				}
-				panic(fmt.Errorf("package without a module: %s", pkg.PkgPath))
-			}
-
-			mod := modules[Path(pkg.Module.Path)]
-			if mod == nil {
-				mod = &Module{
-					Path:    Path(pkg.Module.Path),
-					Version: pkg.Module.Version,
-					Dir:     pkg.Module.Dir,
-					Deps:    make(map[*Module]PackageSet),
-				}
-
-				if pkg.Module.Replace != nil {
-					mod.ReplacePath = pkg.Module.Replace.Path
-					mod.Version = pkg.Module.Replace.Version
-				}
-
-				mod.Version = strings.TrimPrefix(mod.Version, "v")
-				modules[mod.Path] = mod
-			}
-
-			for _, dep := range pkg.Imports {
-				if isBuiltin(dep) {
-					continue
-				}
-
-				depMod := modules[Path(dep.Module.Path)]
-				if depMod.Path == mod.Path {
-					continue // ignore intra-module dependencies
-				}
-
-				depSet := mod.Dep(depMod)
-				depSet.Add(Path(dep.PkgPath))
-			}
-		},
-	)
-
-	var paths []Path
-	for path := range modules {
-		paths = append(paths, path)
+	if len(changes) > 0 {
+		os.Exit(exitChanged)
 	}
-	sortPaths(paths)
-
-	var buffer bytes.Buffer
-	for _, path := range paths {
-		mod := modules[path]
+}
 
-		if !mod.IsExternal() {
-			continue
-		}
+// Exit codes, so scripts can tell what a run did without parsing its output.
+// A dry run exits with exitChanged if it would have changed anything.
+const (
+	exitUnchanged = 0
+	exitChanged   = 1
+	exitError     = 2
+)
 
-		buffer.Reset()
-		outDir := slashpath.Join("third_party/gopkgs", string(mod.Path))
-		if mod.ReplacePath != "" && mod.ReplacePath[0] == '.' {
-			if mod.ReplacePath != "./"+outDir {
-				fmt.Fprintf(os.Stderr, "replace points at //%v, expected it to point at //%v\n", mod.ReplacePath, outDir)
-				os.Exit(1)
-			}
+// commands are mud's subcommands.
+// Without one, mud regenerates everything.
+var commands = map[string]func(args []string) error{
+	"add":          cmdAdd,
+	"adopt":        cmdAdopt,
+	"cache":        cmdCache,
+	"check":        cmdCheck,
+	"doctor":       cmdDoctor,
+	"drift":        cmdDrift,
+	"explain-hash": cmdExplainHash,
+	"hold":         cmdHold,
+	"import":       cmdImport,
+	"mirror":       cmdMirror,
+	"outdated":     cmdOutdated,
+	"refs":         cmdRefs,
+	"serve":        cmdServe,
+	"stats":        cmdStats,
+	"tidy":         cmdTidy,
+	"unused":       cmdUnused,
+	"update":       cmdUpdate,
+	"vendorhash":   cmdVendorHash,
+}
 
-			// vendored packages don't use buildGo.external,
-			// so we don't generate a manifest for them.
-			// they are expected to have their own buildGo expressions,
-			// like any other in-tree code.
-			continue
-		}
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		if err := tmpl.Execute(&buffer, mod); err != nil {
-			panic(err)
-		}
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: mud [flags] [command [args]]\n\ncommands: %s\n\nflags:\n", strings.Join(names, ", "))
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nexit status: %d if nothing changed, %d if files changed, %d on errors\n", exitUnchanged, exitChanged, exitError)
+}
 
-		if err := writeFile(outDir, "default.nix", buffer.Bytes()); err != nil {
-			panic(err)
+func run() error {
+	cmd := cmdGenerate
+	var args []string
+	if flag.NArg() > 0 {
+		c, ok := commands[flag.Arg(0)]
+		if !ok {
+			return fmt.Errorf("unknown command %q", flag.Arg(0))
 		}
+		cmd, args = c, flag.Args()[1:]
 	}
-}
-
-func writeFile(dir, name string, data []byte) error {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+	// doctor checks what the rest of this needs, so it can't need it
+	if flag.Arg(0) == "doctor" {
+		return cmd(args)
 	}
 
-	f, err := tempfile.Open(dir, name+".tmp", 0644)
-	if err != nil {
+	if err := enterRoot(); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	if _, err := f.Write(data); err != nil {
+	if err := loadConfig(); err != nil {
 		return err
 	}
 
-	// TODO(edef): this ought to use unix.Unlink,
-	// but that's a bit more caution and effort than a non-library function warrants
-	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+	if err := checkStdoutFlags(); err != nil {
 		return err
 	}
-
-	if err := tempfile.Commit(f); err != nil {
-		return err
+	// serve writes nothing, and runs for as long as it's wanted,
+	// so it mustn't keep other runs out
+	if !readOnly() && !*watch && flag.Arg(0) != "serve" {
+		unlock, err := lockRepo()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		sweepTempFiles()
 	}
+	defer handleSignals()()
 
-	return os.Rename(f.Name(), filepath.Join(dir, name))
-}
+	startProgress()
+	defer prog.Done()
 
-func pkgErrors(pkg *packages.Package) error {
-	var errs error
-	for _, err := range pkg.Errors {
-		multierr.AppendInto(&errs, err)
-	}
-	if pkg.Module != nil && pkg.Module.Error != nil {
-		multierr.AppendInto(&errs, errors.New(pkg.Module.Error.Err))
-	}
-	return errs
+	return cmd(args)
 }
 
-func isBuiltin(pkg *packages.Package) bool {
-	importPath := pkg.PkgPath
-	i := strings.IndexByte(importPath, '/')
-	if i != -1 {
-		importPath = importPath[:i]
+func cmdGenerate(args []string) error {
+	if len(args) > 0 {
+		return errors.New("mud takes no arguments")
 	}
-	return strings.IndexByte(importPath, '.') == -1
+	if *watch {
+		return watchLoop()
+	}
+	return regenerate()
 }
 
-var nixIdentRe = regexp.MustCompile(`^[a-zA-Z\_][a-zA-Z0-9\_\'\-]*$`)
-var nixKeyword = map[string]bool{
-	"if":      true,
-	"then":    true,
-	"else":    true,
-	"assert":  true,
-	"with":    true,
-	"let":     true,
-	"in":      true,
-	"rec":     true,
-	"inherit": true,
-	"or":      true,
+// regenerate loads the graph and writes out everything generated from it.
+func regenerate() error {
+	return regenerateWith(nil)
 }
 
-type Path string
-
-func (p Path) NixAttr() string {
-	names := strings.Split(string(p), "/")
-	for i, name := range names {
-		if !nixIdentRe.MatchString(name) || nixKeyword[name] {
-			names[i] = fmt.Sprintf("%q", name)
+// regenerateWith is regenerate, with extra work done on the loaded graph
+// before anything is written.
+func regenerateWith(extra func(modules map[Path]*Module) error) error {
+	var fp string
+	if config.Incremental {
+		var err error
+		if fp, err = fingerprint(); err != nil {
+			return err
+		}
+		state, err := readState()
+		if err != nil {
+			return err
+		}
+		if extra == nil && !*toStdout && !*rehash && state.upToDate(fp) {
+			slog.Info("nothing changed since the last run")
+			return nil
+		}
+		if state != nil {
+			reuseHashes = true
+			previousSums = make(GoSum)
+			for key, sum := range state.Sums {
+				path, version, _ := strings.Cut(key, "@")
+				previousSums[module.Version{Path: path, Version: version}] = sum
+			}
 		}
 	}
-	return strings.Join(names, ".")
-}
 
-type Module struct {
-	Path    Path
-	Version string
-	Dir     string
-	// If not empty, the path that this module's source is located at in the repo
-	ReplacePath string
-	// Deps maps modules we depend on to the exact packages
-	// from that module we depend on
-	Deps map[*Module]PackageSet
-}
+	start := len(changes)
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if !carryOn(err) {
+		return err
+	}
+	problems := err
 
-func (m *Module) Imports() []Path {
-	var imports []Path
-	for _, dep := range m.Deps {
-		for pkg := range dep {
-			imports = append(imports, pkg)
+	if err := generate(modules); !carryOn(err) {
+		return errors.Join(problems, err, abortFiles())
+	} else if err != nil {
+		problems = errors.Join(problems, err)
+	}
+	if extra != nil {
+		if err := extra(modules); err != nil {
+			return errors.Join(problems, err, abortFiles())
 		}
 	}
-	sortPaths(imports)
-	return imports
-}
 
-func (m *Module) Dep(d *Module) PackageSet {
-	pkgs := m.Deps[d]
-	if pkgs == nil {
-		pkgs = make(PackageSet)
-		m.Deps[d] = pkgs
+	if config.Journal {
+		if err := emitJournal(modules, start); err != nil {
+			return errors.Join(problems, err, abortFiles())
+		}
 	}
-	return pkgs
-}
-
-func (m *Module) ModSHA256() string {
-	if m.Dir == "" {
-		panic(fmt.Errorf("module without a dir: %s", m.Path))
+	if config.Provenance != "" {
+		if err := emitProvenance(modules); err != nil {
+			return errors.Join(problems, err, abortFiles())
+		}
 	}
 
-	h := sha256.New()
-	if err := archive.CopyPath(archive.WriteDump(h), m.Dir); err != nil {
-		panic(err)
+	prog.Phase("writing")
+	if err := commitFiles(); err != nil {
+		return errors.Join(problems, err)
+	}
+	if err := reportChanges(start); err != nil {
+		return errors.Join(problems, err)
+	}
+	if err := runHooks(changes[start:]); err != nil {
+		return errors.Join(problems, err)
+	}
+	if problems != nil {
+		// the next run has to try the failed parts again
+		return problems
 	}
 
-	return base32.Encode(h.Sum(nil))
-}
-
-func (m *Module) IsExternal() bool {
-	return !strings.HasPrefix(string(m.Path), "example.com/")
+	if config.Incremental && !readOnly() {
+		return saveState(fp)
+	}
+	return nil
 }
 
-type PackageSet map[Path]struct{}
-
-func (s PackageSet) Add(p Path) {
-	s[p] = struct{}{}
+// carryOn reports whether a run can go on after err,
+// because it only concerns some of the modules and -strict isn't set.
+func carryOn(err error) bool {
+	var incomplete *incompleteError
+	return err == nil || (errors.As(err, &incomplete) && !config.Strict)
 }
 
-func sortPaths(xs []Path) {
-	sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] })
+// saveState records the inputs and outputs of a successful run.
+func saveState(fp string) error {
+	sums, err := readGoSums()
+	if err != nil {
+		return err
+	}
+	state := &runState{
+		Fingerprint: fp,
+		Sums:        make(map[string]string),
+		Outputs:     emitted,
+	}
+	for mv, sum := range sums {
+		state.Sums[mv.Path+"@"+mv.Version] = sum
+	}
+	return writeState(state)
 }
@@ -0,0 +1,14 @@
+{ platform, ... }:
+
+platform.buildGo.package {
+  name = "mudtest";
+
+  srcs = [
+    ./mudtest.go
+  ];
+
+  deps = with platform.third_party; [
+    gopkgs."golang.org".x.mod.module
+    gopkgs."golang.org".x.mod.sumdb.dirhash
+  ];
+}
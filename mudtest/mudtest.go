@@ -0,0 +1,244 @@
+// Package mudtest sets up fixture repositories and module caches
+// for testing mud hermetically: custom templates, generators,
+// and the expressions they produce, without a real GOPATH or network.
+//
+// The module cache is written the way the go command lays one out,
+// and mud is run against it with GOPROXY=off, so everything it loads,
+// downloads and hashes comes from the fixture.
+//
+//	repo := mudtest.New(t, "example.com/app", map[string]string{
+//		"main.go": `package main; import _ "example.org/lib"; func main() {}`,
+//	}, mudtest.Module{
+//		Path: "example.org/lib", Version: "v1.0.0",
+//		Files: map[string]string{"lib.go": "package lib"},
+//	})
+//	repo.Run("-template", "my.tmpl")
+//	got := repo.ReadFile(repo.Expression("example.org/lib"))
+package mudtest
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// Binary is the mud binary Run runs: $MUD if it's set, or mud from $PATH.
+var Binary = "mud"
+
+func init() {
+	if b := os.Getenv("MUD"); b != "" {
+		Binary = b
+	}
+}
+
+// Module is a module version in the fixture module cache.
+type Module struct {
+	Path, Version string
+	// Files are the module's files by slash-separated path.
+	// A go.mod is made up if there isn't one.
+	Files map[string]string
+	// Indirect marks the requirement on it indirect.
+	Indirect bool
+}
+
+// Repo is a fixture repository, with its own module cache.
+type Repo struct {
+	t testing.TB
+	// Dir is the repository root
+	Dir string
+	// ModCache is the GOMODCACHE mud runs with
+	ModCache string
+	// Env is added to mud's environment, after the settings that isolate it
+	Env []string
+}
+
+// New makes a repository for the main module with the given files,
+// requiring the given modules, which are put in its module cache.
+// go.mod and go.sum are written unless files has them,
+// and a .mudroot marks the repository root.
+func New(t testing.TB, mainModule string, files map[string]string, mods ...Module) *Repo {
+	t.Helper()
+	root := t.TempDir()
+	r := &Repo{t: t, Dir: filepath.Join(root, "repo"), ModCache: filepath.Join(root, "modcache")}
+
+	var gomod, gosum strings.Builder
+	fmt.Fprintf(&gomod, "module %s\n\ngo 1.21\n", mainModule)
+	if len(mods) > 0 {
+		gomod.WriteString("\nrequire (\n")
+	}
+	for _, m := range mods {
+		h1, modH1, err := r.addModule(m)
+		if err != nil {
+			t.Fatalf("mudtest: adding %s@%s to the module cache: %v", m.Path, m.Version, err)
+		}
+		comment := ""
+		if m.Indirect {
+			comment = " // indirect"
+		}
+		fmt.Fprintf(&gomod, "\t%s %s%s\n", m.Path, m.Version, comment)
+		fmt.Fprintf(&gosum, "%s %s %s\n%s %s/go.mod %s\n", m.Path, m.Version, h1, m.Path, m.Version, modH1)
+	}
+	if len(mods) > 0 {
+		gomod.WriteString(")\n")
+	}
+
+	all := map[string]string{".mudroot": "", "go.mod": gomod.String(), "go.sum": gosum.String()}
+	for name, data := range files {
+		all[name] = data
+	}
+	for name, data := range all {
+		r.WriteFile(name, data)
+	}
+	return r
+}
+
+// addModule writes a module version into the module cache,
+// both as the download cache's zip, .mod and .info files
+// and extracted, and returns its go.sum hashes.
+func (r *Repo) addModule(m Module) (h1, modH1 string, err error) {
+	files := make(map[string]string)
+	for name, data := range m.Files {
+		files[name] = data
+	}
+	if _, ok := files["go.mod"]; !ok {
+		files["go.mod"] = fmt.Sprintf("module %s\n\ngo 1.21\n", m.Path)
+	}
+
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return "", "", err
+	}
+	escVersion, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return "", "", err
+	}
+	download := filepath.Join(r.ModCache, "cache", "download", filepath.FromSlash(escPath), "@v")
+	if err := os.MkdirAll(download, 0755); err != nil {
+		return "", "", err
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	prefix := m.Path + "@" + m.Version + "/"
+	extracted := filepath.Join(r.ModCache, filepath.FromSlash(escPath)+"@"+escVersion)
+	for _, name := range names {
+		w, err := zw.Create(prefix + name)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			return "", "", err
+		}
+		if err := writeFile(filepath.Join(extracted, filepath.FromSlash(name)), files[name]); err != nil {
+			return "", "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", "", err
+	}
+
+	base := filepath.Join(download, escVersion)
+	zipName := base + ".zip"
+	if err := os.WriteFile(zipName, buf.Bytes(), 0644); err != nil {
+		return "", "", err
+	}
+	if h1, err = dirhash.HashZip(zipName, dirhash.Hash1); err != nil {
+		return "", "", err
+	}
+	modH1, err = dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(files["go.mod"])), nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	for ext, data := range map[string]string{
+		".mod":     files["go.mod"],
+		".info":    fmt.Sprintf(`{"Version":%q,"Time":"2020-01-01T00:00:00Z"}`, m.Version),
+		".ziphash": h1,
+	} {
+		if err := os.WriteFile(base+ext, []byte(data), 0644); err != nil {
+			return "", "", err
+		}
+	}
+	return h1, modH1, nil
+}
+
+// WriteFile writes a file in the repository, by slash-separated path.
+func (r *Repo) WriteFile(name, data string) {
+	r.t.Helper()
+	if err := writeFile(filepath.Join(r.Dir, filepath.FromSlash(name)), data); err != nil {
+		r.t.Fatalf("mudtest: %v", err)
+	}
+}
+
+// ReadFile reads a file in the repository, by slash-separated path.
+func (r *Repo) ReadFile(name string) string {
+	r.t.Helper()
+	data, err := os.ReadFile(filepath.Join(r.Dir, filepath.FromSlash(name)))
+	if err != nil {
+		r.t.Fatalf("mudtest: %v", err)
+	}
+	return string(data)
+}
+
+// Expression is the path of the buildgo expression mud generates for a module.
+func (r *Repo) Expression(modulePath string) string {
+	return path.Join("third_party/gopkgs", modulePath, "default.nix")
+}
+
+// Run runs mud in the repository with args, failing the test if it fails,
+// and returns what it wrote to stdout.
+// Exiting because files changed isn't a failure.
+func (r *Repo) Run(args ...string) string {
+	r.t.Helper()
+	stdout, stderr, err := r.Exec(args...)
+	if exit, ok := err.(*exec.ExitError); err != nil && !(ok && exit.ExitCode() == 1) {
+		r.t.Fatalf("mud %s: %v\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return stdout
+}
+
+// Exec runs mud in the repository with args, returning its output and exit error,
+// for tests of how it fails.
+func (r *Repo) Exec(args ...string) (stdout, stderr string, err error) {
+	cmd := exec.Command(Binary, args...)
+	cmd.Dir = r.Dir
+	cmd.Env = append(os.Environ(),
+		"GOMODCACHE="+r.ModCache,
+		"GOPROXY=off",
+		"GOSUMDB=off",
+		"GOWORK=off",
+		"GOFLAGS=-mod=mod",
+		"GOTOOLCHAIN=local",
+		// mud's own caches
+		"XDG_CACHE_HOME="+filepath.Join(filepath.Dir(r.Dir), "cache"),
+	)
+	cmd.Env = append(cmd.Env, r.Env...)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err = cmd.Run()
+	return out.String(), errOut.String(), err
+}
+
+func writeFile(name, data string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, []byte(data), 0644)
+}
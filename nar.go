@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// excluder decides whether to leave a file or directory out of a NAR,
+// given its slash-separated path relative to the root.
+type excluder func(rel string, isDir bool) bool
+
+func excludeNothing(string, bool) bool { return false }
+
+// narHashZip computes the NAR hash of the tree a module zip extracts to,
+// without going through an extracted copy of it.
+// Module zips only contain regular, non-executable files under prefix,
+// so that's all we need to be able to serialise.
+// Excluded files leave their directories behind, like deleting them would.
+func narHashZip(name, prefix string, exclude excluder) ([]byte, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	root := make(narDir)
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		rel, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok {
+			return nil, fmt.Errorf("%s: file %q outside of %q", name, f.Name, prefix)
+		}
+		if err := root.add(strings.Split(rel, "/"), f, exclude); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	h := sha256.New()
+	w := &narWriter{w: h}
+	w.str("nix-archive-1")
+	root.write(w)
+	if w.err != nil {
+		return nil, w.err
+	}
+	return h.Sum(nil), nil
+}
+
+// narDir is a directory being serialised into a NAR.
+// Values are either narDir or *zip.File.
+type narDir map[string]any
+
+func (d narDir) add(names []string, f *zip.File, exclude excluder) error {
+	return d.addAt("", names, f, exclude)
+}
+
+func (d narDir) addAt(dir string, names []string, f *zip.File, exclude excluder) error {
+	name := names[0]
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", f.Name)
+	}
+	rel := slashpath.Join(dir, name)
+
+	if len(names) == 1 {
+		if _, ok := d[name]; ok {
+			return fmt.Errorf("duplicate file %q", f.Name)
+		}
+		if !exclude(rel, false) {
+			d[name] = f
+		}
+		return nil
+	}
+	if exclude(rel, true) {
+		return nil
+	}
+
+	sub, ok := d[name].(narDir)
+	if !ok {
+		if _, exists := d[name]; exists {
+			return fmt.Errorf("file %q is also a directory", f.Name)
+		}
+		sub = make(narDir)
+		d[name] = sub
+	}
+	return sub.addAt(rel, names[1:], f, exclude)
+}
+
+func (d narDir) write(w *narWriter) {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.str("(", "type", "directory")
+	for _, name := range names {
+		w.str("entry", "(", "name", name, "node")
+		switch node := d[name].(type) {
+		case narDir:
+			node.write(w)
+		case *zip.File:
+			w.file(node)
+		}
+		w.str(")")
+	}
+	w.str(")")
+}
+
+// narWriter writes NAR framing, latching the first error.
+type narWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *narWriter) str(ss ...string) {
+	for _, s := range ss {
+		w.header(uint64(len(s)))
+		w.write([]byte(s))
+		w.pad(uint64(len(s)))
+	}
+}
+
+func (w *narWriter) file(f *zip.File) {
+	w.str("(", "type", "regular", "contents")
+	w.header(f.UncompressedSize64)
+	if w.err == nil {
+		rc, err := f.Open()
+		if err != nil {
+			w.err = err
+			return
+		}
+		n, err := io.Copy(w.w, rc)
+		rc.Close()
+		if err == nil && uint64(n) != f.UncompressedSize64 {
+			err = fmt.Errorf("%s: size mismatch", f.Name)
+		}
+		w.err = err
+	}
+	w.pad(f.UncompressedSize64)
+	w.str(")")
+}
+
+func (w *narWriter) header(n uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	w.write(buf[:])
+}
+
+func (w *narWriter) pad(n uint64) {
+	var zero [8]byte
+	if n%8 != 0 {
+		w.write(zero[:8-n%8])
+	}
+}
+
+func (w *narWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+// narHashDir computes the NAR hash of a directory,
+// leaving out anything exclude matches,
+// like builtins.path does with a filter.
+func narHashDir(dir string, exclude excluder) ([]byte, error) {
+	h := sha256.New()
+	w := &narWriter{w: h}
+	w.str("nix-archive-1")
+	if err := w.dir(dir, "", exclude); err != nil {
+		return nil, err
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return h.Sum(nil), nil
+}
+
+// narSizeDir returns the size of the NAR of a directory,
+// which is the size of the tree in the Nix store, give or take.
+func narSizeDir(dir string, exclude excluder) (int64, error) {
+	var c countingWriter
+	w := &narWriter{w: &c}
+	w.str("nix-archive-1")
+	if err := w.dir(dir, "", exclude); err != nil {
+		return 0, err
+	}
+	return c.n, w.err
+}
+
+type countingWriter struct{ n int64 }
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+func (w *narWriter) dir(dir, rel string, exclude excluder) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// ReadDir sorts by name, which is the order NARs want
+	w.str("(", "type", "directory")
+	for _, e := range entries {
+		if exclude(slashpath.Join(rel, e.Name()), e.IsDir()) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		w.str("entry", "(", "name", e.Name(), "node")
+		switch {
+		case e.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			w.str("(", "type", "symlink", "target", target, ")")
+		case e.IsDir():
+			if err := w.dir(path, slashpath.Join(rel, e.Name()), exclude); err != nil {
+				return err
+			}
+		case e.Type().IsRegular():
+			if err := w.regular(path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: can't archive %v", path, e.Type())
+		}
+		w.str(")")
+	}
+	w.str(")")
+	return nil
+}
+
+func (w *narWriter) regular(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.str("(", "type", "regular")
+	if fi.Mode()&0111 != 0 {
+		w.str("executable", "")
+	}
+	w.str("contents")
+	size := uint64(fi.Size())
+	w.header(size)
+	if w.err == nil {
+		n, err := io.Copy(w.w, f)
+		if err == nil && uint64(n) != size {
+			err = fmt.Errorf("%s: changed size while hashing", path)
+		}
+		w.err = err
+	}
+	w.pad(size)
+	w.str(")")
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// checkNix makes sure data parses as a Nix expression,
+// by running it through nix-instantiate --parse.
+func checkNix(path string, data []byte) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("nix-instantiate", "--parse", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return fmt.Errorf("checking %s: %w", path, err)
+		}
+		return fmt.Errorf("%s: generated invalid Nix:\n%s", path, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// osvEntry is the subset of an OSV vulnerability record we use.
+type osvEntry struct {
+	ID        string
+	Aliases   []string
+	Summary   string
+	Withdrawn string
+	Severity  []struct {
+		Type  string
+		Score string
+	}
+	Affected []struct {
+		Package struct {
+			Ecosystem string
+			Name      string
+		}
+		Ranges []struct {
+			Type   string
+			Events []map[string]string
+		}
+		Versions []string
+	}
+	DatabaseSpecific struct {
+		Severity string
+	} `json:"database_specific"`
+}
+
+// readOSV reads the Go entries of an OSV database mirrored to disk:
+// either a directory of JSON records, like the Go vulnerability database's ID dir,
+// or a zip of them, like OSV's Go/all.zip.
+// The entries are indexed by the module they affect.
+func readOSV(db string) (map[string][]*osvEntry, error) {
+	entries := make(map[string][]*osvEntry)
+	add := func(name string, r io.Reader) error {
+		var e osvEntry
+		if err := json.NewDecoder(r).Decode(&e); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if e.Withdrawn != "" {
+			return nil
+		}
+		seen := make(map[string]bool)
+		for _, a := range e.Affected {
+			if a.Package.Ecosystem == "Go" && !seen[a.Package.Name] {
+				seen[a.Package.Name] = true
+				entries[a.Package.Name] = append(entries[a.Package.Name], &e)
+			}
+		}
+		return nil
+	}
+
+	fi, err := os.Stat(db)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		z, err := zip.OpenReader(db)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			if !strings.HasSuffix(f.Name, ".json") {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(f.Name, r)
+			r.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", db, err)
+			}
+		}
+		return entries, nil
+	}
+
+	err = filepath.WalkDir(db, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		if d.Name() == "modules.json" || d.Name() == "vulns.json" || d.Name() == "db.json" {
+			return nil // the Go database's indexes
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return add(path, f)
+	})
+	return entries, err
+}
+
+// affects reports whether the entry covers the module version,
+// and returns the first version that fixes it, if there's one.
+func (e *osvEntry) affects(path, version string) (ok bool, fixed string) {
+	for _, a := range e.Affected {
+		if a.Package.Ecosystem != "Go" || a.Package.Name != path {
+			continue
+		}
+		for _, v := range a.Versions {
+			if withV(v) == version {
+				return true, ""
+			}
+		}
+		for _, r := range a.Ranges {
+			if r.Type != "SEMVER" && r.Type != "ECOSYSTEM" {
+				continue
+			}
+			if in, f := inRange(r.Events, version); in {
+				return true, f
+			}
+		}
+	}
+	return false, ""
+}
+
+// inRange evaluates OSV range events against a version,
+// the way the OSV schema describes: sorted, an introduced event
+// at or below the version makes it affected, and later fixed
+// or last_affected events below it make it not.
+func inRange(events []map[string]string, version string) (bool, string) {
+	type event struct{ kind, version string }
+	var sorted []event
+	for _, ev := range events {
+		for kind, v := range ev {
+			if v == "0" {
+				v = "v0.0.0-0"
+			}
+			sorted = append(sorted, event{kind, withV(v)})
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return semver.Compare(sorted[i].version, sorted[j].version) < 0 })
+
+	affected, fixed := false, ""
+	for _, ev := range sorted {
+		switch ev.kind {
+		case "introduced":
+			if semver.Compare(version, ev.version) >= 0 {
+				affected = true
+			}
+		case "fixed":
+			if semver.Compare(version, ev.version) >= 0 {
+				affected = false
+			} else if affected && fixed == "" {
+				fixed = ev.version
+			}
+		case "last_affected":
+			if semver.Compare(version, ev.version) > 0 {
+				affected = false
+			}
+		}
+	}
+	if !affected {
+		fixed = ""
+	}
+	return affected, fixed
+}
+
+// severity rates the entry: from its CVSS v3 vector if it has one,
+// otherwise as the database rated it, like GitHub's advisories do.
+func (e *osvEntry) severity() string {
+	for _, s := range e.Severity {
+		if s.Type != "CVSS_V3" {
+			continue
+		}
+		if score, ok := cvss3Score(s.Score); ok {
+			return fmt.Sprintf("%s %.1f", cvssRating(score), score)
+		}
+	}
+	switch s := strings.ToUpper(e.DatabaseSpecific.Severity); s {
+	case "":
+		return "UNKNOWN"
+	case "MODERATE":
+		return "MEDIUM"
+	default:
+		return s
+	}
+}
+
+// cvss3Score computes the base score of a CVSS v3 vector,
+// per the specification's formulas.
+func cvss3Score(vector string) (float64, bool) {
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C":  {"H": 0.56, "L": 0.22, "N": 0},
+		"I":  {"H": 0.56, "L": 0.22, "N": 0},
+		"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	}
+	metrics := make(map[string]string)
+	for _, part := range strings.Split(vector, "/")[1:] {
+		k, v, _ := strings.Cut(part, ":")
+		metrics[k] = v
+	}
+	scope := metrics["S"]
+	pr := map[string]float64{"N": 0.85, "L": 0.62, "H": 0.27}
+	if scope == "C" {
+		pr = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}
+	}
+	weights["PR"] = pr
+	if !strings.HasPrefix(vector, "CVSS:3") || (scope != "U" && scope != "C") {
+		return 0, false
+	}
+	w := make(map[string]float64)
+	for k, values := range weights {
+		v, ok := values[metrics[k]]
+		if !ok {
+			return 0, false
+		}
+		w[k] = v
+	}
+
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if scope == "C" {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, true
+	}
+	exploitability := 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	if scope == "C" {
+		return roundUp(math.Min(1.08*(impact+exploitability), 10)), true
+	}
+	return roundUp(math.Min(impact+exploitability, 10)), true
+}
+
+// roundUp is CVSS's round up to one decimal, which avoids floating point surprises.
+func roundUp(x float64) float64 {
+	i := int(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+func cvssRating(score float64) string {
+	switch {
+	case score == 0:
+		return "NONE"
+	case score < 4:
+		return "LOW"
+	case score < 7:
+		return "MEDIUM"
+	case score < 9:
+		return "HIGH"
+	}
+	return "CRITICAL"
+}
+
+// vulnError is a known vulnerability in the version of a module in use.
+type vulnError struct {
+	// Module is path@version
+	Module   string
+	Path     Path
+	ID       string
+	Aliases  []string
+	Severity string
+	Summary  string
+	// Fixed is the first version without it, if there's one
+	Fixed string
+}
+
+func (e *vulnError) Error() string {
+	msg := fmt.Sprintf("%s: %s (%s)", e.Module, e.ID, e.Severity)
+	if e.Summary != "" {
+		msg += ": " + e.Summary
+	}
+	return withHint(msg, e.hint())
+}
+
+func (e *vulnError) hint() string {
+	if e.Fixed == "" {
+		return "there's no fixed version yet"
+	}
+	return fmt.Sprintf("fixed in %s: run `mud update %s@%s`", e.Fixed, e.Path, e.Fixed)
+}
+
+// scanVulns matches the modules against the OSV database in the VulnDB setting,
+// returning a vulnError for every vulnerability in the versions in use.
+// It never touches the network: the database is whatever was last mirrored.
+func scanVulns(mods []*Module) ([]error, error) {
+	prog.Phase("scanning for vulnerabilities")
+	db, err := readOSV(config.VulnDB)
+	if err != nil {
+		return nil, fmt.Errorf("reading vulnerability database: %w", err)
+	}
+	if len(db) == 0 {
+		return nil, fmt.Errorf("%s has no Go vulnerabilities in it: is it an OSV database?", config.VulnDB)
+	}
+
+	var found []error
+	for _, mod := range mods {
+		if mod.IsLocal() {
+			continue
+		}
+		mv := mod.ModuleVersion()
+		for _, e := range db[mv.Path] {
+			ok, fixed := e.affects(mv.Path, mv.Version)
+			if !ok {
+				continue
+			}
+			found = append(found, &vulnError{
+				Module:   mv.String(),
+				Path:     mod.Path,
+				ID:       e.ID,
+				Aliases:  e.Aliases,
+				Severity: e.severity(),
+				Summary:  e.Summary,
+				Fixed:    fixed,
+			})
+		}
+	}
+	slog.Debug("scanned for vulnerabilities", "db", config.VulnDB, "modules", len(db), "found", len(found))
+	return found, nil
+}
+
+// reportVulns scans for vulnerabilities during a run,
+// warning about them, unless we're being strict.
+func reportVulns(mods []*Module) error {
+	found, err := scanVulns(mods)
+	if err != nil {
+		return err
+	}
+	if config.Strict {
+		return errors.Join(found...)
+	}
+	for _, err := range found {
+		slog.Warn(err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// outdatedModule is a row of mud outdated's report.
+type outdatedModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	// Manifest is the version the manifest was generated for,
+	// if that's not the one in use
+	Manifest string `json:"manifest,omitempty"`
+	Latest   string `json:"latest"`
+	// Held is set for held modules, to why they're held
+	Held string `json:"held,omitempty"`
+}
+
+// cmdOutdated lists the external modules with newer versions available,
+// within their current major version, since a new major is a different module.
+func cmdOutdated(args []string) error {
+	fs := flag.NewFlagSet("outdated", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: mud outdated [-json]")
+	}
+	if config.Offline {
+		return fmt.Errorf("mud outdated needs the module proxy, so it can't run offline")
+	}
+
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if err != nil {
+		return err
+	}
+
+	// go list sorts its output, so the arguments' order doesn't matter,
+	// and replaced modules are left out, since their requirement isn't what's used
+	var paths []string
+	for path, mod := range modules {
+		if mod.IsExternal() && mod.ReplacePath == "" && config.Selected(path) {
+			paths = append(paths, string(path))
+		}
+	}
+
+	var out []byte
+	if len(paths) > 0 {
+		prog.Phase("checking for updates")
+		if out, err = goCmd(append([]string{"list", "-m", "-e", "-u", "-json"}, paths...)...); err != nil {
+			return err
+		}
+	}
+
+	var report []outdatedModule
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m struct {
+			listedModule
+			Update *struct {
+				Version string
+			}
+		}
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if m.Error != nil {
+			slog.Warn("couldn't check for updates", "module", m.Path, "error", m.Error.Err)
+			continue
+		}
+		if m.Update == nil {
+			continue
+		}
+
+		row := outdatedModule{Path: m.Path, Version: m.Version, Latest: m.Update.Version}
+		if reason, held := holdReason(Path(m.Path)); held {
+			row.Held = reason
+			if row.Held == "" {
+				row.Held = "held"
+			}
+		}
+		if mod := modules[Path(m.Path)]; mod != nil {
+			man, err := readManifest(filepath.Join(mod.OutDir(), "default.nix"))
+			if err != nil {
+				return err
+			}
+			if man != nil && "v"+man.Version != m.Version {
+				row.Manifest = "v" + man.Version
+			}
+		}
+		report = append(report, row)
+	}
+
+	prog.Done()
+	if *asJSON {
+		if report == nil {
+			report = []outdatedModule{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(report)
+	}
+	if len(report) == 0 {
+		slog.Info("everything is up to date")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tCURRENT\tLATEST\tMANIFEST\tHELD")
+	for _, row := range report {
+		manifest, held := row.Manifest, row.Held
+		if manifest == "" {
+			manifest = "-"
+		}
+		if held == "" {
+			held = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.Path, row.Version, row.Latest, manifest, held)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var dryRun = flag.Bool("dry-run", false, "print a diff of what would change instead of writing files")
+
+// staged holds files written to temporary names by emitFile,
+// waiting for commitFiles to move them into place.
+// stagedMu guards it, since an interrupted run cleans it up
+// from the signal handler.
+var (
+	staged   []stagedFile
+	stagedMu sync.Mutex
+)
+
+// stagedFile is a file to move into place,
+// or to remove if tmp is empty.
+type stagedFile struct {
+	tmp, path string
+}
+
+// emitted records the hash of every file emitFile was given,
+// whether or not it changed.
+var emitted = make(map[string]string)
+
+// changes records every file emitFile changed (or would have, on a dry run),
+// in the order they were emitted.
+var changes []fileChange
+
+type fileChange struct {
+	Path    string
+	Created bool
+	Removed bool
+	// Old and New are what the file describes before and after,
+	// if it's a generated manifest
+	Old, New *Manifest
+}
+
+// emitFile stages a generated file to be written by commitFiles,
+// or prints a diff against the current file if this is a dry run
+// (unless we're being quiet), or writes it to stdout with -stdout.
+// Files that wouldn't change are left alone, except on stdout.
+func emitFile(dir, name string, data []byte) error {
+	path := filepath.Join(dir, name)
+	emitted[filepath.ToSlash(path)] = hashBytes(data)
+	old, err := os.ReadFile(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if exists && bytes.Equal(old, data) {
+		if *toStdout {
+			return streamFile(path, data)
+		}
+		return nil
+	}
+	if config.CheckNix && strings.HasSuffix(name, ".nix") {
+		if err := checkNix(path, data); err != nil {
+			return err
+		}
+	}
+	changes = append(changes, fileChange{Path: path, Created: !exists, Old: parseManifest(old), New: parseManifest(data)})
+
+	if *toStdout {
+		return streamFile(path, data)
+	}
+	if !*dryRun {
+		slog.Info("writing", "file", path)
+		return stageFile(dir, name, data)
+	}
+
+	if *quiet {
+		return nil
+	}
+	slashPath := filepath.ToSlash(path)
+	oldName := "a/" + slashPath
+	if !exists {
+		oldName = "/dev/null"
+	}
+	_, err = os.Stdout.Write(unifiedDiff(oldName, "b/"+slashPath, old, data))
+	return err
+}
+
+// removeFile stages a file for removal by commitFiles,
+// or prints a diff removing it if this is a dry run.
+func removeFile(path string) error {
+	old, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	changes = append(changes, fileChange{Path: path, Removed: true, Old: parseManifest(old)})
+	delete(emitted, filepath.ToSlash(path))
+
+	if *toStdout {
+		slog.Info("would remove", "file", path)
+		return nil
+	}
+	if !*dryRun {
+		slog.Info("removing", "file", path)
+		stagedMu.Lock()
+		defer stagedMu.Unlock()
+		staged = append(staged, stagedFile{path: path})
+		return nil
+	}
+
+	if *quiet {
+		return nil
+	}
+	_, err = os.Stdout.Write(unifiedDiff("a/"+filepath.ToSlash(path), "/dev/null", old, nil))
+	return err
+}
+
+func stageFile(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	tmp, err := writeTemp(dir, name, data)
+	if err != nil {
+		return err
+	}
+	if err := recordStaged(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	staged = append(staged, stagedFile{tmp: tmp, path: filepath.Join(dir, name)})
+	return nil
+}
+
+// commitFiles moves all staged files into place.
+// Nothing is renamed until everything has been generated,
+// so a failed run leaves the tree as it was.
+func commitFiles() error {
+	if err := finishStream(); err != nil {
+		return err
+	}
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	for i, f := range staged {
+		if f.tmp == "" {
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				staged = staged[i:]
+				return errors.Join(err, abortStaged())
+			}
+			removeEmptyParents(f.path)
+			continue
+		}
+		if err := replaceFile(f.tmp, f.path); err != nil {
+			staged = staged[i:]
+			return errors.Join(err, abortStaged())
+		}
+	}
+	staged = nil
+	forgetStaged()
+	return nil
+}
+
+// removeEmptyParents removes the directories above a removed file
+// for as long as they're empty.
+func removeEmptyParents(path string) {
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// abortFiles removes all staged files that haven't been moved into place.
+func abortFiles() error {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	return abortStaged()
+}
+
+// abortStaged is abortFiles, with stagedMu held.
+func abortStaged() error {
+	var errs []error
+	for _, f := range staged {
+		if f.tmp == "" {
+			continue
+		}
+		if err := os.Remove(f.tmp); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	staged = nil
+	if len(errs) == 0 {
+		forgetStaged()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// MaintainerRule gives the modules matching Pattern maintainers,
+// instead of whoever CODEOWNERS says owns their expressions.
+// The first matching rule applies.
+type MaintainerRule struct {
+	Pattern     string   `json:"pattern"`
+	Maintainers []string `json:"maintainers"`
+}
+
+// codeOwnersFiles are where GitHub and GitLab look for CODEOWNERS, in order.
+var codeOwnersFiles = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS", ".gitlab/CODEOWNERS"}
+
+// codeOwnersRule is a line of a CODEOWNERS file.
+type codeOwnersRule struct {
+	re     *regexp.Regexp
+	owners []string
+}
+
+// readCodeOwners reads the repository's CODEOWNERS file, if it has one.
+func readCodeOwners() ([]codeOwnersRule, error) {
+	for _, name := range codeOwnersFiles {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		rules := []codeOwnersRule{}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") ||
+				strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+				continue // GitLab sections don't change who owns what
+			}
+			var owners []string
+			for _, owner := range fields[1:] {
+				if strings.HasPrefix(owner, "#") {
+					break
+				}
+				owners = append(owners, owner)
+			}
+			re, err := codeOwnersPattern(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+			}
+			rules = append(rules, codeOwnersRule{re, owners})
+		}
+		return rules, scanner.Err()
+	}
+	return nil, nil
+}
+
+// codeOwnersPattern compiles a CODEOWNERS pattern, which follows gitignore:
+// a pattern with a slash other than at the end is anchored at the root,
+// * and ? stay within a path element while ** crosses them,
+// and a pattern matching a directory covers everything in it.
+func codeOwnersPattern(pattern string) (*regexp.Regexp, error) {
+	p := strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil, fmt.Errorf("bad pattern %q", pattern)
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '\\' && i+1 < len(p):
+			i++
+			re.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("(?:/.*)?$")
+	return regexp.Compile(re.String())
+}
+
+// codeOwners returns the owners of a file: those of the last rule matching it.
+func codeOwners(rules []codeOwnersRule, file string) []string {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].re.MatchString(file) {
+			return rules[i].owners
+		}
+	}
+	return nil
+}
+
+// assignMaintainers sets the maintainers in the modules' metadata,
+// from the maintainer rules or else, with CodeOwners,
+// from who owns the file generated for each, which is who'd review a bump of it.
+func assignMaintainers(mods []*Module) error {
+	var rules []codeOwnersRule
+	if config.CodeOwners {
+		var err error
+		if rules, err = readCodeOwners(); err != nil {
+			return err
+		}
+		if rules == nil {
+			return fmt.Errorf("-code-owners needs a CODEOWNERS file (looked for %s)", strings.Join(codeOwnersFiles, ", "))
+		}
+	}
+	for _, mod := range mods {
+		owners := codeOwners(rules, generatedFile(mod.Path))
+		for _, rule := range config.Maintainers {
+			if matchPattern(rule.Pattern, string(mod.Path)) {
+				owners = rule.Maintainers
+				break
+			}
+		}
+		if len(owners) == 0 {
+			continue
+		}
+		if mod.meta == nil {
+			mod.meta = &ModuleMeta{}
+		}
+		mod.meta.Maintainers = owners
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// pluginPrefix is what an out-of-process generator's executable is called,
+// followed by the generator's name: -generator=bazel runs mud-gen-bazel
+// from $PATH, if there's no generator of that name built in.
+const pluginPrefix = "mud-gen-"
+
+// pluginProtocol is the version of the request a plugin is sent.
+// It changes only when fields change meaning or go away.
+const pluginProtocol = 1
+
+// pluginRequest is what a plugin gets on stdin.
+type pluginRequest struct {
+	Protocol int `json:"protocol"`
+	// GopkgsDir is where the built-in generators write,
+	// for plugins that want to write alongside them
+	GopkgsDir string         `json:"gopkgsDir"`
+	Modules   []pluginModule `json:"modules"`
+}
+
+// pluginModule is an external module, as the built-in templates see it.
+type pluginModule struct {
+	Path string `json:"path"`
+	// Version is the version as go.mod has it, with the v
+	Version string `json:"version,omitempty"`
+	// ModulePath is the path the source is fetched as, if it's replaced
+	ModulePath string `json:"modulePath,omitempty"`
+	// Replace is the repository directory of a local replacement,
+	// which has no version or hashes
+	Replace     string   `json:"replace,omitempty"`
+	GoVersion   string   `json:"goVersion,omitempty"`
+	Toolchain   string   `json:"toolchain,omitempty"`
+	NARHash     string   `json:"narHash,omitempty"`
+	GoSum       string   `json:"goSum,omitempty"`
+	SubPackages []string `json:"subPackages"`
+	Deps        []string `json:"deps"`
+	// Excludes are the source filter patterns for the module
+	Excludes []string    `json:"excludes,omitempty"`
+	VCS      *VCSInfo    `json:"vcs,omitempty"`
+	Meta     *ModuleMeta `json:"meta,omitempty"`
+}
+
+// pluginResponse is what a plugin writes to stdout:
+// the files to write, by slash-separated path from the repository root.
+type pluginResponse struct {
+	Files []struct {
+		Path     string `json:"path"`
+		Contents string `json:"contents"`
+	} `json:"files"`
+}
+
+// lookupGenerator finds a built-in generator, or a plugin by that name.
+func lookupGenerator(name string) (generator, bool) {
+	if gen, ok := generators[name]; ok {
+		return gen, true
+	}
+	bin, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return generator{}, false
+	}
+	return generator{generate: func(selected, all []*Module) error {
+		return runPlugin(bin, all)
+	}}, true
+}
+
+// runPlugin runs a plugin generator over every external module,
+// and emits the files it returns like a built-in generator would,
+// so dry runs, -stdout, hooks and stale checks all work the same.
+// Plugins always cover every module, so -only and -exclude don't apply.
+// Their stderr is passed through.
+func runPlugin(bin string, all []*Module) error {
+	req := pluginRequest{Protocol: pluginProtocol, GopkgsDir: filepath.ToSlash(gopkgsDir), Modules: []pluginModule{}}
+	for i, mod := range all {
+		prog.Step(i+1, len(all), string(mod.Path))
+		pm, err := pluginModuleOf(mod)
+		if err != nil {
+			return err
+		}
+		req.Modules = append(req.Modules, pm)
+	}
+	in, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("running generator plugin", "command", bin, "modules", len(req.Modules))
+	var out bytes.Buffer
+	cmd := exec.Command(bin)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("generator %s: %w", bin, err)
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		return fmt.Errorf("generator %s: bad response: %w", bin, err)
+	}
+	for _, f := range resp.Files {
+		name := filepath.FromSlash(f.Path)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("generator %s: %q is outside the repository", bin, f.Path)
+		}
+		if err := emitFile(filepath.Dir(name), filepath.Base(name), []byte(f.Contents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pluginModuleOf(mod *Module) (pluginModule, error) {
+	pm := pluginModule{
+		Path:        string(mod.Path),
+		SubPackages: mod.SubPackages(),
+		Deps:        []string{},
+		Excludes:    mod.sourceExcludes(),
+		Meta:        mod.Meta(),
+	}
+	for _, dep := range mod.DepModules() {
+		pm.Deps = append(pm.Deps, string(dep.Path))
+	}
+	var err error
+	if pm.GoVersion, err = mod.GoVersion(); err != nil {
+		return pm, err
+	}
+	if pm.Toolchain, err = mod.Toolchain(); err != nil {
+		return pm, err
+	}
+	if mod.IsLocal() {
+		pm.Replace = filepath.ToSlash(mod.ReplacePath)
+		return pm, nil
+	}
+	mv := mod.ModuleVersion()
+	pm.Version = mv.Version
+	if mv.Path != pm.Path {
+		pm.ModulePath = mv.Path
+	}
+	if pm.NARHash, err = mod.ModSRI(); err != nil {
+		return pm, err
+	}
+	pm.GoSum = mod.Sum()
+	if pm.VCS, err = mod.VCS(); err != nil {
+		return pm, err
+	}
+	return pm, nil
+}
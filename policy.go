@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy is what the repository accepts as dependencies.
+// It's checked on every run, before anything is written,
+// and by mud check.
+type Policy struct {
+	// Deny are patterns of modules that mustn't be used at all.
+	Deny []string `json:"deny"`
+	// DenyLicenses are SPDX license identifiers no module may be under,
+	// like AGPL-3.0, which also covers its -only and -or-later forms.
+	// Licenses come from deps.dev, as with -metadata.
+	DenyLicenses []string `json:"denyLicenses"`
+	// DenyArchived rejects modules whose GitHub repositories are archived.
+	// GITHUB_TOKEN is used for the API, if set.
+	DenyArchived bool `json:"denyArchived"`
+	// Approvals is a directory of sign-offs for direct dependencies:
+	// a module required directly by one of the repository's go.mod files
+	// needs a non-empty OWNERS file in the directory named after its path,
+	// like approvals/github.com/google/uuid/OWNERS.
+	Approvals string `json:"approvals"`
+}
+
+func (p *Policy) enabled() bool {
+	return len(p.Deny) > 0 || len(p.DenyLicenses) > 0 || p.DenyArchived || p.Approvals != ""
+}
+
+func (p *Policy) validate() error {
+	for _, id := range p.DenyLicenses {
+		if id == "" || strings.ContainsAny(id, " ()") {
+			return fmt.Errorf("bad license %q in policy: licenses are SPDX identifiers, not expressions", id)
+		}
+	}
+	return nil
+}
+
+// cmdCheck checks the modules in use against the policy and the budget,
+// and for vulnerabilities if there's a VulnDB,
+// listing every finding, without generating anything.
+// -base is the git revision the budget for new modules counts from.
+// -report picks other formats for the findings, like SARIF,
+// for code scanning UIs and CI annotations to show.
+func cmdCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	report := addReportFlags(fs)
+	base := fs.String("base", "", "count modules added since the git `revision` against the budget")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: mud check [-report format] [-base revision]")
+	}
+	if err := report.validate(); err != nil {
+		return err
+	}
+	if !config.Policy.enabled() && !config.Budget.enabled() && config.VulnDB == "" {
+		return errors.New("nothing to check: set \"policy\", \"budget\" or \"vulnDB\" in mud.json")
+	}
+	if config.Budget.MaxNewModules > 0 && *base == "" {
+		slog.Warn("not checking the budget for new modules without -base")
+	}
+
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if err != nil {
+		return err
+	}
+	var mods []*Module
+	for _, path := range sortedPaths(modules) {
+		if mod := modules[path]; mod.IsExternal() {
+			mods = append(mods, mod)
+		}
+	}
+
+	var findings []error
+	if config.Policy.enabled() {
+		violations, err := checkPolicy(mods)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, violations...)
+	}
+	if config.Budget.enabled() {
+		over, err := checkBudget(modules, mods, *base)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, over...)
+	}
+	if config.VulnDB != "" {
+		vulns, err := scanVulns(mods)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, vulns...)
+	}
+	if err := report.report(findings); err != nil {
+		return err
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("%d problems found", len(findings))
+	}
+	slog.Info("all modules pass", "modules", len(mods))
+	return nil
+}
+
+// checkPolicy returns the policy violations of mods, as moduleErrors.
+// It fails outright when a check can't be made at all, like offline,
+// or when GitHub can't say whether a repository is archived.
+// A module deps.dev couldn't be asked about violates the license policy,
+// while one it knows no licenses for, or doesn't know of, is only warned about.
+func checkPolicy(mods []*Module) ([]error, error) {
+	policy := &config.Policy
+	prog.Phase("checking policy")
+
+	var violations []error
+	violate := func(mod *Module, err error, hint string) {
+		violations = append(violations, &moduleError{Kind: "policy", Module: string(mod.Path), Err: err, Hint: hint})
+	}
+
+	for _, mod := range mods {
+		for _, pattern := range policy.Deny {
+			if matchPattern(pattern, string(mod.Path)) {
+				violate(mod, fmt.Errorf("denied by policy pattern %q", pattern), "")
+				break
+			}
+		}
+	}
+
+	if len(policy.DenyLicenses) > 0 {
+		if config.Offline {
+			return nil, errors.New("the license policy needs deps.dev, so it can't be checked offline")
+		}
+		var unknown []*Module
+		for _, mod := range mods {
+			if mod.meta == nil {
+				unknown = append(unknown, mod)
+			}
+		}
+		fetchMetadata(unknown)
+		if !config.Metadata {
+			// only -metadata puts it into the expressions
+			defer func() {
+				for _, mod := range unknown {
+					mod.meta = nil
+				}
+			}()
+		}
+		for _, mod := range mods {
+			if mod.meta == nil {
+				continue // local
+			}
+			if err := mod.meta.fetchErr; err != nil {
+				violate(mod, fmt.Errorf("couldn't look up its licenses: %w", err), "the license policy needs deps.dev, so run again once it can be reached")
+				continue
+			}
+			if len(mod.meta.Licenses) == 0 {
+				slog.Warn("no licenses known for module, so the license policy can't check it", "module", mod.Path)
+			}
+			if l := deniedLicense(mod.meta.Licenses, policy.DenyLicenses); l != "" {
+				violate(mod, fmt.Errorf("is under %s, which the policy denies", l), "")
+			}
+		}
+	}
+
+	if policy.DenyArchived {
+		if config.Offline {
+			return nil, errors.New("the archived repository policy needs the GitHub API, so it can't be checked offline")
+		}
+		archived, err := archivedRepos(mods)
+		if err != nil {
+			return nil, err
+		}
+		for _, mod := range mods {
+			if url := archived[mod]; url != "" {
+				violate(mod, fmt.Errorf("its repository %s is archived", url), "")
+			}
+		}
+	}
+
+	if policy.Approvals != "" {
+		direct, err := directRequires()
+		if err != nil {
+			return nil, err
+		}
+		for _, mod := range mods {
+			if !direct[mod.Path] {
+				continue
+			}
+			owners := filepath.Join(policy.Approvals, filepath.FromSlash(string(mod.Path)), "OWNERS")
+			fi, err := os.Stat(owners)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err != nil || fi.Size() == 0 {
+				violate(mod, errors.New("is a direct dependency without an approval"),
+					fmt.Sprintf("get it signed off in %s, listing who approved it", owners))
+			}
+		}
+	}
+	return violations, nil
+}
+
+// deniedLicense returns the first license in the SPDX expressions that's denied.
+func deniedLicense(exprs, denied []string) string {
+	for _, expr := range exprs {
+		for _, id := range strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(expr)) {
+			switch id {
+			case "AND", "OR", "WITH":
+				continue
+			}
+			base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(id, "+"), "-only"), "-or-later")
+			for _, d := range denied {
+				if strings.EqualFold(id, d) || strings.EqualFold(base, d) {
+					return id
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// directRequires returns the modules the repository's go.mod files require directly.
+func directRequires() (map[Path]bool, error) {
+	dirs, err := repoModules()
+	if err != nil {
+		return nil, err
+	}
+	direct := make(map[Path]bool)
+	for _, dir := range dirs {
+		f, err := readGoMod(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range f.Require {
+			if !r.Indirect {
+				direct[Path(r.Mod.Path)] = true
+			}
+		}
+	}
+	return direct, nil
+}
+
+// archivedRepos asks GitHub which of the modules' repositories are archived,
+// returning their URLs. Modules hosted elsewhere can't be checked, and are left out.
+func archivedRepos(mods []*Module) (map[*Module]string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	repos := make(map[string][]*Module)
+	for _, mod := range mods {
+		if mod.IsLocal() {
+			continue
+		}
+		url := guessRepoURL(mod.ModuleVersion().Path)
+		if mod.meta != nil && mod.meta.Repository != "" {
+			url = mod.meta.Repository
+		}
+		if githubURLRe.MatchString(url) {
+			repos[url] = append(repos[url], mod)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		archived = make(map[*Module]string)
+		errs     []error
+	)
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range work {
+				match := githubURLRe.FindStringSubmatch(url)
+				isArchived, err := githubArchived(client, match[1], match[2])
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else if isArchived {
+					for _, mod := range repos[url] {
+						archived[mod] = url
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for url := range repos {
+		work <- url
+	}
+	close(work)
+	wg.Wait()
+	return archived, errors.Join(errs...)
+}
+
+func githubArchived(client *http.Client, owner, repo string) (bool, error) {
+	u := "https://api.github.com/repos/" + owner + "/" + repo
+	req, err := http.NewRequestWithContext(context.Background(), "GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	var v struct {
+		Archived bool
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return false, err
+	}
+	return v.Archived, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// progress reports what mud is up to on an interactive stderr:
+// a status line that's rewritten as work progresses,
+// and how long each phase took once it's over.
+type progress struct {
+	enabled bool
+	phase   string
+	start   time.Time
+	// times adds up how long was spent in each phase, in order of first use
+	times []phaseTime
+}
+
+type phaseTime struct {
+	phase string
+	d     time.Duration
+	count int
+}
+
+var prog progress
+
+// startProgress enables progress reporting if stderr is a terminal
+// and nothing else is going to parse it.
+func startProgress() {
+	fi, err := os.Stderr.Stat()
+	prog.enabled = err == nil && fi.Mode()&os.ModeCharDevice != 0 && *logFormat == "text" && !*quiet
+}
+
+// Phase ends the current phase, if any, and starts a new one.
+// Starting the phase that's already going on carries on with it.
+func (p *progress) Phase(name string) {
+	if p.phase == name {
+		return
+	}
+	p.Done()
+	p.phase = name
+	p.start = time.Now()
+	if p.enabled {
+		fmt.Fprintf(os.Stderr, "\r\033[K%s...", name)
+	}
+}
+
+// Step reports that item n of total in the current phase is being worked on.
+func (p *progress) Step(n, total int, item string) {
+	if p.enabled {
+		fmt.Fprintf(os.Stderr, "\r\033[K%s: %d/%d %s", p.phase, n, total, item)
+	}
+}
+
+// Done ends the current phase, printing how long it took.
+func (p *progress) Done() {
+	if p.phase == "" {
+		return
+	}
+	d := time.Since(p.start)
+	if p.enabled {
+		fmt.Fprintf(os.Stderr, "\r\033[K%s: done in %v\n", p.phase, d.Round(time.Millisecond))
+	}
+	p.record(p.phase, d)
+	p.phase = ""
+}
+
+func (p *progress) record(phase string, d time.Duration) {
+	for i := range p.times {
+		if p.times[i].phase == phase {
+			p.times[i].d += d
+			p.times[i].count++
+			return
+		}
+	}
+	p.times = append(p.times, phaseTime{phase: phase, d: d, count: 1})
+}
+
+var timings = flag.Bool("timings", false, "print how long each phase took in total")
+
+// printTimings writes the time spent in each phase to stderr.
+func (p *progress) printTimings(total time.Duration) {
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, t := range p.times {
+		times := ""
+		if t.count > 1 {
+			times = fmt.Sprintf("(%d times)", t.count)
+		}
+		fmt.Fprintf(w, "%s\t%v\t%.0f%%\t%s\n", t.phase, t.d.Round(time.Millisecond), 100*t.d.Seconds()/total.Seconds(), times)
+	}
+	fmt.Fprintf(w, "total\t%v\n", total.Round(time.Millisecond))
+	w.Flush()
+}
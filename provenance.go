@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+)
+
+// The in-toto statement with a SLSA v1 provenance predicate
+// that -provenance writes. Nothing in it depends on when mud ran,
+// so it only changes when the inputs or the generated files do.
+type (
+	inTotoStatement struct {
+		Type          string         `json:"_type"`
+		Subject       []resourceDesc `json:"subject"`
+		PredicateType string         `json:"predicateType"`
+		Predicate     slsaProvenance `json:"predicate"`
+	}
+	slsaProvenance struct {
+		BuildDefinition struct {
+			BuildType            string         `json:"buildType"`
+			ExternalParameters   map[string]any `json:"externalParameters"`
+			ResolvedDependencies []resourceDesc `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				ID      string            `json:"id"`
+				Version map[string]string `json:"version,omitempty"`
+			} `json:"builder"`
+		} `json:"runDetails"`
+	}
+	resourceDesc struct {
+		Name        string            `json:"name,omitempty"`
+		URI         string            `json:"uri,omitempty"`
+		Digest      map[string]string `json:"digest,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	dsseEnvelope struct {
+		PayloadType string          `json:"payloadType"`
+		Payload     string          `json:"payload"`
+		Signatures  []dsseSignature `json:"signatures"`
+	}
+	dsseSignature struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	}
+)
+
+const (
+	provenanceBuildType = "urn:mud:generate:v1"
+	provenanceBuilder   = "urn:mud"
+)
+
+// emitProvenance emits the provenance statement for the files this run generated,
+// as a DSSE envelope signed with the ProvenanceKey if there is one.
+// Modules are listed by their NAR hashes, which is what the expressions pin,
+// with their go.sum hashes alongside.
+func emitProvenance(modules map[Path]*Module) error {
+	st := inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       []resourceDesc{},
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+	self := filepath.ToSlash(config.Provenance)
+	for path, sum := range emitted {
+		if path != self {
+			st.Subject = append(st.Subject, resourceDesc{Name: path, Digest: map[string]string{"sha256": sum}})
+		}
+	}
+	sort.Slice(st.Subject, func(i, j int) bool { return st.Subject[i].Name < st.Subject[j].Name })
+
+	def := &st.Predicate.BuildDefinition
+	def.BuildType = provenanceBuildType
+	def.ExternalParameters = map[string]any{"generator": config.Generator}
+
+	dirs, err := repoModules()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, dir := range dirs {
+		names = append(names, moduleFiles(dir)...)
+	}
+	names = append(names, *configPath)
+	if config.Template != "" {
+		names = append(names, config.Template)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, resourceDesc{
+			Name:   filepath.ToSlash(name),
+			Digest: map[string]string{"sha256": hashBytes(data)},
+		})
+	}
+	for _, path := range sortedPaths(modules) {
+		mod := modules[path]
+		if !mod.IsExternal() || mod.IsLocal() || mod.narHash == nil {
+			continue
+		}
+		mv := mod.ModuleVersion()
+		d := resourceDesc{
+			Name:   mv.String(),
+			URI:    "pkg:golang/" + mv.String(),
+			Digest: map[string]string{"narSha256": hex.EncodeToString(mod.narHash)},
+		}
+		if mod.sum != "" {
+			d.Annotations = map[string]string{"goSum": mod.sum}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, d)
+	}
+
+	builder := &st.Predicate.RunDetails.Builder
+	builder.ID = provenanceBuilder
+	if info, ok := debug.ReadBuildInfo(); ok {
+		builder.Version = map[string]string{"mud": info.Main.Version, "go": info.GoVersion}
+	}
+
+	data, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if config.ProvenanceKey != "" {
+		if data, err = signDSSE(data); err != nil {
+			return err
+		}
+	}
+	return emitFile(filepath.Dir(config.Provenance), filepath.Base(config.Provenance), append(data, '\n'))
+}
+
+// signDSSE wraps an in-toto statement in a DSSE envelope,
+// signed with the Ed25519 key in the ProvenanceKey PEM file.
+// Ed25519 signatures are deterministic, so the envelope is too.
+func signDSSE(payload []byte) ([]byte, error) {
+	pemData, err := os.ReadFile(config.ProvenanceKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key in it", config.ProvenanceKey)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", config.ProvenanceKey, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", config.ProvenanceKey)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha256.Sum256(pub)
+
+	const payloadType = "application/vnd.in-toto+json"
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+	return json.MarshalIndent(&dsseEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{{
+			KeyID: hex.EncodeToString(keyID[:]),
+			Sig:   base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(pae))),
+		}},
+	}, "", "  ")
+}
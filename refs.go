@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// gopkgsRefRe matches references into the gopkgs tree from Nix code,
+// by the name of the gopkgs dir.
+func gopkgsRefRe() *regexp.Regexp {
+	_, name := gopkgsAttr()
+	prefix := regexp.QuoteMeta(name)
+	if !strings.HasPrefix(name, `"`) {
+		prefix = `\b` + prefix
+	}
+	return regexp.MustCompile(prefix + `((?:\.(?:"(?:[^"\\]|\\.)*"|[A-Za-z_][A-Za-z0-9_'-]*))+)`)
+}
+
+var attrNameRe = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|[A-Za-z_][A-Za-z0-9_'-]*`)
+
+// cmdRefs cross-checks the gopkgs tree against the Nix code using it:
+// references to modules or packages that aren't there,
+// and modules that nothing references.
+func cmdRefs(args []string) error {
+	if len(args) > 0 {
+		return errors.New("mud refs takes no arguments")
+	}
+
+	// everything with an expression in the gopkgs dir, generated or not
+	mods := make(map[Path]*Manifest)
+	err := filepath.WalkDir(gopkgsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "default.nix" || filepath.Dir(path) == filepath.FromSlash(gopkgsDir) {
+			return nil
+		}
+		rel, err := filepath.Rel(gopkgsDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		man, err := readManifest(path)
+		if err != nil {
+			return err
+		}
+		mods[dirPath(filepath.ToSlash(rel))] = man
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var paths []Path
+	for path := range mods {
+		paths = append(paths, path)
+	}
+	attrRenames = renameAttrs(paths)
+
+	prog.Phase("scanning")
+	used := make(map[Path]bool)
+	var problems int
+	err = filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != "." && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".nix") {
+			return nil
+		}
+		return scanRefs(path, func(line int, ref Path) {
+			_, name := gopkgsAttr()
+			mod, sub := findModule(mods, ref)
+			switch {
+			case mod == "":
+				problems++
+				fmt.Printf("%s:%d: %s.%s: no such module\n", path, line, name, ref.NixAttr())
+			case !builds(mods[mod], sub):
+				problems++
+				fmt.Printf("%s:%d: %s.%s: %s doesn't build package %s\n", path, line, name, ref.NixAttr(), mod, sub)
+			}
+			// a module's own expression doesn't count as using it
+			if mod != "" && filepath.Dir(path) != filepath.Join(gopkgsDir, filepath.FromSlash(mod.dirName())) {
+				used[mod] = true
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	prog.Done()
+	sortPaths(paths)
+	for _, path := range paths {
+		if !used[path] {
+			fmt.Printf("//%s/%s: nothing references it\n", gopkgsDir, path.dirName())
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d broken gopkgs references", problems)
+	}
+	return nil
+}
+
+// scanRefs calls fn for every gopkgs reference in a Nix file.
+func scanRefs(name string, fn func(line int, ref Path)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	refRe := gopkgsRefRe()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		for _, match := range refRe.FindAllStringSubmatch(stripComment(scanner.Text()), -1) {
+			var elems []string
+			for _, name := range attrNameRe.FindAllString(match[1], -1) {
+				if unquoted, err := strconv.Unquote(name); err == nil {
+					name = unquoted
+				}
+				// primed names are renamed nested modules, see attrRenames
+				name = strings.TrimSuffix(name, "'")
+				elems = append(elems, name)
+			}
+			fn(line, unalias(elems))
+		}
+	}
+	return scanner.Err()
+}
+
+// stripComment cuts a # comment off a line of Nix,
+// minding # inside double-quoted strings.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// findModule returns the module a package path is in, and the package's
+// path within it, going by the longest module path that's a prefix of it.
+func findModule(mods map[Path]*Manifest, path Path) (Path, string) {
+	for p := string(path); ; {
+		if _, ok := mods[Path(p)]; ok {
+			sub := strings.TrimPrefix(strings.TrimPrefix(string(path), p), "/")
+			if sub == "" {
+				sub = "."
+			}
+			return Path(p), sub
+		}
+		i := strings.LastIndexByte(p, '/')
+		if i < 0 {
+			return "", ""
+		}
+		p = p[:i]
+	}
+}
+
+// builds reports whether a module's expression builds a package.
+// Hand-written expressions are taken at their word.
+func builds(man *Manifest, sub string) bool {
+	return man == nil || man.SubPackages == nil || slices.Contains(man.SubPackages, sub)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// annotation is a finding as CI systems show one: a level,
+// a place in the tree, and what's wrong there.
+type annotation struct {
+	// Level is error, warning or note, as in SARIF
+	Level string
+	File  string
+	Line  int
+	// Module is the module path, if it's about one
+	Module string
+	// Rule identifies the kind of finding, and RuleText describes it
+	Rule, RuleText string
+	Message        string
+	// HelpURI and Score are set for vulnerabilities, if known
+	HelpURI, Score string
+}
+
+// annotate locates a finding: a module's problems are at the file generated for it,
+// which is where a reviewer sees the dependency come in,
+// and budgets at go.mod, since they're about the whole graph.
+func annotate(err error) (annotation, error) {
+	a := annotation{Level: "error", Line: 1, Message: err.Error()}
+	var (
+		be *budgetError
+		ve *vulnError
+		me *moduleError
+	)
+	switch {
+	case errors.As(err, &be):
+		a.File = "go.mod"
+		a.Rule, a.RuleText = "mud/budget", "dependency budget exceeded"
+	case errors.As(err, &ve):
+		a.Module = string(ve.Path)
+		a.Level = sarifLevel(ve.Severity)
+		a.Rule, a.RuleText = ve.ID, ve.ID
+		if ve.Summary != "" {
+			a.RuleText = ve.Summary
+		}
+		a.HelpURI = "https://osv.dev/vulnerability/" + ve.ID
+		_, a.Score, _ = strings.Cut(ve.Severity, " ")
+	case errors.As(err, &me):
+		a.Module = me.Module
+		a.Rule, a.RuleText = "mud/"+me.Kind, kindTitles[me.Kind]
+		if a.RuleText == "" {
+			a.RuleText = me.Kind + " problem"
+		}
+	default:
+		return a, err
+	}
+	if a.Module != "" {
+		a.File = generatedFile(Path(a.Module))
+	}
+	return a, nil
+}
+
+// kindTitles describe the kinds of module errors findings have.
+var kindTitles = map[string]string{
+	"drift":  "stale expression",
+	"policy": "policy violation",
+}
+
+// reporter prints findings in the format picked with -report:
+// text, sarif, github for GitHub Actions annotations,
+// or a text/template given with -report-template, executed for each annotation.
+type reporter struct {
+	format, template string
+}
+
+func addReportFlags(fs *flag.FlagSet) *reporter {
+	r := &reporter{}
+	fs.StringVar(&r.format, "report", "text", "report findings as `format` (text, sarif or github)")
+	fs.StringVar(&r.template, "report-template", "", "report each finding with the text/template in `file`")
+	return r
+}
+
+func (r *reporter) validate() error {
+	if r.template != "" {
+		if r.format != "text" {
+			return errors.New("-report-template is its own format, so it can't be used with -report")
+		}
+		return nil
+	}
+	switch r.format {
+	case "text", "sarif", "github":
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q", r.format)
+}
+
+func (r *reporter) report(findings []error) error {
+	if r.format == "text" && r.template == "" {
+		for _, err := range findings {
+			fmt.Println(err)
+		}
+		return nil
+	}
+
+	var as []annotation
+	for _, err := range findings {
+		a, err := annotate(err)
+		if err != nil {
+			return err
+		}
+		as = append(as, a)
+	}
+	switch {
+	case r.template != "":
+		data, err := os.ReadFile(r.template)
+		if err != nil {
+			return err
+		}
+		t, err := template.New(r.template).Funcs(templateFuncs).Parse(string(data))
+		if err != nil {
+			return err
+		}
+		for _, a := range as {
+			if err := t.Execute(os.Stdout, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	case r.format == "sarif":
+		return writeSARIF(os.Stdout, as)
+	}
+	for _, a := range as {
+		fmt.Println(githubAnnotation(a))
+	}
+	return nil
+}
+
+// githubAnnotation formats an annotation as a GitHub Actions workflow command.
+func githubAnnotation(a annotation) string {
+	level := a.Level
+	if level == "note" {
+		level = "notice"
+	}
+	props := []string{"file=" + githubEscapeProperty(a.File), fmt.Sprintf("line=%d", a.Line)}
+	if a.RuleText != "" {
+		props = append(props, "title="+githubEscapeProperty(a.RuleText))
+	}
+	return fmt.Sprintf("::%s %s::%s", level, strings.Join(props, ","), githubEscape(a.Message))
+}
+
+func githubEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer(":", "%3A", ",", "%2C").Replace(githubEscape(s))
+}
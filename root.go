@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+var (
+	chdir    = flag.String("C", "", "run as if mud was started in `dir`")
+	rootOnly = flag.Bool("root-only", false, "require being run from the repository root instead of searching upwards for it")
+)
+
+// rootMarkers are the names whose presence marks a directory
+// as the repository root. .git is a file rather than a directory
+// in worktrees and submodules, so any kind of file will do.
+var rootMarkers = stringList{".git", ".jj", ".hg", ".mudroot"}
+
+func init() {
+	flag.Var(&rootMarkers, "root-marker", "also treat directories containing `name` as the repository root (repeatable)")
+}
+
+// enterRoot changes to the root of the repository mud was started in.
+func enterRoot() error {
+	// an explicit config file or cache dir is relative to where we were started
+	for _, p := range []*string{configPath, cacheDir} {
+		if *p == "" || (p == configPath && !isFlagSet("config")) {
+			continue
+		}
+		path, err := filepath.Abs(*p)
+		if err != nil {
+			return err
+		}
+		*p = path
+	}
+
+	if *chdir != "" {
+		if err := os.Chdir(*chdir); err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	for {
+		if ok, err := isRoot(dir); err != nil {
+			return err
+		} else if ok {
+			slog.Debug("found repository root", "dir", dir)
+			return os.Chdir(dir)
+		}
+
+		if *rootOnly {
+			return errors.New("mud must be run from the repository root")
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return errors.New("not inside a repository (none of " + rootMarkers.String() + " found in any parent directory)")
+		}
+		dir = parent
+	}
+}
+
+func isRoot(dir string) (bool, error) {
+	for _, marker := range rootMarkers {
+		_, err := os.Lstat(filepath.Join(dir, marker))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
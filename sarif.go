@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	slashpath "path"
+	"sort"
+	"strings"
+)
+
+// The subset of SARIF 2.1.0 that mud check -report=sarif writes,
+// which is what code scanning UIs need to show a finding.
+type (
+	sarifLog struct {
+		Schema  string     `json:"$schema"`
+		Version string     `json:"version"`
+		Runs    []sarifRun `json:"runs"`
+	}
+	sarifRun struct {
+		Tool    sarifTool     `json:"tool"`
+		Results []sarifResult `json:"results"`
+	}
+	sarifTool struct {
+		Driver sarifDriver `json:"driver"`
+	}
+	sarifDriver struct {
+		Name  string      `json:"name"`
+		Rules []sarifRule `json:"rules"`
+	}
+	sarifRule struct {
+		ID               string            `json:"id"`
+		ShortDescription sarifMessage      `json:"shortDescription"`
+		HelpURI          string            `json:"helpUri,omitempty"`
+		Properties       map[string]string `json:"properties,omitempty"`
+	}
+	sarifResult struct {
+		RuleID    string          `json:"ruleId"`
+		Level     string          `json:"level"`
+		Message   sarifMessage    `json:"message"`
+		Locations []sarifLocation `json:"locations"`
+	}
+	sarifMessage struct {
+		Text string `json:"text"`
+	}
+	sarifLocation struct {
+		PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+		LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+	}
+	sarifPhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine int `json:"startLine"`
+		} `json:"region"`
+	}
+	sarifLogicalLocation struct {
+		FullyQualifiedName string `json:"fullyQualifiedName"`
+		Kind               string `json:"kind"`
+	}
+)
+
+// writeSARIF writes mud check's findings as a SARIF log.
+func writeSARIF(w io.Writer, as []annotation) error {
+	rules := make(map[string]sarifRule)
+	results := []sarifResult{}
+	for _, a := range as {
+		rule := sarifRule{ID: a.Rule, HelpURI: a.HelpURI}
+		rule.ShortDescription.Text = a.RuleText
+		if a.Score != "" {
+			// GitHub sorts by this, when it's there
+			rule.Properties = map[string]string{"security-severity": a.Score}
+		}
+		rules[a.Rule] = rule
+
+		r := sarifResult{RuleID: a.Rule, Level: a.Level}
+		r.Message.Text = a.Message
+		var loc sarifLocation
+		loc.PhysicalLocation.ArtifactLocation.URI = a.File
+		loc.PhysicalLocation.Region.StartLine = a.Line
+		if a.Module != "" {
+			loc.LogicalLocations = []sarifLogicalLocation{{FullyQualifiedName: a.Module, Kind: "module"}}
+		}
+		r.Locations = []sarifLocation{loc}
+		results = append(results, r)
+	}
+
+	driver := sarifDriver{Name: "mud", Rules: []sarifRule{}}
+	for _, rule := range rules {
+		driver.Rules = append(driver.Rules, rule)
+	}
+	sort.Slice(driver.Rules, func(i, j int) bool { return driver.Rules[i].ID < driver.Rules[j].ID })
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	})
+}
+
+// sarifLevel maps a vulnerability's severity to a SARIF level.
+func sarifLevel(severity string) string {
+	rating, _, _ := strings.Cut(severity, " ")
+	switch rating {
+	case "CRITICAL", "HIGH":
+		return "error"
+	case "LOW", "NONE":
+		return "note"
+	}
+	return "warning"
+}
+
+// generatedFile is the file the configured generator writes a module's expression to.
+func generatedFile(path Path) string {
+	switch config.Generator {
+	case "buck2":
+		return slashpath.Join(gopkgsDir, "BUCK")
+	case "cue":
+		return slashpath.Join(gopkgsDir, "gopkgs.cue")
+	case "flake":
+		return slashpath.Join(gopkgsDir, "gopkgs.nix")
+	case "guix":
+		return slashpath.Join(gopkgsDir, "gopkgs.scm")
+	}
+	return slashpath.Join(gopkgsDir, path.dirName(), "default.nix")
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// servedGraph is the module graph mud serve answers from,
+// replaced as a whole when it's reloaded.
+type servedGraph struct {
+	modules map[Path]*Module
+	pkgs    map[Path]*Package
+	// importers are the modules importing each one directly
+	importers map[Path][]Path
+	// sums is go.sum, for checking modules before previewing them
+	sums   GoSum
+	loaded time.Time
+	// problems are what the load couldn't cover
+	problems error
+}
+
+// servedModule is a module as mud serve describes it.
+type servedModule struct {
+	Path     string   `json:"path"`
+	Version  string   `json:"version,omitempty"`
+	Replace  string   `json:"replace,omitempty"`
+	Packages []string `json:"packages"`
+	Deps     []string `json:"deps"`
+	Builds   []string `json:"builds,omitempty"`
+}
+
+// graphServer serves the graph over HTTP.
+type graphServer struct {
+	mu    sync.RWMutex
+	graph *servedGraph
+	// renderMu serializes manifest previews,
+	// since rendering caches hashes in the modules
+	renderMu sync.Mutex
+}
+
+// cmdServe loads the module graph and serves it as JSON over HTTP,
+// for dashboards and editors, reloading it whenever the module files change:
+//
+//	GET /status               when the graph was loaded, and what went wrong
+//	GET /modules              the external modules
+//	GET /modules/<path>       one of them
+//	GET /why/<path>           a chain of imports from the repository to a module or package
+//	GET /rdeps/<path>         the modules importing a module directly
+//	GET /manifest/<path>      the expression mud would generate for a module
+func cmdServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:8377", "listen on `address`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: mud serve [-addr address]")
+	}
+
+	s := &graphServer{}
+	files := watchFiles()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	prog.Done()
+	go func() {
+		// like -watch, but the graph is all that's redone
+		for {
+			time.Sleep(watchInterval)
+			current := watchFiles()
+			if sameTimes(files, current) {
+				continue
+			}
+			files = current
+			slog.Warn("inputs changed, reloading")
+			if err := s.reload(); err != nil {
+				slog.Error("couldn't reload, still serving the last graph", "error", err)
+			}
+			prog.Done()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.serveStatus)
+	mux.HandleFunc("GET /modules", s.serveModules)
+	mux.HandleFunc("GET /modules/{path...}", s.serveModule)
+	mux.HandleFunc("GET /why/{path...}", s.serveWhy)
+	mux.HandleFunc("GET /rdeps/{path...}", s.serveRdeps)
+	mux.HandleFunc("GET /manifest/{path...}", s.serveManifest)
+	slog.Info("serving the module graph", "addr", "http://"+*addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+// reload loads the graph again, and swaps it in if that worked.
+func (s *graphServer) reload() error {
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if !carryOn(err) {
+		return err
+	}
+	sums, sumErr := readGoSums()
+	if sumErr != nil {
+		return sumErr
+	}
+	g := &servedGraph{
+		modules:   modules,
+		pkgs:      make(map[Path]*Package),
+		importers: make(map[Path][]Path),
+		sums:      sums,
+		loaded:    time.Now(),
+		problems:  err,
+	}
+	// what generate works out before rendering, for the previews,
+	// done before the graph is shared, since it's written to the modules
+	var external []*Module
+	for _, path := range sortedPaths(modules) {
+		mod := modules[path]
+		for p, pkg := range mod.Pkgs {
+			g.pkgs[p] = pkg
+		}
+		for dep := range mod.Deps {
+			g.importers[dep.Path] = append(g.importers[dep.Path], path)
+			dep.importers = append(dep.importers, path)
+		}
+		if mod.IsExternal() {
+			external = append(external, mod)
+			if !mod.IsLocal() {
+				mod.sum = sums[mod.ModuleVersion()]
+			}
+		}
+	}
+	if config.RequiredBy {
+		markRequiredBy(modules)
+	}
+
+	// the attr renames are global, and used by the previews
+	s.renderMu.Lock()
+	defer s.renderMu.Unlock()
+	if err := checkAttrs(external); err != nil {
+		g.problems = errors.Join(g.problems, err)
+	}
+	s.mu.Lock()
+	s.graph = g
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *graphServer) current() *servedGraph {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.graph
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("couldn't write response", "error", err)
+	}
+}
+
+// module looks up the external module named in the request,
+// writing a 404 if there isn't one.
+func (g *servedGraph) module(w http.ResponseWriter, r *http.Request) *Module {
+	mod := g.modules[Path(r.PathValue("path"))]
+	if mod == nil || !mod.IsExternal() {
+		http.Error(w, fmt.Sprintf("no external module %s in the graph", r.PathValue("path")), http.StatusNotFound)
+		return nil
+	}
+	return mod
+}
+
+func describeModule(mod *Module) servedModule {
+	sm := servedModule{
+		Path:     string(mod.Path),
+		Replace:  mod.ReplacePath,
+		Packages: []string{},
+		Deps:     []string{},
+		Builds:   mod.BuildNames(),
+	}
+	if !mod.IsLocal() {
+		sm.Version = "v" + mod.Version
+	}
+	for _, path := range mod.PackageList() {
+		sm.Packages = append(sm.Packages, string(path))
+	}
+	for _, dep := range mod.DepModules() {
+		sm.Deps = append(sm.Deps, string(dep.Path))
+	}
+	return sm
+}
+
+func (s *graphServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	g := s.current()
+	status := struct {
+		Loaded   time.Time `json:"loaded"`
+		Modules  int       `json:"modules"`
+		Problems string    `json:"problems,omitempty"`
+	}{Loaded: g.loaded, Modules: len(g.modules)}
+	if g.problems != nil {
+		status.Problems = g.problems.Error()
+	}
+	writeJSON(w, status)
+}
+
+func (s *graphServer) serveModules(w http.ResponseWriter, r *http.Request) {
+	g := s.current()
+	mods := []servedModule{}
+	for _, path := range sortedPaths(g.modules) {
+		if mod := g.modules[path]; mod.IsExternal() {
+			mods = append(mods, describeModule(mod))
+		}
+	}
+	writeJSON(w, mods)
+}
+
+func (s *graphServer) serveModule(w http.ResponseWriter, r *http.Request) {
+	if mod := s.current().module(w, r); mod != nil {
+		writeJSON(w, describeModule(mod))
+	}
+}
+
+// serveWhy answers with the shortest chain of imports
+// from a first-party package to the module or package asked about,
+// like go mod why.
+func (s *graphServer) serveWhy(w http.ResponseWriter, r *http.Request) {
+	g := s.current()
+	target := Path(r.PathValue("path"))
+	matches := func(pkg *Package) bool {
+		return pkg.Path == target || pkg.Module.Path == target
+	}
+
+	var queue []Path
+	from := make(map[Path]Path)
+	for path, pkg := range g.pkgs {
+		if !pkg.Module.IsExternal() {
+			queue = append(queue, path)
+			from[path] = ""
+		}
+	}
+	sortPaths(queue)
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if pkg := g.pkgs[path]; matches(pkg) {
+			chain := []string{}
+			for p := path; p != ""; p = from[p] {
+				chain = append([]string{string(p)}, chain...)
+			}
+			writeJSON(w, struct {
+				Path  string   `json:"path"`
+				Chain []string `json:"chain"`
+			}{string(target), chain})
+			return
+		}
+		for _, imp := range g.pkgs[path].Imports.Sorted() {
+			if _, seen := from[imp]; !seen && g.pkgs[imp] != nil {
+				from[imp] = path
+				queue = append(queue, imp)
+			}
+		}
+	}
+	http.Error(w, fmt.Sprintf("nothing in the repository imports %s", target), http.StatusNotFound)
+}
+
+func (s *graphServer) serveRdeps(w http.ResponseWriter, r *http.Request) {
+	g := s.current()
+	mod := g.module(w, r)
+	if mod == nil {
+		return
+	}
+	importers := []string{}
+	for _, path := range g.importers[mod.Path] {
+		importers = append(importers, string(path))
+	}
+	sort.Strings(importers)
+	writeJSON(w, struct {
+		Path      string   `json:"path"`
+		Importers []string `json:"importers"`
+	}{string(mod.Path), importers})
+}
+
+// serveManifest renders the expression a run would generate for the module,
+// reusing the hash in its current one if the version hasn't changed,
+// and otherwise checking the module cache against go.sum before hashing it.
+// It's rendered from a copy of the module, so the graph shared between
+// requests isn't written to. Metadata and maintainers need fetching,
+// so they're left out, even when a run would include them.
+func (s *graphServer) serveManifest(w http.ResponseWriter, r *http.Request) {
+	if config.Generator != "buildgo" {
+		http.Error(w, "manifest previews need the buildgo generator, which renders modules one at a time", http.StatusNotImplemented)
+		return
+	}
+	g := s.current()
+	shared := g.module(w, r)
+	if shared == nil {
+		return
+	}
+	if shared.IsVendored() {
+		http.Error(w, fmt.Sprintf("%s is vendored, so its expression is hand-written", shared.Path), http.StatusNotFound)
+		return
+	}
+	mod := new(Module)
+	*mod = *shared
+
+	s.renderMu.Lock()
+	defer s.renderMu.Unlock()
+	t, err := externalTemplate()
+	if err == nil && mod.IsLocal() {
+		t = localTmpl
+	}
+	if err == nil && !mod.IsLocal() {
+		if err = mod.CheckMajor(); err == nil {
+			err = mod.reuseHash()
+		}
+		if err == nil && !mod.hashReused && !mod.hashedBySum() {
+			err = mod.VerifySum(g.sums)
+		}
+	}
+	var buffer bytes.Buffer
+	if err == nil {
+		err = t.Execute(&buffer, mod)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+)
+
+// sidecarName is the file next to a module's expression
+// with its metadata as JSON, if sidecars are enabled.
+const sidecarName = "metadata.json"
+
+// sidecar is the content of a module's metadata.json.
+type sidecar struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	// Replace is what the module is replaced by, if anything
+	Replace string `json:"replace,omitempty"`
+	// Hash is the SRI hash of the module's source, as Nix sees it,
+	// unless go.sum's is trusted instead
+	Hash string `json:"hash,omitempty"`
+	Sum  string `json:"goSum,omitempty"`
+	// Importers are the modules that import it directly
+	Importers []string `json:"importers"`
+	// RequiredBy are the first-party packages that import it directly,
+	// with the RequiredBy setting
+	RequiredBy []string `json:"requiredBy,omitempty"`
+	// Packages are the packages used from it
+	Packages []string `json:"packages"`
+	Builds   []string `json:"builds,omitempty"`
+	// Licenses are known if metadata was fetched
+	Licenses []string `json:"licenses,omitempty"`
+}
+
+func emitSidecar(mod *Module) error {
+	hash, err := mod.ModSRI()
+	if err != nil {
+		return err
+	}
+	s := &sidecar{
+		Path:      string(mod.Path),
+		Replace:   mod.ReplacePath,
+		Hash:      hash,
+		Sum:       mod.Sum(),
+		Importers: []string{},
+		Packages:  []string{},
+		Builds:    mod.BuildNames(),
+	}
+	if !mod.IsLocal() {
+		s.Version = "v" + mod.Version
+	}
+	for _, path := range mod.importers {
+		s.Importers = append(s.Importers, string(path))
+	}
+	sort.Strings(s.Importers)
+	s.Importers = slices.Compact(s.Importers)
+	for _, path := range mod.requiredBy {
+		s.RequiredBy = append(s.RequiredBy, string(path))
+	}
+	for _, path := range mod.PackageList() {
+		s.Packages = append(s.Packages, string(path))
+	}
+	if mod.meta != nil {
+		s.Licenses = mod.meta.Licenses
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return emitFile(mod.OutDir(), sidecarName, append(data, '\n'))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// handleSignals makes SIGINT and SIGTERM stop the run cleanly:
+// the files staged so far are removed, rather than left next to
+// the files they were to replace, and the repository is left as it was.
+// A commit already under way is finished first.
+// stop puts the default handling back.
+func handleSignals() (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-c:
+			prog.Done()
+			slog.Error("interrupted, cleaning up", "signal", sig)
+			if err := abortFiles(); err != nil {
+				slog.Error("couldn't remove staged files", "error", err)
+			}
+			os.Exit(exitError)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// stagedRecord lists the temporary names of the files staged by the run
+// in progress, one per line, so that if it dies without cleaning up,
+// the next run knows which files are its leftovers.
+// A run that finishes, committed or not, removes it.
+func stagedRecord() string {
+	return filepath.Join(stateDir(), "staged")
+}
+
+// recordStaged adds a staged file to the record.
+func recordStaged(tmp string) error {
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(stagedRecord(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, tmp)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// forgetStaged removes the record, once nothing staged is left over.
+func forgetStaged() {
+	if err := os.Remove(stagedRecord()); err != nil && !os.IsNotExist(err) {
+		slog.Warn("couldn't remove the record of staged files", "file", stagedRecord(), "error", err)
+	}
+}
+
+// staleTempRe matches the names of staged files:
+// name.tmp on Linux, and name.tmp followed by digits elsewhere.
+var staleTempRe = regexp.MustCompile(`.\.tmp[0-9]*$`)
+
+// staleTempFiles lists the temporary files runs that didn't finish
+// left behind that are still there: the staged files on the record,
+// and the state dir's half-written caches.
+// Nothing else is touched, since files named like them can be anyone's,
+// like a vendored module's test data.
+func staleTempFiles() []string {
+	var stale []string
+	if data, err := os.ReadFile(stagedRecord()); err == nil {
+		for _, name := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if name == "" || !staleTempRe.MatchString(name) {
+				continue
+			}
+			if fi, err := os.Lstat(name); err == nil && fi.Mode().IsRegular() {
+				stale = append(stale, name)
+			}
+		}
+	}
+
+	// the caches are written to name.tmp and renamed
+	if _, err := os.Lstat(statePath() + ".tmp"); err == nil {
+		stale = append(stale, statePath()+".tmp")
+	}
+	for _, dir := range []string{"load", "sumdb"} {
+		filepath.WalkDir(filepath.Join(stateDir(), dir), func(name string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // gone, or not there yet
+			}
+			if e.Type().IsRegular() && strings.HasSuffix(name, ".tmp") {
+				stale = append(stale, name)
+			}
+			return nil
+		})
+	}
+	return stale
+}
+
+// sweepTempFiles removes the temporary files left behind by runs
+// that didn't finish, so they don't get committed by accident,
+// saying which as it goes; mud doctor lists them without removing anything.
+// It's only safe with the repository locked, since another run's
+// staged files look the same.
+func sweepTempFiles() {
+	stale := staleTempFiles()
+	for _, name := range stale {
+		slog.Warn("removing a temporary file left by an interrupted run", "file", name)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			slog.Warn("couldn't remove it", "file", name, "error", err)
+			return
+		}
+	}
+	forgetStaged()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	slashpath "path"
+	"strings"
+)
+
+// SourceFilter leaves files out of the sources of matching modules,
+// or of every module if Pattern is empty.
+// Exclude patterns ending in a slash match directories by name,
+// patterns containing a slash match paths from the module root,
+// and other patterns match any file or directory by name.
+type SourceFilter struct {
+	Pattern string   `json:"pattern"`
+	Exclude []string `json:"exclude"`
+}
+
+// sourceExcludes returns the exclude patterns that apply to the module.
+// Only modules fetched through the module proxy can be filtered:
+// local replacements are filtered by name instead,
+// and git checkouts are hashed as Nix fetches them.
+func (m *Module) sourceExcludes() []string {
+	if m.IsLocal() || m.Fetcher() != "proxy" {
+		return nil
+	}
+	patterns := make(map[string]bool)
+	for _, filter := range config.SourceFilters {
+		if filter.Pattern == "" || matchPattern(filter.Pattern, string(m.Path)) {
+			for _, p := range filter.Exclude {
+				patterns[p] = true
+			}
+		}
+	}
+	return sortedKeys(patterns)
+}
+
+// SourceExcludes returns the module's exclude patterns as Nix strings.
+func (m *Module) SourceExcludes() []string {
+	var quoted []string
+	for _, p := range m.sourceExcludes() {
+		quoted = append(quoted, nixString(p))
+	}
+	return quoted
+}
+
+// excludePaths returns an excluder for source filter patterns.
+func excludePaths(patterns []string) excluder {
+	if len(patterns) == 0 {
+		return excludeNothing
+	}
+	return func(rel string, isDir bool) bool {
+		name := slashpath.Base(rel)
+		for _, p := range patterns {
+			var ok bool
+			switch {
+			case strings.HasSuffix(p, "/"):
+				ok, _ = slashpath.Match(strings.TrimSuffix(p, "/"), name)
+				ok = ok && isDir
+			case strings.Contains(p, "/"):
+				ok, _ = slashpath.Match(p, rel)
+			default:
+				ok, _ = slashpath.Match(p, name)
+			}
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+}
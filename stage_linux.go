@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mutable/tempfile"
+)
+
+// writeTemp writes data to an anonymous file in dir
+// and links it in next to name, returning the temporary name.
+func writeTemp(dir, name string, data []byte) (string, error) {
+	f, err := tempfile.Open(dir, name+".tmp", 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+
+	// TODO(edef): this ought to use unix.Unlink,
+	// but that's a bit more caution and effort than a non-library function warrants
+	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := tempfile.Commit(f); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// replaceFile moves a staged file into place.
+func replaceFile(tmp, path string) error {
+	return os.Rename(tmp, path)
+}
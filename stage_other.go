@@ -0,0 +1,44 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"runtime"
+	"time"
+)
+
+// writeTemp writes data to a new file in dir, named after name,
+// returning its name.
+func writeTemp(dir, name string, data []byte) (string, error) {
+	f, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// replaceFile moves a staged file into place.
+// Windows refuses to replace a file something else has open,
+// which for editors and virus scanners is usually brief, so it's retried.
+func replaceFile(tmp, path string) error {
+	err := os.Rename(tmp, path)
+	for i := 0; i < 20 && runtime.GOOS == "windows" && errors.Is(err, fs.ErrPermission); i++ {
+		time.Sleep(100 * time.Millisecond)
+		err = os.Rename(tmp, path)
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runState is what an incremental run remembers about the last run.
+type runState struct {
+	// Fingerprint covers all the inputs the generated files depend on
+	Fingerprint string `json:"fingerprint"`
+	// Sums are the go.sum entries the manifests were generated from
+	Sums map[string]string `json:"sums"`
+	// Outputs are the hashes of the files that were generated,
+	// keyed by slash-separated path
+	Outputs map[string]string `json:"outputs"`
+}
+
+var cacheDir = flag.String("cache-dir", "", "keep caches and state between runs in `dir` (default $XDG_CACHE_HOME/mud/<repo-id>)")
+
+// legacyStateDir is where state was kept before it moved out of the repository.
+const legacyStateDir = ".mud"
+
+var defaultStateDir string
+
+// stateDir holds mud's caches and state between runs:
+// nothing in it is needed, it just saves work.
+// It's outside the repository, in the user's cache directory,
+// under a name for the repository made from its path,
+// so each checkout or worktree has its own.
+func stateDir() string {
+	if *cacheDir != "" {
+		return *cacheDir
+	}
+	if defaultStateDir == "" {
+		defaultStateDir = legacyStateDir
+		root, err := filepath.Abs(".")
+		if err == nil {
+			if dir, err := os.UserCacheDir(); err == nil {
+				defaultStateDir = filepath.Join(dir, "mud", repoID(root))
+			}
+		}
+	}
+	return defaultStateDir
+}
+
+// repoID names the state directory of the repository at root.
+func repoID(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Base(root) + "-" + hex.EncodeToString(sum[:6])
+}
+
+// cmdCache manages the state directory:
+// mud cache dir prints where it is, and mud cache clean removes it,
+// along with the .mud directory older versions kept in the repository.
+func cmdCache(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mud cache dir|clean")
+	}
+	switch args[0] {
+	case "dir":
+		fmt.Println(stateDir())
+		return nil
+	case "clean":
+		for _, dir := range []string{stateDir(), legacyStateDir} {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				continue
+			}
+			slog.Info("removing", "dir", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown cache command %q (want dir or clean)", args[0])
+}
+
+func statePath() string {
+	return filepath.Join(stateDir(), "state.json")
+}
+
+func readState() (*runState, error) {
+	data, err := os.ReadFile(statePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		// a broken state file only costs us a full run
+		slog.Warn("ignoring unreadable state file", "file", statePath(), "error", err)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func writeState(state *runState) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+	tmp := statePath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath())
+}
+
+// upToDate reports whether the generated files still match the state,
+// which means nothing needs to be regenerated.
+func (s *runState) upToDate(fingerprint string) bool {
+	if s == nil || s.Fingerprint != fingerprint {
+		return false
+	}
+	for path, want := range s.Outputs {
+		data, err := os.ReadFile(filepath.FromSlash(path))
+		if err != nil || hashBytes(data) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// fingerprint hashes everything the generated files are derived from:
+// the module files, the settings, the go env, the tools,
+// and the imports of every Go file.
+// File contents beyond imports don't matter to mud, so they're not included,
+// except in local replacements, whose expressions have a hash of all of them.
+func fingerprint() (string, error) {
+	h := sha256.New()
+	io.WriteString(h, strings.Join(os.Args[1:], "\x00")+"\n")
+	for _, env := range goEnv() {
+		if strings.HasPrefix(env, "GO") || strings.HasPrefix(env, "CGO_") {
+			fmt.Fprintf(h, "env %q\n", env)
+		}
+	}
+	dirs, err := repoModules()
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		replaced, err := replaceDirs(dir)
+		if err != nil {
+			return "", err
+		}
+		for _, root := range replaced {
+			if err := hashTree(h, root); err != nil {
+				return "", err
+			}
+		}
+	}
+	var names []string
+	for _, dir := range dirs {
+		names = append(names, moduleFiles(dir)...)
+	}
+	if config.Template != "" {
+		names = append(names, config.Template)
+	}
+	for _, name := range append(names, *configPath) {
+		data, err := os.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		io.WriteString(h, name+"\n"+hashBytes(data)+"\n")
+	}
+
+	files, err := repoGoFiles()
+	if err != nil {
+		return "", err
+	}
+
+	fset := token.NewFileSet()
+	for _, path := range files {
+		f, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			// let the package load report it properly
+			io.WriteString(h, path+"\x00unparseable\n")
+			continue
+		}
+		// build constraints are in the comments before the package clause,
+		// as directives, which Text leaves out
+		io.WriteString(h, path+"\x00"+f.Name.Name)
+		for _, c := range f.Comments {
+			if c.Pos() < f.Package {
+				for _, line := range c.List {
+					io.WriteString(h, "\x00"+line.Text)
+				}
+			}
+		}
+		for _, imp := range f.Imports {
+			io.WriteString(h, "\x00"+imp.Path.Value)
+		}
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTree writes the name, size and modification time
+// of every file under root to h, or that it's missing.
+func hashTree(h io.Writer, root string) error {
+	fmt.Fprintf(h, "tree %q\n", root)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == root {
+			io.WriteString(h, "missing\n")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+}
+
+// repoGoFiles returns the Go files in the repository, sorted,
+// skipping hidden directories and testdata like the go command does.
+func repoGoFiles() ([]string, error) {
+	return goFilesIn(".")
+}
+
+// goFilesIn is repoGoFiles for the tree at root.
+func goFilesIn(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root && (strings.HasPrefix(d.Name(), ".") || d.Name() == "testdata") {
+			return fs.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".go") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
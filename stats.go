@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// moduleStats is mud stats' report on the external dependencies.
+type moduleStats struct {
+	Modules int `json:"modules"`
+	// SourceSize adds up the NAR sizes of the modules' sources
+	SourceSize int64 `json:"sourceSize"`
+	// Depth is how many modules lie between the repository
+	// and the dependency furthest from it, counting that one
+	Depth        int             `json:"depth"`
+	Largest      []moduleSize    `json:"largest"`
+	MostImported []moduleImports `json:"mostImported"`
+}
+
+type moduleSize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type moduleImports struct {
+	Path      string `json:"path"`
+	Importers int    `json:"importers"`
+}
+
+// cmdStats reports how many external modules there are, how big they are,
+// which are imported the most, and how deep the module graph goes.
+func cmdStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	top := fs.Int("top", 10, "list the `n` largest and most imported modules")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: mud stats [-json] [-top n]")
+	}
+
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if err != nil {
+		return err
+	}
+
+	stats := &moduleStats{Largest: []moduleSize{}, MostImported: []moduleImports{}}
+	importers := make(map[*Module]int)
+	var paths []Path
+	for path := range modules {
+		paths = append(paths, path)
+	}
+	sortPaths(paths)
+	var mods []*Module
+	for _, path := range paths {
+		mod := modules[path]
+		for dep := range mod.Deps {
+			importers[dep]++
+		}
+		if mod.IsExternal() && config.Selected(path) {
+			mods = append(mods, mod)
+		}
+	}
+	stats.Modules = len(mods)
+	stats.Depth = graphDepth(modules)
+
+	prog.Phase("measuring")
+	for i, mod := range mods {
+		prog.Step(i+1, len(mods), string(mod.Path))
+		size, err := mod.narSize()
+		if err != nil {
+			slog.Warn("couldn't measure module", "module", mod.Path, "error", err)
+			continue
+		}
+		stats.SourceSize += size
+		stats.Largest = append(stats.Largest, moduleSize{Path: string(mod.Path), Size: size})
+		if n := importers[mod]; n > 0 {
+			stats.MostImported = append(stats.MostImported, moduleImports{Path: string(mod.Path), Importers: n})
+		}
+	}
+	prog.Done()
+
+	// the sorts are stable, so ties stay in path order
+	sort.SliceStable(stats.Largest, func(i, j int) bool { return stats.Largest[i].Size > stats.Largest[j].Size })
+	sort.SliceStable(stats.MostImported, func(i, j int) bool {
+		return stats.MostImported[i].Importers > stats.MostImported[j].Importers
+	})
+	stats.Largest = stats.Largest[:min(*top, len(stats.Largest))]
+	stats.MostImported = stats.MostImported[:min(*top, len(stats.MostImported))]
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(stats)
+	}
+
+	fmt.Printf("external modules: %d\n", stats.Modules)
+	fmt.Printf("total source size: %s\n", formatSize(stats.SourceSize))
+	fmt.Printf("module graph depth: %d\n", stats.Depth)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if len(stats.Largest) > 0 {
+		fmt.Fprintln(w, "\nLARGEST\tSIZE")
+		for _, m := range stats.Largest {
+			fmt.Fprintf(w, "%s\t%s\n", m.Path, formatSize(m.Size))
+		}
+	}
+	if len(stats.MostImported) > 0 {
+		fmt.Fprintln(w, "\nMOST IMPORTED\tIMPORTERS")
+		for _, m := range stats.MostImported {
+			fmt.Fprintf(w, "%s\t%d\n", m.Path, m.Importers)
+		}
+	}
+	return w.Flush()
+}
+
+// narSize returns the size of the module's source as Nix stores it,
+// leaving out what its expression filters out.
+func (m *Module) narSize() (int64, error) {
+	if m.Dir == "" {
+		return 0, &notCachedError{Module: m.ModuleVersion().String()}
+	}
+	if m.IsLocal() {
+		patterns, err := m.localExcludes()
+		if err != nil {
+			return 0, err
+		}
+		return narSizeDir(m.Dir, excludeNames(patterns))
+	}
+	return narSizeDir(m.Dir, excludePaths(m.sourceExcludes()))
+}
+
+// graphDepth returns the length of the longest of the shortest chains of imports
+// from the repository's modules to each external one.
+// Modules can import each other, so the longest chains don't always end.
+func graphDepth(modules map[Path]*Module) int {
+	depth := make(map[*Module]int)
+	var queue []*Module
+	for _, mod := range modules {
+		if !mod.IsExternal() {
+			depth[mod] = 0
+			queue = append(queue, mod)
+		}
+	}
+	var deepest int
+	for len(queue) > 0 {
+		mod := queue[0]
+		queue = queue[1:]
+		for dep := range mod.Deps {
+			if _, ok := depth[dep]; ok {
+				continue
+			}
+			depth[dep] = depth[mod] + 1
+			deepest = depth[dep]
+			queue = append(queue, dep)
+		}
+	}
+	return deepest
+}
+
+// formatSize renders a size in bytes with a binary unit.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
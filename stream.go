@@ -0,0 +1,77 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	toStdout     = flag.Bool("stdout", false, "write generated files to stdout instead of the working tree")
+	stdoutFormat = flag.String("stdout-format", "stream", "format for -stdout: stream (files one after another, each under a ### path line) or tar")
+)
+
+var tarOut *tar.Writer
+
+// readOnly reports whether the working tree is being left alone,
+// so nothing else, like caches or the lock, should be written either.
+func readOnly() bool {
+	return *dryRun || *toStdout
+}
+
+func checkStdoutFlags() error {
+	if !*toStdout {
+		return nil
+	}
+	if *dryRun {
+		return fmt.Errorf("-stdout and -dry-run both write to stdout, pick one")
+	}
+	switch *stdoutFormat {
+	case "stream", "tar":
+		return nil
+	}
+	return fmt.Errorf("unknown -stdout-format %q", *stdoutFormat)
+}
+
+// streamFile writes a generated file to stdout,
+// with its path relative to the repository root.
+func streamFile(path string, data []byte) error {
+	path = filepath.ToSlash(path)
+	if *stdoutFormat == "stream" {
+		if _, err := fmt.Fprintf(os.Stdout, "### %s\n", path); err != nil {
+			return err
+		}
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	if tarOut == nil {
+		tarOut = tar.NewWriter(os.Stdout)
+	}
+	// a fixed mtime keeps the archive reproducible
+	err := tarOut.WriteHeader(&tar.Header{
+		Name:    path,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Unix(0, 0),
+		Format:  tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tarOut.Write(data)
+	return err
+}
+
+// finishStream completes the archive on stdout, if we're writing one.
+func finishStream() error {
+	if tarOut == nil {
+		return nil
+	}
+	err := tarOut.Close()
+	tarOut = nil
+	return err
+}
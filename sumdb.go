@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+)
+
+// knownSumDBs are the keys of the checksum databases the go command knows by name.
+var knownSumDBs = map[string]string{
+	"sum.golang.org":       "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8",
+	"sum.golang.google.cn": "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8",
+}
+
+// verifySumDB checks the go.sum hashes of mods against the checksum database,
+// the one the go command would use, skipping modules GONOSUMDB or GOPRIVATE match.
+// VerifySum has checked the module cache against go.sum,
+// so together they check the source is what everyone else gets.
+// It returns the failures by module; err is for not being able to check at all.
+func verifySumDB(mods []*Module, sums GoSum) (failures map[*Module]error, err error) {
+	out, err := goCmd("env", "GOSUMDB", "GONOSUMDB")
+	if err != nil {
+		return nil, err
+	}
+	env := strings.Split(string(out), "\n")
+	gosumdb, nosumdb := strings.TrimSpace(env[0]), strings.TrimSpace(env[1])
+	if gosumdb == "off" {
+		return nil, errors.New("GOSUMDB is off, so there's no checksum database to verify against")
+	}
+	ops, err := newSumDBOps(gosumdb)
+	if err != nil {
+		return nil, fmt.Errorf("GOSUMDB=%s: %w", gosumdb, err)
+	}
+	client := sumdb.NewClient(ops)
+	client.SetGONOSUMDB(nosumdb)
+
+	prog.Phase("verifying with " + ops.name)
+	failures = make(map[*Module]error)
+	var lookupErrs []error
+	var mu sync.Mutex
+	work := make(chan *Module)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mod := range work {
+				err := lookupSum(client, mod.ModuleVersion(), sums)
+				mu.Lock()
+				var me *moduleError
+				if errors.As(err, &me) {
+					failures[mod] = err
+				} else if err != nil {
+					lookupErrs = append(lookupErrs, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, mod := range mods {
+		work <- mod
+	}
+	close(work)
+	wg.Wait()
+
+	if msg := ops.securityError(); msg != "" {
+		return nil, fmt.Errorf("%s is misbehaving: %s", ops.name, msg)
+	}
+	// not being able to ask is no reason to think a module is bad,
+	// but it's no reason to trust it either
+	if len(lookupErrs) > 0 {
+		return nil, fmt.Errorf("couldn't verify %d modules with %s: %w", len(lookupErrs), ops.name, lookupErrs[0])
+	}
+	return failures, nil
+}
+
+// lookupSum checks the checksum database has the go.sum hash of a module version.
+// Hashes that differ are moduleErrors; other errors are from the lookup.
+func lookupSum(client *sumdb.Client, mv module.Version, sums GoSum) error {
+	lines, err := client.Lookup(mv.Path, mv.Version)
+	if errors.Is(err, sumdb.ErrGONOSUMDB) {
+		slog.Debug("not verifying private module", "module", mv.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mismatch := func(err error) error {
+		return &moduleError{Kind: "sumdb", Module: mv.String(), Err: err,
+			Hint: "go.sum doesn't have the hash everyone else gets: find out where it came from before trusting it"}
+	}
+	want := sums[mv]
+	if want == "" {
+		return &moduleError{Kind: "sum", Module: mv.String(), Err: errors.New("missing go.sum entry"), Hint: "run `go mod tidy` to add it"}
+	}
+	prefix := mv.Path + " " + mv.Version + " "
+	for _, line := range lines {
+		if got, ok := strings.CutPrefix(line, prefix); ok {
+			if got != want {
+				return mismatch(fmt.Errorf("go.sum has %s, but the checksum database has %s", want, got))
+			}
+			return nil
+		}
+	}
+	return mismatch(errors.New("the checksum database has no hash for it"))
+}
+
+// sumDBOps gives the sumdb client what it needs:
+// HTTP access to the database, and somewhere to remember
+// the latest signed tree and the tiles it's seen, which is the state dir.
+type sumDBOps struct {
+	name, key, url string
+	client         *http.Client
+
+	mu       sync.Mutex
+	latest   []byte
+	security []string
+}
+
+// newSumDBOps parses a GOSUMDB setting: a known name,
+// or name+hash+key, optionally followed by the database's URL.
+func newSumDBOps(gosumdb string) (*sumDBOps, error) {
+	key, url, _ := strings.Cut(gosumdb, " ")
+	if known, ok := knownSumDBs[key]; ok {
+		if url == "" {
+			url = "https://" + key
+		}
+		key = known
+	}
+	name, _, ok := strings.Cut(key, "+")
+	if !ok {
+		return nil, errors.New("unknown checksum database, and no key for it")
+	}
+	if url == "" {
+		url = "https://" + name
+	}
+	ops := &sumDBOps{
+		name:   name,
+		key:    key,
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	ops.latest, _ = os.ReadFile(ops.path(name + "/latest"))
+	return ops, nil
+}
+
+func (o *sumDBOps) path(file string) string {
+	return filepath.Join(stateDir(), "sumdb", filepath.FromSlash(file))
+}
+
+func (o *sumDBOps) ReadRemote(path string) ([]byte, error) {
+	resp, err := o.client.Get(o.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s%s: %s: %s", o.url, path, resp.Status, bytes.TrimSpace(body))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (o *sumDBOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	if file == o.name+"/latest" {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.latest, nil
+	}
+	return nil, fmt.Errorf("unknown sumdb config file %s", file)
+}
+
+func (o *sumDBOps) WriteConfig(file string, old, new []byte) error {
+	if file != o.name+"/latest" {
+		return fmt.Errorf("can't write sumdb config file %s", file)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !bytes.Equal(o.latest, old) {
+		return sumdb.ErrWriteConflict
+	}
+	o.latest = new
+	if readOnly() {
+		return nil
+	}
+	// remembering the latest tree is what catches the database rolling back
+	return o.write(file, new)
+}
+
+func (o *sumDBOps) ReadCache(file string) ([]byte, error) {
+	return os.ReadFile(o.path(file))
+}
+
+func (o *sumDBOps) WriteCache(file string, data []byte) {
+	if readOnly() {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.write(file, data); err != nil {
+		slog.Debug("couldn't cache sumdb tile", "file", file, "error", err)
+	}
+}
+
+func (o *sumDBOps) write(file string, data []byte) error {
+	path := o.path(file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (o *sumDBOps) Log(msg string) {
+	slog.Debug("sumdb", "msg", msg)
+}
+
+func (o *sumDBOps) SecurityError(msg string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.security = append(o.security, msg)
+}
+
+func (o *sumDBOps) securityError() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.security, "; ")
+}
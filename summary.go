@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// summary sorts the changes of a run into what happened to each module.
+type summary struct {
+	Added, Removed, Updated, Rehashed []moduleChange
+	// Other counts changed files that aren't module manifests
+	Other int
+}
+
+type moduleChange struct {
+	Path       string
+	OldVersion string
+	NewVersion string
+}
+
+func summarize(cs []fileChange) *summary {
+	s := &summary{}
+	for _, c := range cs {
+		old, new := manifestOf(c.Old), manifestOf(c.New)
+		if !isModuleExpr(c.Path) {
+			old, new = nil, nil
+		}
+		switch {
+		case old == nil && new == nil:
+			s.Other++
+		case old == nil:
+			s.Added = append(s.Added, moduleChange{Path: new.Path, NewVersion: new.Version})
+		case new == nil:
+			s.Removed = append(s.Removed, moduleChange{Path: old.Path, OldVersion: old.Version})
+		case old.Version != new.Version:
+			s.Updated = append(s.Updated, moduleChange{Path: new.Path, OldVersion: old.Version, NewVersion: new.Version})
+		case old.SHA256 != new.SHA256:
+			s.Rehashed = append(s.Rehashed, moduleChange{Path: new.Path, OldVersion: old.Version, NewVersion: new.Version})
+		default:
+			// the expression changed in some other way, like its deps
+			s.Other++
+		}
+	}
+	for _, list := range [][]moduleChange{s.Added, s.Removed, s.Updated, s.Rehashed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return s
+}
+
+// manifestOf returns m if it describes a module,
+// rather than being some other generated file, like the index.
+func manifestOf(m *Manifest) *Manifest {
+	if m == nil || m.Path == "" {
+		return nil
+	}
+	return m
+}
+
+// isModuleExpr reports whether a generated file is in the gopkgs dir,
+// where the expressions of external modules are:
+// first-party and tool program expressions elsewhere look much the same.
+func isModuleExpr(path string) bool {
+	path = filepath.ToSlash(path)
+	if config.ToolProgramsDir != "" && inDir(path, config.ToolProgramsDir) {
+		return false
+	}
+	return inDir(path, gopkgsDir)
+}
+
+func (s *summary) empty() bool {
+	return len(s.Added)+len(s.Removed)+len(s.Updated)+len(s.Rehashed)+s.Other == 0
+}
+
+// write prints the summary, one module per line, under a one-line overview.
+func (s *summary) write(w io.Writer) error {
+	var counts []string
+	count := func(n int, what string) {
+		if n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, what))
+		}
+	}
+	count(len(s.Added), "added")
+	count(len(s.Removed), "removed")
+	count(len(s.Updated), "updated")
+	count(len(s.Rehashed), "rehashed")
+	if s.Other == 1 {
+		count(s.Other, "other file changed")
+	} else {
+		count(s.Other, "other files changed")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mud: %s\n", strings.Join(counts, ", "))
+	for _, c := range s.Added {
+		fmt.Fprintf(&b, "  added    %s %s\n", c.Path, c.NewVersion)
+	}
+	for _, c := range s.Removed {
+		fmt.Fprintf(&b, "  removed  %s %s\n", c.Path, c.OldVersion)
+	}
+	for _, c := range s.Updated {
+		fmt.Fprintf(&b, "  updated  %s %s → %s\n", c.Path, c.OldVersion, c.NewVersion)
+	}
+	for _, c := range s.Rehashed {
+		fmt.Fprintf(&b, "  rehashed %s %s\n", c.Path, c.NewVersion)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// reportChanges prints a summary of the changes made since the start'th one.
+func reportChanges(start int) error {
+	s := summarize(changes[start:])
+	if *quiet {
+		return nil
+	}
+	if s.empty() {
+		slog.Info("everything is up to date")
+		return nil
+	}
+	prog.Done()
+	return s.write(os.Stderr)
+}
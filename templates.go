@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/mutable/base32"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// templateFuncs are the functions custom templates get, on top of text/template's.
+// Versions can be given with or without their leading v, like Module.Version.
+var templateFuncs = template.FuncMap{
+	// nixString quotes a value as a Nix string
+	"nixString": func(s any) string { return nixString(fmt.Sprint(s)) },
+	// nixAttr is the attribute path of a module or package in the index
+	"nixAttr": func(path any) string { return Path(fmt.Sprint(path)).NixAttr() },
+	// sri and base32 convert a hash in any of the Nix encodings mud reads
+	"sri": func(hash string) (string, error) {
+		sum, err := parseNixHash(hash)
+		if err != nil {
+			return "", err
+		}
+		return "sha256-" + base64.StdEncoding.EncodeToString(sum), nil
+	},
+	"base32": func(hash string) (string, error) {
+		sum, err := parseNixHash(hash)
+		if err != nil {
+			return "", err
+		}
+		return base32.Encode(sum), nil
+	},
+	// semverMajor is the major version, like v2
+	"semverMajor": func(v string) string { return semver.Major(withV(v)) },
+	// semverCompare is -1, 0 or 1 as a is older, the same as, or newer than b
+	"semverCompare": func(a, b string) int { return semver.Compare(withV(a), withV(b)) },
+	"isPseudo":      func(v string) bool { return module.IsPseudoVersion(withV(v)) },
+	// pseudoRev is the commit hash prefix a pseudo-version was made from
+	"pseudoRev":  func(v string) (string, error) { return module.PseudoVersionRev(withV(v)) },
+	"trimPrefix": strings.TrimPrefix,
+	"join":       join,
+	// gopkgsScope and gopkgsName are the attr path of the gopkgs dir,
+	// split for with gopkgsScope; [ gopkgsName.foo ]
+	"gopkgsScope": func() string { scope, _ := gopkgsAttr(); return scope },
+	"gopkgsName":  func() string { _, name := gopkgsAttr(); return name },
+}
+
+// join joins strings or paths with sep.
+func join(sep string, elems any) (string, error) {
+	switch elems := elems.(type) {
+	case []string:
+		return strings.Join(elems, sep), nil
+	case []Path:
+		ss := make([]string, len(elems))
+		for i, p := range elems {
+			ss[i] = string(p)
+		}
+		return strings.Join(ss, sep), nil
+	}
+	return "", fmt.Errorf("can't join %T", elems)
+}
+
+func withV(v string) string {
+	if strings.HasPrefix(v, "v") {
+		return v
+	}
+	return "v" + v
+}
+
+// externalTemplate returns the template for expressions of external modules:
+// the Template setting's, or the built-in buildGo.external one.
+// Custom templates are executed with the *Module,
+// so they see everything the built-in one does, and more:
+// ReplacePath and Dir, Importers, DepList, Builds and the like.
+func externalTemplate() (*template.Template, error) {
+	if config.Template == "" {
+		return tmpl, nil
+	}
+	data, err := os.ReadFile(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(config.Template).Funcs(templateFuncs).Parse(string(data))
+}
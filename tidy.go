@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+)
+
+// cmdTidy runs go mod tidy, regenerates the manifests,
+// removes the ones for modules that are no longer used,
+// and points out requirements that nothing imports.
+func cmdTidy(args []string) error {
+	if len(args) > 0 {
+		return errors.New("mud tidy takes no arguments")
+	}
+	if *dryRun {
+		return errors.New("mud tidy changes go.mod, so it can't be a dry run")
+	}
+
+	prog.Phase("tidying")
+	if _, err := goCmd("mod", "tidy"); err != nil {
+		return err
+	}
+
+	reuseHashes = true
+	return regenerateWith(func(modules map[Path]*Module) error {
+		if err := removeStale(modules); err != nil {
+			return err
+		}
+		return reportUnusedRequires(modules)
+	})
+}
+
+// removeStale removes generated manifests for modules that aren't in the graph.
+// Hand-written expressions are left alone.
+func removeStale(modules map[Path]*Module) error {
+	return filepath.WalkDir(gopkgsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() != "default.nix" || filepath.Dir(path) == filepath.FromSlash(gopkgsDir) {
+			return nil
+		}
+
+		man, err := readManifest(path)
+		if err != nil || man == nil {
+			return err
+		}
+		if mod := modules[Path(man.Path)]; mod != nil && mod.IsExternal() {
+			return nil
+		}
+		if err := removeFile(filepath.Join(filepath.Dir(path), sidecarName)); err != nil {
+			return err
+		}
+		return removeFile(path)
+	})
+}
+
+// reportUnusedRequires warns about requirements in the go.mod files
+// that none of the loaded packages use, as mud unused lists them.
+func reportUnusedRequires(modules map[Path]*Module) error {
+	dirs, err := repoModules()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		reqs, err := unusedRequires(modules, dir)
+		if err != nil {
+			return err
+		}
+		for _, req := range reqs {
+			slog.Warn("go.mod requires a module that no loaded package imports", "go.mod", filepath.Join(dir, "go.mod"), "module", req.Mod.Path, "version", req.Mod.Version)
+		}
+	}
+	return nil
+}
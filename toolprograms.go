@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	slashpath "path"
+	"path/filepath"
+	"regexp"
+	"text/template"
+)
+
+// toolTmpl renders a buildGo.program expression for an external command,
+// building it from the sources of its module, fetched like its expression does.
+var toolTmpl = template.Must(template.Must(template.Must(srcTmpl.Clone()).
+	AddParseTree("deps", depsTmpl.Tree)).New("tool").Parse(`
+# generator //tools/mud (DO NOT EDIT)
+{ platform, pkgs, ... }:
+
+# {{.Path}}, from {{.Module.Path}} v{{.Module.Version}}
+let
+  path = "{{.Module.Path}}";
+{{- template "src" .Module}}
+in
+platform.buildGo.program {
+  name = "{{.Name}}";
+{{- with .GoVersion}}
+  goVersion = "{{.}}";
+{{- end}}
+{{- with .Toolchain}}
+  toolchain = "{{.}}";
+{{- end}}
+  srcs = map (f: "${src}/{{.Dir}}${f}") [
+{{- range .Srcs}}
+    "{{.}}"
+{{- end}}
+  ];
+{{- template "deps" .}}
+}
+`[1:]))
+
+// toolProgram is the template data for a tool's program expression.
+type toolProgram struct {
+	firstPartyPackage
+	Module *Module
+	// Dir is the package's dir in its module, with a trailing slash
+	Dir string
+}
+
+// majorSuffixRe matches the last element of major version module paths.
+var majorSuffixRe = regexp.MustCompile(`^v[0-9]+$`)
+
+// toolName is what go install would name a command:
+// the last element of its path, or the one before a major version suffix.
+func toolName(path Path) string {
+	name := slashpath.Base(string(path))
+	if dir := slashpath.Dir(string(path)); majorSuffixRe.MatchString(name) && dir != "." {
+		name = slashpath.Base(dir)
+	}
+	return name
+}
+
+// generateToolPrograms writes a buildGo.program expression
+// to the tool programs dir for each external command the tools use,
+// in a dir named after the command.
+// Commands from local or vendored modules are left out,
+// since there are no fetched sources to build them from.
+func generateToolPrograms(modules map[Path]*Module) error {
+	if config.ToolProgramsDir == "" {
+		return nil
+	}
+
+	pkgs := make(map[Path]*Package)
+	for _, mod := range modules {
+		for path, pkg := range mod.Pkgs {
+			pkgs[path] = pkg
+		}
+	}
+
+	var paths []Path
+	for path := range toolPackages {
+		if pkg := pkgs[path]; pkg != nil && pkg.Name == "main" && pkg.Module.IsExternal() {
+			paths = append(paths, path)
+		}
+	}
+	sortPaths(paths)
+
+	names := make(map[string]Path)
+	var buffer bytes.Buffer
+	for _, path := range paths {
+		pkg := pkgs[path]
+		mod := pkg.Module
+		if mod.IsLocal() || mod.IsVendored() {
+			slog.Warn("not generating a program for a tool from a local module", "package", path, "module", mod.Path)
+			continue
+		}
+		name := toolName(path)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("tools %s and %s would both be built as %s", other, path, name)
+		}
+		names[name] = path
+
+		rel, err := filepath.Rel(mod.Dir, pkg.Dir())
+		if err != nil {
+			return err
+		}
+		goDirs, err := mod.goDirectives()
+		if err != nil {
+			return err
+		}
+		data := toolProgram{
+			firstPartyPackage: firstPartyPackage{
+				Name:      name,
+				Path:      path,
+				GoVersion: goDirs.Go,
+				Toolchain: goDirs.Toolchain,
+			},
+			Module: mod,
+		}
+		if rel != "." {
+			data.Dir = filepath.ToSlash(rel) + "/"
+		}
+		for _, f := range pkg.GoFiles {
+			data.Srcs = append(data.Srcs, filepath.Base(f))
+		}
+		for _, imp := range pkg.Imports.Sorted() {
+			if dep := pkgs[imp]; dep != nil && dep.Module.IsExternal() {
+				data.External = append(data.External, imp)
+			}
+		}
+
+		buffer.Reset()
+		if err := toolTmpl.Execute(&buffer, data); err != nil {
+			return err
+		}
+		if err := emitOwnedFile(filepath.Join(config.ToolProgramsDir, name), "default.nix", buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// cmdUnused lists the requirements in the repository's go.mod files
+// that none of the packages loaded from that module use, tools included.
+// Indirect requirements of modules in use are kept out of it,
+// since they pin versions for the module graph rather than for imports.
+func cmdUnused(args []string) error {
+	if len(args) > 0 {
+		return errors.New("mud unused takes no arguments")
+	}
+	if config.SkipTests {
+		return errors.New("mud unused needs the test packages loaded, or what only tests use looks unused: run it without -skip-tests")
+	}
+
+	prog.Phase("loading packages")
+	modules, err := loadModules()
+	if err != nil {
+		return err
+	}
+	dirs, err := repoModules()
+	if err != nil {
+		return err
+	}
+
+	var unused int
+	for _, dir := range dirs {
+		reqs, err := unusedRequires(modules, dir)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, "go.mod")
+		for _, r := range reqs {
+			unused++
+			fmt.Printf("%s:%d: %s is required, but nothing uses it\n", name, r.Syntax.Start.Line, r.Mod)
+		}
+	}
+
+	if unused > 0 {
+		return fmt.Errorf("%d requirements are unused, and can be dropped from go.mod", unused)
+	}
+	return nil
+}
+
+// unusedRequires returns the requirements in the go.mod in dir
+// that none of the packages loaded from that module use,
+// other than indirect ones some module in use requires too.
+func unusedRequires(modules map[Path]*Module, dir string) ([]*modfile.Require, error) {
+	f, err := readGoMod(dir)
+	if err != nil {
+		return nil, err
+	}
+	prog.Phase("reading module graph")
+	edges, err := readModuleGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+	// requirements of modules in use decide the versions selected
+	needed := make(map[Path]bool)
+	for _, e := range edges {
+		if from := modules[e.From]; from != nil && from.usedBy[dir] {
+			needed[e.To] = true
+		}
+	}
+
+	var unused []*modfile.Require
+	for _, r := range f.Require {
+		path := Path(r.Mod.Path)
+		if mod := modules[path]; mod != nil && mod.usedBy[dir] {
+			continue
+		}
+		if r.Indirect && needed[path] {
+			continue
+		}
+		unused = append(unused, r)
+	}
+	return unused, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+// cmdUpdate bumps a module with go get and regenerates the manifests it affects.
+// Modules whose version didn't change keep their recorded hashes,
+// so only what actually changed is rehashed and rewritten.
+func cmdUpdate(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mud update <module>[@version]")
+	}
+	target := args[0]
+	if !strings.Contains(target, "@") {
+		target += "@latest"
+	}
+
+	if *dryRun {
+		return errors.New("mud update changes go.mod, so it can't be a dry run")
+	}
+
+	prog.Phase("updating")
+	slog.Info("updating", "module", target)
+	path, _, _ := strings.Cut(target, "@")
+	if reason, held := holdReason(Path(path)); held {
+		versions, err := requiredVersions()
+		if err != nil {
+			return err
+		}
+		return &heldError{Module: path, From: versions[path], Reason: reason}
+	}
+	err := keepHolds(func() error {
+		_, err := goCmd("get", target)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	reuseHashes = true
+	return regenerate()
+}
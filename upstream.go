@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// listedModule is the subset of `go list -m -json` output we use.
+type listedModule struct {
+	Path       string
+	Version    string
+	Retracted  []string
+	Deprecated string
+	Error      *struct {
+		Err string
+	}
+}
+
+// checkUpstream asks the module proxy whether the pinned versions have been
+// retracted, or the modules deprecated, since they were picked.
+// Those are warnings, unless we're being strict.
+func checkUpstream(mods []*Module) error {
+	if config.Offline {
+		slog.Warn("not checking for retractions and deprecations offline")
+		return nil
+	}
+
+	var paths []string
+	for _, mod := range mods {
+		if !mod.IsLocal() {
+			paths = append(paths, string(mod.Path))
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	prog.Phase("checking upstream")
+	out, err := goCmd(append([]string{"list", "-m", "-e", "-u", "-retracted", "-json"}, paths...)...)
+	if err != nil {
+		return err
+	}
+
+	var problems []error
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m listedModule
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if m.Error != nil {
+			slog.Warn("couldn't check module upstream", "module", m.Path, "error", m.Error.Err)
+		}
+		if len(m.Retracted) > 0 {
+			problems = append(problems, fmt.Errorf("%s@%s has been retracted: %s", m.Path, m.Version, strings.Join(m.Retracted, "; ")))
+		}
+		if m.Deprecated != "" {
+			problems = append(problems, fmt.Errorf("%s is deprecated: %s", m.Path, m.Deprecated))
+		}
+	}
+
+	if config.Strict {
+		return errors.Join(problems...)
+	}
+	for _, err := range problems {
+		slog.Warn(err.Error())
+	}
+	return nil
+}
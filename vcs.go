@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// VCSInfo locates the commit a module version was made from,
+// so a module can be fetched from its repository instead of a proxy.
+type VCSInfo struct {
+	// Rev is the full commit hash if the go command recorded it,
+	// the abbreviated one from a pseudo-version,
+	// or the tag of a release version
+	Rev string
+	// URL is the repository URL, if it's known
+	URL string
+	// Subdir is the module's directory in the repository, if it isn't the root
+	Subdir string
+}
+
+// moduleOrigin is where the go command got a module from.
+type moduleOrigin struct {
+	VCS    string
+	URL    string
+	Subdir string
+	Hash   string
+}
+
+// moduleInfo is the subset of a module's .info file we use.
+type moduleInfo struct {
+	Version string
+	// Origin is where the go command got the module from, when it knows
+	Origin *moduleOrigin
+}
+
+// info reads the module's .info file from the download cache,
+// returning nil if it isn't there.
+func (m *Module) info() (*moduleInfo, error) {
+	name, err := downloadPath(m.ModuleVersion(), ".info")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info moduleInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &info, nil
+}
+
+// gitOrigin returns the git repository the module came from, if it's known:
+// resolveOrigins asks the go command, and otherwise it's in the .info file.
+func (m *Module) gitOrigin() (*moduleOrigin, error) {
+	o := m.origin
+	if o == nil {
+		info, err := m.info()
+		if err != nil || info == nil {
+			return nil, err
+		}
+		o = info.Origin
+	}
+	if o == nil || o.VCS != "git" {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// resolveOrigins asks the go command where the modules came from,
+// for those whose .info file doesn't say.
+func resolveOrigins(mods []*Module) error {
+	if config.Offline {
+		return nil
+	}
+	var unknown []module.Version
+	byVersion := make(map[module.Version]*Module)
+	for _, mod := range mods {
+		if mod.IsLocal() {
+			continue
+		}
+		info, err := mod.info()
+		if err != nil {
+			return err
+		}
+		if info != nil && info.Origin != nil {
+			continue
+		}
+		mv := mod.ModuleVersion()
+		unknown = append(unknown, mv)
+		byVersion[mv] = mod
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	downloaded, err := goModDownload(unknown...)
+	if err != nil {
+		return err
+	}
+	for _, d := range downloaded {
+		if mod := byVersion[module.Version{Path: d.Path, Version: d.Version}]; mod != nil && d.Origin != nil {
+			mod.origin = d.Origin
+		}
+	}
+	return nil
+}
+
+// VCS returns where the module's commit lives, when the module proxy's
+// path and version aren't enough to find it in the repository:
+// for pseudo-versions, and for modules in subdirectories of their repository.
+// It returns nil for release versions of modules at the root of their repository.
+func (m *Module) VCS() (*VCSInfo, error) {
+	mv := m.ModuleVersion()
+	vcs := &VCSInfo{URL: guessRepoURL(mv.Path)}
+	if vcs.URL != "" {
+		vcs.Subdir = guessSubdir(mv.Path)
+	}
+	pseudo := module.IsPseudoVersion(mv.Version)
+	if pseudo {
+		rev, err := module.PseudoVersionRev(mv.Version)
+		if err != nil {
+			return nil, err
+		}
+		vcs.Rev = rev
+	}
+
+	o, err := m.gitOrigin()
+	if err != nil {
+		return nil, err
+	}
+	if o != nil {
+		if o.URL != "" {
+			vcs.URL = o.URL
+		}
+		vcs.Subdir = o.Subdir
+		if o.Hash != "" && (!pseudo || strings.HasPrefix(o.Hash, vcs.Rev)) {
+			vcs.Rev = o.Hash
+		}
+	}
+
+	if !pseudo && vcs.Subdir == "" {
+		return nil, nil
+	}
+	if vcs.Rev == "" {
+		// tags for modules in subdirectories are prefixed with the subdirectory
+		vcs.Rev = "refs/tags/" + vcs.Subdir + "/" + mv.Version
+	}
+	return vcs, nil
+}
+
+// guessRepoURL returns the repository URL for modules on well-known hosts,
+// where the first two path elements after the host name the repository.
+func guessRepoURL(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	switch parts[0] {
+	case "github.com", "gitlab.com", "bitbucket.org":
+		return "https://" + strings.Join(parts[:3], "/")
+	}
+	return ""
+}
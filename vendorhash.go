@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cmdVendorHash prints the vendorHash nixpkgs' buildGoModule needs
+// to build the given packages: the hash of go mod vendor's output
+// for the module they're in, which is what its goModules derivation produces.
+// It's computed from the module cache, without building anything.
+func cmdVendorHash(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: mud vendorhash <package>...")
+	}
+
+	prog.Phase("vendoring")
+	seen := make(map[string]bool)
+	for _, pkg := range args {
+		out, err := goCmd("list", "-f", "{{with .Module}}{{.Path}} {{.Dir}}{{end}}", pkg)
+		if err != nil {
+			return err
+		}
+		path, dir, ok := strings.Cut(strings.TrimSpace(string(out)), " ")
+		if !ok {
+			return fmt.Errorf("%s isn't in a module", pkg)
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		hash, err := vendorHash(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Printf("%s %s\n", path, hash)
+	}
+	return nil
+}
+
+// vendorHash vendors the module in dir into a temporary directory
+// and returns its NAR hash as an SRI string, or null if there's nothing to vendor,
+// which is how buildGoModule wants modules without dependencies declared.
+func vendorHash(dir string) (string, error) {
+	tmp, err := os.MkdirTemp("", "mud-vendor")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	vendor := filepath.Join(tmp, "vendor")
+	if _, err := goCmd("-C", dir, "mod", "vendor", "-o", vendor); err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(vendor)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return "null", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sum, err := narHashDir(vendor, excludeNothing)
+	if err != nil {
+		return "", err
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var watch = flag.Bool("watch", false, "keep running, and regenerate whenever the module or tools files change")
+
+const watchInterval = time.Second
+
+// watchFiles returns the files whose changes affect the dependency graph,
+// with their modification times: those of every repository module,
+// the configuration, and the tools.
+func watchFiles() map[string]time.Time {
+	files := make(map[string]time.Time)
+	add := func(path string) {
+		if fi, err := os.Stat(path); err == nil {
+			files[path] = fi.ModTime()
+		}
+	}
+
+	dirs, err := repoModules()
+	if err != nil {
+		// the round reports it
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		for _, name := range moduleFiles(dir) {
+			add(name)
+		}
+	}
+	add(*configPath)
+	for _, tools := range config.Tools {
+		dir, recursive := strings.CutSuffix(tools.Pattern, "/...")
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && path != dir && !recursive {
+				return fs.SkipDir
+			}
+			if !d.IsDir() && strings.HasSuffix(path, ".go") {
+				add(path)
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// watchLoop regenerates once, and then again every time the watched files change.
+// Hashes from the previous round are reused for modules that didn't change.
+func watchLoop() error {
+	var last map[string]time.Time
+	for {
+		current := watchFiles()
+		if !sameTimes(last, current) {
+			if last != nil {
+				slog.Warn("inputs changed, regenerating")
+			}
+			resetLoad()
+			if err := regenerateLocked(); err != nil {
+				slog.Error(err.Error())
+			}
+			reuseHashes = true
+			changes = nil
+			emitted = make(map[string]string)
+			last = current
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// regenerateLocked is regenerate, holding the repository lock only while it runs,
+// so other mud commands can run in between.
+func regenerateLocked() error {
+	unlock, err := lockRepo()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer prog.Done()
+	return regenerate()
+}
+
+func sameTimes(a, b map[string]time.Time) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for name, t := range a {
+		if u, ok := b[name]; !ok || !t.Equal(u) {
+			return false
+		}
+	}
+	return true
+}